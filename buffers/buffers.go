@@ -2,17 +2,44 @@ package buffers
 
 import (
 	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/gldebug"
 	vmath "github.com/rwesterteiger/vectormath"
+	"log"
+	"unsafe"
 )
 
+// bufferOffset turns a byte offset into the buffer currently bound into the
+// pointer argument expected by VertexAttribPointer, DrawElements & co.
+func bufferOffset(offset int) gl.Pointer {
+	return gl.Pointer(unsafe.Add(nil, offset))
+}
+
 type VBO struct {
 	handle gl.Uint
-	nComponents gl.Int
+	layout *VertexLayout
+
+	size int // in bytes
+	usage gl.Enum
+}
+
+// MakeVBO uploads (possibly interleaved) vertex data described by layout.
+func MakeVBO(data []byte, layout *VertexLayout) (vbo *VBO) {
+	vbo = &VBO{ layout : layout, size : len(data), usage : gl.STATIC_DRAW }
+	gl.GenBuffers(1, &vbo.handle)
+	gldebug.Track(gldebug.Buffer, vbo.handle)
+
+	gl.BindBuffer(gl.ARRAY_BUFFER, vbo.handle)
+	defer gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+
+	gl.BufferData(gl.ARRAY_BUFFER, gl.Sizeiptr(len(data)), gl.Pointer(&data[0]), gl.STATIC_DRAW)
+
+	return
 }
 
 func MakeVBOFromVec3s(vecs []vmath.Vector3) (vbo *VBO) {
-	vbo = &VBO{ nComponents : 3 }
+	vbo = &VBO{ layout : MakeVertexLayout().AddFloat(0, 3), size : 12 * len(vecs), usage : gl.STATIC_DRAW }
 	gl.GenBuffers(1, &vbo.handle)
+	gldebug.Track(gldebug.Buffer, vbo.handle)
 
 	gl.BindBuffer(gl.ARRAY_BUFFER, vbo.handle)
 	defer gl.BindBuffer(gl.ARRAY_BUFFER, 0)
@@ -31,8 +58,9 @@ func MakeVBOFromVec3s(vecs []vmath.Vector3) (vbo *VBO) {
 
 
 func MakeVBOFromVec2s(vecs []vmath.Vector2) (vbo *VBO) {
-	vbo = &VBO{ nComponents : 2 }
+	vbo = &VBO{ layout : MakeVertexLayout().AddFloat(0, 2), size : 8 * len(vecs), usage : gl.STATIC_DRAW }
 	gl.GenBuffers(1, &vbo.handle)
+	gldebug.Track(gldebug.Buffer, vbo.handle)
 
 	gl.BindBuffer(gl.ARRAY_BUFFER, vbo.handle)
 	defer gl.BindBuffer(gl.ARRAY_BUFFER, 0)
@@ -48,15 +76,20 @@ func MakeVBOFromVec2s(vecs []vmath.Vector2) (vbo *VBO) {
 	return
 }
 
+// Delete frees the buffer. Deleting a VBO twice (e.g. once directly and once
+// through the VAO owning it) is harmless.
 func (vbo *VBO) Delete() {
+	if vbo.handle == 0 {
+		return
+	}
+
+	gldebug.Untrack(gldebug.Buffer, vbo.handle)
 	gl.DeleteBuffers(1, &vbo.handle)
+	vbo.handle = 0
 }
 
-func (vbo *VBO) vertexAttribPointer(idx gl.Uint) {
-	gl.BindBuffer(gl.ARRAY_BUFFER, vbo.handle)
-	defer gl.BindBuffer(gl.ARRAY_BUFFER, 0)
-
-	gl.VertexAttribPointer(idx, vbo.nComponents, gl.FLOAT, gl.TRUE, 0, nil)	
+func (vbo *VBO) GetLayout() *VertexLayout {
+	return vbo.layout
 }
 
 type VAO struct {
@@ -64,37 +97,225 @@ type VAO struct {
 	nElements gl.Sizei
 	handle gl.Uint
 	idxBufferHandle gl.Uint
+	idxType gl.Enum // gl.UNSIGNED_INT, gl.UNSIGNED_SHORT or gl.UNSIGNED_BYTE
+	idxSize int // size of one index in bytes
+
+	vbos []ownedVBO // attached VBOs, owned by the VAO
+}
+
+// ownedVBO is a VBO attached to a VAO with the attribute indices it still
+// feeds.
+type ownedVBO struct {
+	vbo *VBO
+	indices []gl.Uint
 }
 
 func MakeVAO(primitiveType gl.Enum, nElements int) (*VAO) {
 	vao := &VAO{primitiveType : primitiveType, nElements : gl.Sizei(nElements) }
 
 	gl.GenVertexArrays(1, &vao.handle)
+	gldebug.Track(gldebug.VertexArray, vao.handle)
 
 	return vao
 }
+// Delete frees the VAO, its index buffer and all VBOs attached to it.
 func (vao *VAO) Delete() {
-	gl.DeleteBuffers(1, &vao.handle)
+	gldebug.Untrack(gldebug.VertexArray, vao.handle)
+	gl.DeleteVertexArrays(1, &vao.handle)
+	vao.handle = 0
+
+	vao.deleteIndexBuffer()
+
+	for _, o := range vao.vbos {
+		o.vbo.Delete()
+	}
+	vao.vbos = nil
+}
+
+func (vao *VAO) deleteIndexBuffer() {
+	if vao.idxBufferHandle == 0 {
+		return
+	}
+
+	gldebug.Untrack(gldebug.Buffer, vao.idxBufferHandle)
 	gl.DeleteBuffers(1, &vao.idxBufferHandle)
+	vao.idxBufferHandle = 0
+}
+
+// own takes ownership of vbo, which feeds the given attribute indices. VBOs
+// attached before which no longer feed any attribute are deleted.
+func (vao *VAO) own(vbo *VBO, indices []gl.Uint) {
+	replaced := make(map[gl.Uint]bool)
+	for _, idx := range indices {
+		replaced[idx] = true
+	}
+
+	kept := vao.vbos[:0]
+	for _, o := range vao.vbos {
+		if o.vbo == vbo {
+			for _, idx := range o.indices {
+				if !replaced[idx] {
+					indices = append(indices, idx)
+				}
+			}
+			continue
+		}
+
+		var left []gl.Uint
+		for _, idx := range o.indices {
+			if !replaced[idx] {
+				left = append(left, idx)
+			}
+		}
+
+		if len(left) == 0 {
+			o.vbo.Delete()
+			continue
+		}
+
+		kept = append(kept, ownedVBO{ o.vbo, left })
+	}
+
+	vao.vbos = append(kept, ownedVBO{ vbo, indices })
 }
 
+func layoutIndices(layout *VertexLayout) (indices []gl.Uint) {
+	for _, a := range layout.Attribs {
+		indices = append(indices, a.Index)
+	}
+	return
+}
+
+// AttachVBO feeds the single attribute stored in vbo to attribute index
+// vtxAttributeIdx, ignoring the index recorded in the VBO's layout. Like all
+// Attach*VBO methods it hands ownership of vbo to the VAO.
 func (vao *VAO) AttachVBO(vtxAttributeIdx gl.Uint, vbo *VBO) {
+	if len(vbo.layout.Attribs) != 1 {
+		log.Fatal("AttachVBO needs a single-attribute VBO, use AttachInterleavedVBO instead")
+	}
+
 	vao.bind()
 	defer vao.unbind()
-	
-	vbo.vertexAttribPointer(vtxAttributeIdx)
-	gl.EnableVertexAttribArray(vtxAttributeIdx)
+
+	gl.BindBuffer(gl.ARRAY_BUFFER, vbo.handle)
+	defer gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+
+	a := vbo.layout.Attribs[0]
+	a.Index = vtxAttributeIdx
+	a.setup(vbo.layout.Stride)
+
+	vao.own(vbo, []gl.Uint{ vtxAttributeIdx })
+}
+
+// AttachInterleavedVBO sets up all attributes of vbo's layout at the
+// attribute indices recorded in the layout.
+func (vao *VAO) AttachInterleavedVBO(vbo *VBO) {
+	vao.bind()
+	defer vao.unbind()
+
+	gl.BindBuffer(gl.ARRAY_BUFFER, vbo.handle)
+	defer gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+
+	vbo.layout.setup()
+
+	vao.own(vbo, layoutIndices(vbo.layout))
+}
+
+// AttachInstancedVBO is like AttachInterleavedVBO, but the attributes of vbo
+// advance once every divisor instances instead of once per vertex.
+func (vao *VAO) AttachInstancedVBO(vbo *VBO, divisor int) {
+	vao.bind()
+	defer vao.unbind()
+
+	gl.BindBuffer(gl.ARRAY_BUFFER, vbo.handle)
+	defer gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+
+	vbo.layout.setup()
+
+	for _, a := range vbo.layout.Attribs {
+		gl.VertexAttribDivisor(a.Index, gl.Uint(divisor))
+	}
+
+	vao.own(vbo, layoutIndices(vbo.layout))
+}
+
+// AttachStreamBuffer sets up layout's attributes to read from the stream
+// buffer starting at offset (as returned by StreamBuffer.Alloc). Call it
+// again with the new offset whenever the data moves to another segment.
+func (vao *VAO) AttachStreamBuffer(sb *StreamBuffer, layout *VertexLayout, offset int) {
+	vao.bind()
+	defer vao.unbind()
+
+	gl.BindBuffer(gl.ARRAY_BUFFER, sb.handle)
+	defer gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+
+	for _, a := range layout.Attribs {
+		a.Offset += offset
+		a.setup(layout.Stride)
+	}
+}
+
+// SetElementCount changes the number of vertices (or indices) Draw renders,
+// e.g. for streamed geometry whose size changes from frame to frame.
+func (vao *VAO) SetElementCount(nElements int) {
+	vao.nElements = gl.Sizei(nElements)
 }
 
 func (vao *VAO) SetIndexBuffer(indices []uint32) {
-	gl.DeleteBuffers(1, &vao.idxBufferHandle)
+	vao.setIndexData(gl.Pointer(&indices[0]), len(indices), gl.UNSIGNED_INT, 4)
+}
+
+// SetIndexBuffer16 uses 16-bit indices, halving index memory for meshes with
+// at most 65536 vertices.
+func (vao *VAO) SetIndexBuffer16(indices []uint16) {
+	vao.setIndexData(gl.Pointer(&indices[0]), len(indices), gl.UNSIGNED_SHORT, 2)
+}
+
+func (vao *VAO) SetIndexBuffer8(indices []uint8) {
+	vao.setIndexData(gl.Pointer(&indices[0]), len(indices), gl.UNSIGNED_BYTE, 1)
+}
+
+// SetIndexBufferCompact stores indices with the smallest index type that can
+// represent the largest index.
+func (vao *VAO) SetIndexBufferCompact(indices []uint32) {
+	var maxIdx uint32
+	for _, idx := range indices {
+		if idx > maxIdx {
+			maxIdx = idx
+		}
+	}
+
+	switch {
+	case maxIdx <= 0xff:
+		indices8 := make([]uint8, len(indices))
+		for i, idx := range indices {
+			indices8[i] = uint8(idx)
+		}
+		vao.SetIndexBuffer8(indices8)
+	case maxIdx <= 0xffff:
+		indices16 := make([]uint16, len(indices))
+		for i, idx := range indices {
+			indices16[i] = uint16(idx)
+		}
+		vao.SetIndexBuffer16(indices16)
+	default:
+		vao.SetIndexBuffer(indices)
+	}
+}
+
+func (vao *VAO) setIndexData(data gl.Pointer, nIndices int, idxType gl.Enum, idxSize int) {
+	vao.deleteIndexBuffer()
 	gl.GenBuffers(1, &vao.idxBufferHandle)
+	gldebug.Track(gldebug.Buffer, vao.idxBufferHandle)
+
+	vao.idxType = idxType
+	vao.idxSize = idxSize
 
 	vao.bind()
 	defer vao.unbind()
 
 	gl.BindBuffer(gl.ELEMENT_ARRAY_BUFFER, vao.idxBufferHandle)
-	gl.BufferData(gl.ELEMENT_ARRAY_BUFFER, gl.Sizeiptr(4 * len(indices)), gl.Pointer(&indices[0]), gl.STATIC_DRAW)
+	gl.BufferData(gl.ELEMENT_ARRAY_BUFFER, gl.Sizeiptr(idxSize * nIndices), data, gl.STATIC_DRAW)
 }
 	
 func (vao *VAO) bind() {
@@ -110,8 +331,47 @@ func (vao *VAO) Draw() {
 	defer vao.unbind()
 
 	if vao.idxBufferHandle != 0 {
-		gl.DrawElements(vao.primitiveType, vao.nElements, gl.UNSIGNED_INT, nil)
+		gl.DrawElements(vao.primitiveType, vao.nElements, vao.idxType, nil)
 	} else {
 		gl.DrawArrays(vao.primitiveType, 0, vao.nElements)
 	}
 }
+
+// DrawRange draws count elements starting at element first. For indexed VAOs
+// baseVertex is added to every index, so several sub-meshes can share one VAO
+// and index buffer; for non-indexed VAOs the vertices
+// [baseVertex+first, baseVertex+first+count) are drawn.
+func (vao *VAO) DrawRange(first, count, baseVertex int) {
+	vao.bind()
+	defer vao.unbind()
+
+	if vao.idxBufferHandle != 0 {
+		gl.DrawElementsBaseVertex(vao.primitiveType, gl.Sizei(count), vao.idxType, bufferOffset(first * vao.idxSize), gl.Int(baseVertex))
+	} else {
+		gl.DrawArrays(vao.primitiveType, gl.Int(baseVertex + first), gl.Sizei(count))
+	}
+}
+
+// DrawInstanced draws nInstances copies of the whole VAO.
+func (vao *VAO) DrawInstanced(nInstances int) {
+	vao.bind()
+	defer vao.unbind()
+
+	if vao.idxBufferHandle != 0 {
+		gl.DrawElementsInstanced(vao.primitiveType, vao.nElements, vao.idxType, nil, gl.Sizei(nInstances))
+	} else {
+		gl.DrawArraysInstanced(vao.primitiveType, 0, vao.nElements, gl.Sizei(nInstances))
+	}
+}
+
+// DrawRangeInstanced is the instanced counterpart of DrawRange.
+func (vao *VAO) DrawRangeInstanced(first, count, baseVertex, nInstances int) {
+	vao.bind()
+	defer vao.unbind()
+
+	if vao.idxBufferHandle != 0 {
+		gl.DrawElementsInstancedBaseVertex(vao.primitiveType, gl.Sizei(count), vao.idxType, bufferOffset(first * vao.idxSize), gl.Sizei(nInstances), gl.Int(baseVertex))
+	} else {
+		gl.DrawArraysInstanced(vao.primitiveType, gl.Int(baseVertex + first), gl.Sizei(count), gl.Sizei(nInstances))
+	}
+}
@@ -0,0 +1,198 @@
+package buffers
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/gldebug"
+	"log"
+	"time"
+	"unsafe"
+)
+
+// MakeDynamicVBO allocates capacity bytes of uninitialized DYNAMIC_DRAW
+// storage meant to be rewritten with Update or OrphanAndUpdate.
+func MakeDynamicVBO(capacity int, layout *VertexLayout) (vbo *VBO) {
+	vbo = &VBO{ layout : layout, usage : gl.DYNAMIC_DRAW }
+	gl.GenBuffers(1, &vbo.handle)
+	gldebug.Track(gldebug.Buffer, vbo.handle)
+	vbo.realloc(capacity)
+
+	return
+}
+
+func (vbo *VBO) realloc(size int) {
+	gl.BindBuffer(gl.ARRAY_BUFFER, vbo.handle)
+	defer gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+
+	gl.BufferData(gl.ARRAY_BUFFER, gl.Sizeiptr(size), nil, vbo.usage)
+	vbo.size = size
+}
+
+func (vbo *VBO) Size() int {
+	return vbo.size
+}
+
+// Update overwrites part of the VBO with BufferSubData. If the GPU is still
+// reading the range this stalls; use OrphanAndUpdate or a StreamBuffer for
+// data that is rewritten every frame.
+func (vbo *VBO) Update(offset int, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	if offset < 0 || offset + len(data) > vbo.size {
+		log.Fatalf("VBO update out of range (offset %d, size %d, buffer size %d)", offset, len(data), vbo.size)
+	}
+
+	gl.BindBuffer(gl.ARRAY_BUFFER, vbo.handle)
+	defer gl.BindBuffer(gl.ARRAY_BUFFER, 0)
+
+	gl.BufferSubData(gl.ARRAY_BUFFER, gl.Intptr(offset), gl.Sizeiptr(len(data)), gl.Pointer(&data[0]))
+}
+
+// Orphan detaches the current storage from the buffer name. Draw calls still
+// in flight keep using the old storage while the driver hands out a fresh
+// block, so the next update does not have to wait for them.
+func (vbo *VBO) Orphan() {
+	vbo.realloc(vbo.size)
+}
+
+// OrphanAndUpdate orphans the buffer and uploads data into the new storage,
+// growing it if data does not fit.
+func (vbo *VBO) OrphanAndUpdate(data []byte) {
+	size := vbo.size
+	if len(data) > size {
+		size = len(data)
+	}
+
+	vbo.realloc(size)
+	vbo.Update(0, data)
+}
+
+// StreamBuffer is a persistently mapped ring buffer for data that is written
+// by the CPU every frame (particles, debug lines, ...). The buffer is split
+// into nSegments segments; each frame writes into the next segment and a
+// fence per segment makes sure the GPU has finished reading it before it is
+// overwritten again.
+//
+// Usage per frame: BeginFrame, any number of Alloc/Write calls, the draw
+// calls using the returned offsets, EndFrame.
+type StreamBuffer struct {
+	handle gl.Uint
+	target gl.Enum
+
+	segmentSize int
+	mapped []byte
+	fences []gl.Sync
+
+	segment int // segment written this frame
+	head int // next free byte within the segment
+}
+
+const streamBufferFenceTimeout = uint64(time.Second)
+
+func MakeStreamBuffer(target gl.Enum, segmentSize, nSegments int) (s *StreamBuffer) {
+	s = &StreamBuffer{ target : target, segmentSize : segmentSize, fences : make([]gl.Sync, nSegments), segment : nSegments - 1 }
+
+	size := segmentSize * nSegments
+	flags := gl.Bitfield(gl.MAP_WRITE_BIT | gl.MAP_PERSISTENT_BIT | gl.MAP_COHERENT_BIT)
+
+	gl.GenBuffers(1, &s.handle)
+	gldebug.Track(gldebug.Buffer, s.handle)
+	gl.BindBuffer(target, s.handle)
+	defer gl.BindBuffer(target, 0)
+
+	gl.BufferStorage(target, gl.Sizeiptr(size), nil, flags)
+	ptr := gl.MapBufferRange(target, 0, gl.Sizeiptr(size), flags)
+
+	if ptr == nil {
+		log.Fatal("Error mapping stream buffer!")
+	}
+
+	s.mapped = unsafe.Slice((*byte)(ptr), size)
+	return
+}
+
+func (s *StreamBuffer) Delete() {
+	for i := range s.fences {
+		s.deleteFence(i)
+	}
+
+	gl.BindBuffer(s.target, s.handle)
+	gl.UnmapBuffer(s.target)
+	gl.BindBuffer(s.target, 0)
+
+	gldebug.Untrack(gldebug.Buffer, s.handle)
+	gl.DeleteBuffers(1, &s.handle)
+	s.mapped = nil
+}
+
+func (s *StreamBuffer) GetHandle() gl.Uint {
+	return s.handle
+}
+
+func (s *StreamBuffer) deleteFence(i int) {
+	if s.fences[i] != nil {
+		gl.DeleteSync(s.fences[i])
+		s.fences[i] = nil
+	}
+}
+
+// BeginFrame advances to the next segment, waiting until the GPU is done with
+// the draws that read it nSegments frames ago.
+func (s *StreamBuffer) BeginFrame() {
+	s.segment = (s.segment + 1) % len(s.fences)
+	s.head = 0
+
+	fence := s.fences[s.segment]
+	if fence == nil {
+		return
+	}
+
+	for {
+		result := gl.ClientWaitSync(fence, gl.SYNC_FLUSH_COMMANDS_BIT, gl.Uint64(streamBufferFenceTimeout))
+
+		if result == gl.ALREADY_SIGNALED || result == gl.CONDITION_SATISFIED {
+			break
+		}
+
+		if result == gl.WAIT_FAILED {
+			log.Fatal("Error waiting for stream buffer fence!")
+		}
+	}
+
+	s.deleteFence(s.segment)
+}
+
+// EndFrame inserts a fence after all draws issued so far, protecting the
+// current segment until the GPU has consumed it.
+func (s *StreamBuffer) EndFrame() {
+	s.deleteFence(s.segment)
+	s.fences[s.segment] = gl.FenceSync(gl.SYNC_GPU_COMMANDS_COMPLETE, 0)
+}
+
+// Alloc reserves size bytes in the current segment, aligned to align bytes
+// relative to the start of the buffer. It returns the offset into the buffer
+// (for attribute pointers and draw calls) and the mapped memory to write to.
+func (s *StreamBuffer) Alloc(size, align int) (offset int, mem []byte) {
+	base := s.segment * s.segmentSize
+	start := base + s.head
+
+	if align > 1 && start % align != 0 {
+		start += align - start % align
+	}
+
+	if start + size > base + s.segmentSize {
+		log.Fatalf("Stream buffer segment overflow (%d bytes requested, segment size %d)", size, s.segmentSize)
+	}
+
+	s.head = start + size - base
+	return start, s.mapped[start : start+size]
+}
+
+// Write copies data into the current segment and returns its buffer offset.
+func (s *StreamBuffer) Write(data []byte, align int) (offset int) {
+	offset, mem := s.Alloc(len(data), align)
+	copy(mem, data)
+
+	return
+}
@@ -0,0 +1,87 @@
+package buffers
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/gldebug"
+)
+
+// DrawElementsIndirectCommand mirrors the command struct consumed by
+// glMultiDrawElementsIndirect. It has no padding, so a slice of it can be
+// uploaded as-is.
+type DrawElementsIndirectCommand struct {
+	Count uint32 // number of indices
+	InstanceCount uint32
+	FirstIndex uint32 // offset into the index buffer, in indices
+	BaseVertex int32 // added to every index
+	BaseInstance uint32 // first instance; also usable to look up per-draw data
+}
+
+const drawElementsIndirectCommandSize = 20
+
+// IndirectBuffer holds draw commands for MultiDrawIndirect.
+type IndirectBuffer struct {
+	handle gl.Uint
+	capacity int // in commands
+	nCommands int
+}
+
+func MakeIndirectBuffer(capacity int) (b *IndirectBuffer) {
+	b = new(IndirectBuffer)
+	gl.GenBuffers(1, &b.handle)
+	gldebug.Track(gldebug.Buffer, b.handle)
+	b.realloc(capacity)
+
+	return
+}
+
+func (b *IndirectBuffer) realloc(capacity int) {
+	gl.BindBuffer(gl.DRAW_INDIRECT_BUFFER, b.handle)
+	defer gl.BindBuffer(gl.DRAW_INDIRECT_BUFFER, 0)
+
+	gl.BufferData(gl.DRAW_INDIRECT_BUFFER, gl.Sizeiptr(capacity * drawElementsIndirectCommandSize), nil, gl.DYNAMIC_DRAW)
+	b.capacity = capacity
+}
+
+func (b *IndirectBuffer) Delete() {
+	gldebug.Untrack(gldebug.Buffer, b.handle)
+	gl.DeleteBuffers(1, &b.handle)
+}
+
+func (b *IndirectBuffer) GetCommandCount() int {
+	return b.nCommands
+}
+
+// Upload replaces the stored commands, growing the buffer if needed.
+func (b *IndirectBuffer) Upload(cmds []DrawElementsIndirectCommand) {
+	b.nCommands = len(cmds)
+	if len(cmds) == 0 {
+		return
+	}
+
+	if len(cmds) > b.capacity {
+		b.realloc(len(cmds))
+	}
+
+	gl.BindBuffer(gl.DRAW_INDIRECT_BUFFER, b.handle)
+	defer gl.BindBuffer(gl.DRAW_INDIRECT_BUFFER, 0)
+
+	gl.BufferSubData(gl.DRAW_INDIRECT_BUFFER, 0, gl.Sizeiptr(len(cmds) * drawElementsIndirectCommandSize), gl.Pointer(&cmds[0]))
+}
+
+// MultiDrawIndirect issues all commands stored in b with a single call. The
+// VAO has to be indexed. To tell the commands apart without
+// GL_ARB_shader_draw_parameters, give each a distinct BaseInstance and read
+// a per-instance attribute (divisor 1), which starts at BaseInstance.
+func (vao *VAO) MultiDrawIndirect(b *IndirectBuffer) {
+	if b.nCommands == 0 {
+		return
+	}
+
+	vao.bind()
+	defer vao.unbind()
+
+	gl.BindBuffer(gl.DRAW_INDIRECT_BUFFER, b.handle)
+	defer gl.BindBuffer(gl.DRAW_INDIRECT_BUFFER, 0)
+
+	gl.MultiDrawElementsIndirect(vao.primitiveType, vao.idxType, nil, gl.Sizei(b.nCommands), 0)
+}
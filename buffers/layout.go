@@ -0,0 +1,284 @@
+package buffers
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"encoding/binary"
+	"log"
+	"math"
+	vmath "github.com/rwesterteiger/vectormath"
+)
+
+// AttribMode selects how the shader sees an attribute's data.
+type AttribMode int
+
+const (
+	AttribFloat AttribMode = iota // float data, or integer data converted to float as-is
+	AttribNormalized // integer data mapped to [0,1] (unsigned) or [-1,1] (signed)
+	AttribInteger // integer data fed to int/uint/ivecN/uvecN inputs via VertexAttribIPointer
+)
+
+// VertexAttrib describes a single vertex attribute inside a VBO.
+type VertexAttrib struct {
+	Index gl.Uint // attribute location in the shader
+	Components int // 1..4
+	Type gl.Enum // gl.FLOAT, gl.HALF_FLOAT, gl.INT, gl.UNSIGNED_BYTE, ...
+	Mode AttribMode
+	Offset int // byte offset from the start of a vertex
+}
+
+// VertexLayout describes how the attributes of one (possibly interleaved)
+// VBO are laid out in memory. Stride is the distance in bytes between
+// consecutive vertices.
+type VertexLayout struct {
+	Stride int
+	Attribs []VertexAttrib
+}
+
+func MakeVertexLayout() *VertexLayout {
+	return new(VertexLayout)
+}
+
+func typeSize(t gl.Enum) int {
+	switch t {
+	case gl.BYTE, gl.UNSIGNED_BYTE:
+		return 1
+	case gl.SHORT, gl.UNSIGNED_SHORT, gl.HALF_FLOAT:
+		return 2
+	case gl.INT, gl.UNSIGNED_INT, gl.FLOAT:
+		return 4
+	case gl.DOUBLE:
+		return 8
+	}
+
+	log.Fatalf("Unsupported vertex attribute type 0x%x", t)
+	return 0
+}
+
+// Add appends an attribute directly after the previous one, padded to a
+// 4-byte boundary, and grows the stride accordingly.
+func (l *VertexLayout) Add(index gl.Uint, components int, t gl.Enum, mode AttribMode) *VertexLayout {
+	if mode == AttribInteger && (t == gl.FLOAT || t == gl.HALF_FLOAT || t == gl.DOUBLE) {
+		log.Fatalf("Integer vertex attribute %d with non-integer type 0x%x", index, t)
+	}
+
+	offset := (l.Stride + 3) &^ 3
+	l.Attribs = append(l.Attribs, VertexAttrib{ Index : index, Components : components, Type : t, Mode : mode, Offset : offset })
+	l.Stride = offset + components * typeSize(t)
+
+	return l
+}
+
+func (l *VertexLayout) AddFloat(index gl.Uint, components int) *VertexLayout {
+	return l.Add(index, components, gl.FLOAT, AttribFloat)
+}
+
+func (l *VertexLayout) AddHalf(index gl.Uint, components int) *VertexLayout {
+	return l.Add(index, components, gl.HALF_FLOAT, AttribFloat)
+}
+
+// AddMat4 appends a column-major float mat4, which occupies the four
+// consecutive attribute indices index..index+3 (one vec4 per column).
+func (l *VertexLayout) AddMat4(index gl.Uint) *VertexLayout {
+	for col := gl.Uint(0); col < 4; col++ {
+		l.AddFloat(index + col, 4)
+	}
+
+	return l
+}
+
+// AddNormalized appends an integer attribute (e.g. gl.UNSIGNED_BYTE colors or
+// gl.BYTE normals) that the shader reads as normalized floats.
+func (l *VertexLayout) AddNormalized(index gl.Uint, components int, t gl.Enum) *VertexLayout {
+	return l.Add(index, components, t, AttribNormalized)
+}
+
+// AddInteger appends an attribute for int/uint shader inputs.
+func (l *VertexLayout) AddInteger(index gl.Uint, components int, t gl.Enum) *VertexLayout {
+	return l.Add(index, components, t, AttribInteger)
+}
+
+// setup issues the attribute pointer calls for the VBO currently bound to
+// ARRAY_BUFFER and enables the attributes. A VAO has to be bound.
+func (l *VertexLayout) setup() {
+	for _, a := range l.Attribs {
+		a.setup(l.Stride)
+	}
+}
+
+func (a *VertexAttrib) setup(stride int) {
+	switch a.Mode {
+	case AttribInteger:
+		gl.VertexAttribIPointer(a.Index, gl.Int(a.Components), a.Type, gl.Sizei(stride), bufferOffset(a.Offset))
+	case AttribNormalized:
+		gl.VertexAttribPointer(a.Index, gl.Int(a.Components), a.Type, gl.TRUE, gl.Sizei(stride), bufferOffset(a.Offset))
+	default:
+		gl.VertexAttribPointer(a.Index, gl.Int(a.Components), a.Type, gl.FALSE, gl.Sizei(stride), bufferOffset(a.Offset))
+	}
+
+	gl.EnableVertexAttribArray(a.Index)
+}
+
+// VertexWriter builds interleaved vertex data in little-endian byte order.
+// Fields are appended as-is, so the calls have to follow the VertexLayout
+// (including the padding Add inserts to keep attributes 4-byte aligned).
+type VertexWriter struct {
+	data []byte
+}
+
+func (w *VertexWriter) Bytes() []byte {
+	return w.data
+}
+
+func (w *VertexWriter) Len() int {
+	return len(w.data)
+}
+
+func (w *VertexWriter) Reset() {
+	w.data = w.data[:0]
+}
+
+// Pad appends zeros up to the next multiple of n bytes.
+func (w *VertexWriter) Pad(n int) {
+	for len(w.data) % n != 0 {
+		w.data = append(w.data, 0)
+	}
+}
+
+func (w *VertexWriter) Float(xs ...float32) {
+	for _, x := range xs {
+		w.Uint32(math.Float32bits(x))
+	}
+}
+
+// Mat4 appends m column by column, matching VertexLayout.AddMat4.
+func (w *VertexWriter) Mat4(m *vmath.Matrix4) {
+	for col := 0; col < 4; col++ {
+		for row := 0; row < 4; row++ {
+			w.Float(m.GetElem(col, row))
+		}
+	}
+}
+
+func (w *VertexWriter) Half(xs ...float32) {
+	for _, x := range xs {
+		w.Uint16(Float32ToHalf(x))
+	}
+}
+
+func (w *VertexWriter) Int32(xs ...int32) {
+	for _, x := range xs {
+		w.Uint32(uint32(x))
+	}
+}
+
+func (w *VertexWriter) Uint32(xs ...uint32) {
+	var b [4]byte
+	for _, x := range xs {
+		binary.LittleEndian.PutUint32(b[:], x)
+		w.data = append(w.data, b[:]...)
+	}
+}
+
+func (w *VertexWriter) Int16(xs ...int16) {
+	for _, x := range xs {
+		w.Uint16(uint16(x))
+	}
+}
+
+func (w *VertexWriter) Uint16(xs ...uint16) {
+	var b [2]byte
+	for _, x := range xs {
+		binary.LittleEndian.PutUint16(b[:], x)
+		w.data = append(w.data, b[:]...)
+	}
+}
+
+func (w *VertexWriter) Int8(xs ...int8) {
+	for _, x := range xs {
+		w.data = append(w.data, byte(x))
+	}
+}
+
+func (w *VertexWriter) Uint8(xs ...uint8) {
+	w.data = append(w.data, xs...)
+}
+
+// UnormByte appends values in [0,1] as normalized unsigned bytes.
+func (w *VertexWriter) UnormByte(xs ...float32) {
+	for _, x := range xs {
+		x = float32(math.Max(0, math.Min(1, float64(x))))
+		w.data = append(w.data, byte(x * 255 + 0.5))
+	}
+}
+
+// SnormByte appends values in [-1,1] as normalized signed bytes.
+func (w *VertexWriter) SnormByte(xs ...float32) {
+	for _, x := range xs {
+		x = float32(math.Max(-1, math.Min(1, float64(x))))
+		w.data = append(w.data, byte(int8(math.Floor(float64(x) * 127 + 0.5))))
+	}
+}
+
+// Float32ToHalf converts f to an IEEE 754 half precision float, rounding to
+// nearest even. Values too large for a half become +-Inf.
+func Float32ToHalf(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits >> 16) & 0x8000
+	exp := int((bits >> 23) & 0xff)
+	mant := bits & 0x7fffff
+
+	switch {
+	case exp == 0xff: // Inf / NaN
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp - 127 > 15: // overflow
+		return sign | 0x7c00
+	case exp - 127 >= -14: // normal half
+		h := uint32(exp - 127 + 15) << 10 | mant >> 13
+		// round to nearest even
+		if mant & 0x1fff > 0x1000 || (mant & 0x1fff == 0x1000 && h & 1 == 1) {
+			h++
+		}
+		return sign | uint16(h)
+	case exp - 127 >= -25: // subnormal half
+		mant |= 0x800000
+		shift := uint(-(exp - 127) - 14 + 13)
+		h := mant >> shift
+		rem := mant & (1 << shift - 1)
+		half := uint32(1) << (shift - 1)
+		if rem > half || (rem == half && h & 1 == 1) {
+			h++
+		}
+		return sign | uint16(h)
+	}
+
+	return sign // underflow to zero
+}
+
+// HalfToFloat32 converts an IEEE 754 half precision float to float32.
+func HalfToFloat32(h uint16) float32 {
+	sign := uint32(h & 0x8000) << 16
+	exp := uint32(h >> 10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch {
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant << 13)
+	case exp == 0:
+		if mant == 0 {
+			return math.Float32frombits(sign)
+		}
+		// subnormal: renormalize
+		e := uint32(127 - 15 + 1)
+		for mant & 0x400 == 0 {
+			mant <<= 1
+			e--
+		}
+		mant &= 0x3ff
+		return math.Float32frombits(sign | e << 23 | mant << 13)
+	}
+
+	return math.Float32frombits(sign | (exp + 127 - 15) << 23 | mant << 13)
+}
@@ -0,0 +1,98 @@
+package buffers
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFloat32ToHalf(t *testing.T) {
+	tests := []struct {
+		f float32
+		h uint16
+	}{
+		{ 0, 0x0000 },
+		{ float32(math.Copysign(0, -1)), 0x8000 },
+		{ 1, 0x3c00 },
+		{ -2, 0xc000 },
+		{ 65504, 0x7bff }, // largest half
+		{ 65519, 0x7bff },
+		{ 65520, 0x7c00 }, // rounds to Inf
+		{ 1e10, 0x7c00 },
+		{ -1e10, 0xfc00 },
+		{ float32(math.Inf(1)), 0x7c00 },
+		{ float32(math.Inf(-1)), 0xfc00 },
+		{ 1.0 / (1 << 14), 0x0400 }, // smallest normal
+		{ 1023.0 / (1 << 24), 0x03ff }, // largest denormal
+		{ 1.0 / (1 << 24), 0x0001 }, // smallest denormal
+		{ -1.0 / (1 << 24), 0x8001 },
+		{ 1.0 / (1 << 25), 0x0000 }, // halfway to the smallest denormal, even
+		{ 1.5 / (1 << 25), 0x0001 },
+		{ 3.0 / (1 << 25), 0x0002 }, // halfway between 1 and 2, even
+		{ 1e-10, 0x0000 },
+		{ 1 + 1.0 / (1 << 11), 0x3c00 }, // halfway, rounds to even
+		{ 1 + 3.0 / (1 << 11), 0x3c02 }, // halfway, rounds to even
+		{ 1 + 1.5 / (1 << 11), 0x3c01 },
+	}
+
+	for _, test := range tests {
+		if h := Float32ToHalf(test.f); h != test.h {
+			t.Errorf("Float32ToHalf(%g) = 0x%04x, want 0x%04x", test.f, h, test.h)
+		}
+	}
+
+	if h := Float32ToHalf(float32(math.NaN())); h & 0x7c00 != 0x7c00 || h & 0x3ff == 0 {
+		t.Errorf("Float32ToHalf(NaN) = 0x%04x", h)
+	}
+}
+
+func TestHalfToFloat32(t *testing.T) {
+	tests := []struct {
+		h uint16
+		f float32
+	}{
+		{ 0x0000, 0 },
+		{ 0x3c00, 1 },
+		{ 0xc000, -2 },
+		{ 0x7bff, 65504 },
+		{ 0x0400, 1.0 / (1 << 14) },
+		{ 0x03ff, 1023.0 / (1 << 24) },
+		{ 0x0001, 1.0 / (1 << 24) },
+		{ 0x8001, -1.0 / (1 << 24) },
+		{ 0x7c00, float32(math.Inf(1)) },
+		{ 0xfc00, float32(math.Inf(-1)) },
+	}
+
+	for _, test := range tests {
+		if f := HalfToFloat32(test.h); f != test.f {
+			t.Errorf("HalfToFloat32(0x%04x) = %g, want %g", test.h, f, test.f)
+		}
+	}
+
+	if f := HalfToFloat32(0x8000); f != 0 || !math.Signbit(float64(f)) {
+		t.Errorf("HalfToFloat32(0x8000) = %g, want -0", f)
+	}
+
+	for _, h := range []uint16{ 0x7c01, 0x7e00, 0xffff } {
+		if f := HalfToFloat32(h); !math.IsNaN(float64(f)) {
+			t.Errorf("HalfToFloat32(0x%04x) = %g, want NaN", h, f)
+		}
+	}
+}
+
+func TestHalfRoundTrip(t *testing.T) {
+	for i := 0; i < 1 << 16; i++ {
+		h := uint16(i)
+		f := HalfToFloat32(h)
+
+		if math.IsNaN(float64(f)) {
+			if back := Float32ToHalf(f); back & 0x7c00 != 0x7c00 || back & 0x3ff == 0 || back & 0x8000 != h & 0x8000 {
+				t.Errorf("NaN 0x%04x came back as 0x%04x", h, back)
+			}
+			continue
+		}
+
+		if back := Float32ToHalf(f); back != h {
+			t.Errorf("0x%04x -> %g -> 0x%04x", h, f, back)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package buffers
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/gldebug"
+	"encoding/binary"
+	"log"
+	"math"
+)
+
+// SSBO wraps a shader storage buffer object. Its contents are usually built
+// with a Std430Writer so the Go side matches the std430 block layout.
+type SSBO struct {
+	handle gl.Uint
+	size int // in bytes
+
+	bindingPoint gl.Uint
+}
+
+// ssboBindings remembers which SSBO currently occupies each indexed
+// SHADER_STORAGE_BUFFER binding point so redundant rebinds can be skipped.
+var ssboBindings = make(map[gl.Uint]*SSBO)
+
+func MakeSSBO(size int, bindingPoint gl.Uint) (s *SSBO) {
+	s = &SSBO{ bindingPoint : bindingPoint }
+	gl.GenBuffers(1, &s.handle)
+	gldebug.Track(gldebug.Buffer, s.handle)
+	s.alloc(size, nil)
+
+	return
+}
+
+func MakeSSBOFromStd430(w *Std430Writer, bindingPoint gl.Uint) (s *SSBO) {
+	s = &SSBO{ bindingPoint : bindingPoint }
+	gl.GenBuffers(1, &s.handle)
+	gldebug.Track(gldebug.Buffer, s.handle)
+	s.alloc(w.Len(), w.Bytes())
+
+	return
+}
+
+func (s *SSBO) alloc(size int, data []byte) {
+	gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, s.handle)
+	defer gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, 0)
+
+	var ptr gl.Pointer
+	if len(data) > 0 {
+		ptr = gl.Pointer(&data[0])
+	}
+
+	gl.BufferData(gl.SHADER_STORAGE_BUFFER, gl.Sizeiptr(size), ptr, gl.DYNAMIC_DRAW)
+	s.size = size
+}
+
+func (s *SSBO) Delete() {
+	if ssboBindings[s.bindingPoint] == s {
+		delete(ssboBindings, s.bindingPoint)
+	}
+
+	gldebug.Untrack(gldebug.Buffer, s.handle)
+	gl.DeleteBuffers(1, &s.handle)
+}
+
+func (s *SSBO) Size() int {
+	return s.size
+}
+
+// Upload replaces the whole buffer contents, growing the buffer if needed.
+func (s *SSBO) Upload(w *Std430Writer) {
+	if w.Len() > s.size {
+		s.alloc(w.Len(), w.Bytes())
+		return
+	}
+
+	s.Update(0, w)
+}
+
+// Update overwrites the byte range starting at offset with the contents of w.
+// The range has to lie within the current buffer size.
+func (s *SSBO) Update(offset int, w *Std430Writer) {
+	if w.Len() == 0 {
+		return
+	}
+
+	if offset < 0 || offset + w.Len() > s.size {
+		log.Fatalf("SSBO update out of range (offset %d, size %d, buffer size %d)", offset, w.Len(), s.size)
+	}
+
+	data := w.Bytes()
+
+	gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, s.handle)
+	defer gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, 0)
+
+	gl.BufferSubData(gl.SHADER_STORAGE_BUFFER, gl.Intptr(offset), gl.Sizeiptr(len(data)), gl.Pointer(&data[0]))
+}
+
+func (s *SSBO) GetBindingPoint() gl.Uint {
+	return s.bindingPoint
+}
+
+func (s *SSBO) SetBindingPoint(bindingPoint gl.Uint) {
+	if ssboBindings[s.bindingPoint] == s {
+		delete(ssboBindings, s.bindingPoint)
+	}
+	s.bindingPoint = bindingPoint
+}
+
+// Bind attaches the whole buffer to its binding point, i.e. to the shader
+// storage block declared with layout (binding = N).
+func (s *SSBO) Bind() {
+	if ssboBindings[s.bindingPoint] == s {
+		return
+	}
+
+	gl.BindBufferBase(gl.SHADER_STORAGE_BUFFER, s.bindingPoint, s.handle)
+	ssboBindings[s.bindingPoint] = s
+}
+
+// BindRange attaches only [offset, offset+size) to the binding point. offset
+// has to be a multiple of SHADER_STORAGE_BUFFER_OFFSET_ALIGNMENT.
+func (s *SSBO) BindRange(offset, size int) {
+	gl.BindBufferRange(gl.SHADER_STORAGE_BUFFER, s.bindingPoint, s.handle, gl.Intptr(offset), gl.Sizeiptr(size))
+	delete(ssboBindings, s.bindingPoint) // a ranged binding never counts as "already bound"
+}
+
+func (s *SSBO) Unbind() {
+	gl.BindBufferBase(gl.SHADER_STORAGE_BUFFER, s.bindingPoint, 0)
+	delete(ssboBindings, s.bindingPoint)
+}
+
+// Read copies size bytes starting at offset back to the CPU. This stalls the
+// pipeline and is meant for debugging only.
+func (s *SSBO) Read(offset, size int) []byte {
+	if offset < 0 || offset + size > s.size {
+		log.Fatalf("SSBO read out of range (offset %d, size %d, buffer size %d)", offset, size, s.size)
+	}
+
+	data := make([]byte, size)
+	if size == 0 {
+		return data
+	}
+
+	// make sure shader writes are visible to the readback
+	gl.MemoryBarrier(gl.BUFFER_UPDATE_BARRIER_BIT)
+
+	gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, s.handle)
+	defer gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, 0)
+
+	gl.GetBufferSubData(gl.SHADER_STORAGE_BUFFER, gl.Intptr(offset), gl.Sizeiptr(size), gl.Pointer(&data[0]))
+	return data
+}
+
+// ReadFloats reads n tightly packed floats (e.g. a float[] array) starting at offset.
+func (s *SSBO) ReadFloats(offset, n int) []float32 {
+	data := s.Read(offset, 4 * n)
+	floats := make([]float32, n)
+
+	for i := range floats {
+		floats[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+
+	return floats
+}
+
+// ReadUints reads n tightly packed uints (e.g. a uint[] array) starting at offset.
+func (s *SSBO) ReadUints(offset, n int) []uint32 {
+	data := s.Read(offset, 4 * n)
+	uints := make([]uint32, n)
+
+	for i := range uints {
+		uints[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+
+	return uints
+}
@@ -0,0 +1,134 @@
+package buffers
+
+import (
+	"encoding/binary"
+	"math"
+
+	vmath "github.com/rwesterteiger/vectormath"
+)
+
+// Std430Writer packs Go values into a byte slice following the std430 layout
+// rules of shader storage blocks: scalars are 4-byte aligned, vec2 is 8-byte
+// aligned, vec3/vec4/mat4 are 16-byte aligned and vec3 occupies 12 bytes
+// (but arrays of vec3 have a stride of 16).
+//
+// Structs are written member by member; call Align with the largest member
+// alignment before and after each struct to get the std430 struct padding.
+type Std430Writer struct {
+	data []byte
+}
+
+func (w *Std430Writer) Bytes() []byte {
+	return w.data
+}
+
+func (w *Std430Writer) Len() int {
+	return len(w.data)
+}
+
+func (w *Std430Writer) Reset() {
+	w.data = w.data[:0]
+}
+
+// Align pads the buffer with zeros up to the next multiple of n bytes.
+func (w *Std430Writer) Align(n int) {
+	for len(w.data) % n != 0 {
+		w.data = append(w.data, 0)
+	}
+}
+
+func (w *Std430Writer) putUint32(x uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], x)
+	w.data = append(w.data, b[:]...)
+}
+
+func (w *Std430Writer) Float(x float32) {
+	w.Align(4)
+	w.putUint32(math.Float32bits(x))
+}
+
+func (w *Std430Writer) Int(x int32) {
+	w.Align(4)
+	w.putUint32(uint32(x))
+}
+
+func (w *Std430Writer) Uint(x uint32) {
+	w.Align(4)
+	w.putUint32(x)
+}
+
+func (w *Std430Writer) Vec2(v *vmath.Vector2) {
+	w.Align(8)
+	w.putUint32(math.Float32bits(v.X))
+	w.putUint32(math.Float32bits(v.Y))
+}
+
+func (w *Std430Writer) Vec3(v *vmath.Vector3) {
+	w.Align(16)
+	w.putUint32(math.Float32bits(v.X))
+	w.putUint32(math.Float32bits(v.Y))
+	w.putUint32(math.Float32bits(v.Z))
+}
+
+func (w *Std430Writer) Vec4(v *vmath.Vector4) {
+	w.Align(16)
+	w.putUint32(math.Float32bits(v.X))
+	w.putUint32(math.Float32bits(v.Y))
+	w.putUint32(math.Float32bits(v.Z))
+	w.putUint32(math.Float32bits(v.W))
+}
+
+// Mat4 writes m as four column vectors, matching GLSL's column-major mat4.
+func (w *Std430Writer) Mat4(m *vmath.Matrix4) {
+	w.Align(16)
+	for col := 0; col < 4; col++ {
+		for row := 0; row < 4; row++ {
+			w.putUint32(math.Float32bits(m.GetElem(col, row)))
+		}
+	}
+}
+
+func (w *Std430Writer) Floats(xs []float32) {
+	for _, x := range xs {
+		w.Float(x)
+	}
+}
+
+func (w *Std430Writer) Ints(xs []int32) {
+	for _, x := range xs {
+		w.Int(x)
+	}
+}
+
+func (w *Std430Writer) Uints(xs []uint32) {
+	for _, x := range xs {
+		w.Uint(x)
+	}
+}
+
+func (w *Std430Writer) Vec2s(vs []vmath.Vector2) {
+	for i := range vs {
+		w.Vec2(&vs[i])
+	}
+}
+
+// Vec3s writes an array of vec3 with the std430 array stride of 16 bytes.
+func (w *Std430Writer) Vec3s(vs []vmath.Vector3) {
+	for i := range vs {
+		w.Vec3(&vs[i])
+		w.Align(16)
+	}
+}
+
+func (w *Std430Writer) Vec4s(vs []vmath.Vector4) {
+	for i := range vs {
+		w.Vec4(&vs[i])
+	}
+}
+
+func (w *Std430Writer) Mat4s(ms []vmath.Matrix4) {
+	for i := range ms {
+		w.Mat4(&ms[i])
+	}
+}
@@ -0,0 +1,132 @@
+package buffers
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	vmath "github.com/rwesterteiger/vectormath"
+)
+
+// floatAt reads the float at byte offset off of b.
+func floatAt(b []byte, off int) float32 {
+	return math.Float32frombits(binary.LittleEndian.Uint32(b[off:]))
+}
+
+func TestStd430Layout(t *testing.T) {
+	tests := []struct {
+		name string
+		write func(w *Std430Writer)
+		size int
+		values map[int]float32 // byte offset -> value
+	}{
+		{
+			"vec3 followed by float",
+			func(w *Std430Writer) { w.Vec3(&vmath.Vector3{ 1, 2, 3 }); w.Float(4) },
+			16, map[int]float32{ 0 : 1, 8 : 3, 12 : 4 },
+		},
+		{
+			"float followed by vec3",
+			func(w *Std430Writer) { w.Float(1); w.Vec3(&vmath.Vector3{ 2, 3, 4 }) },
+			28, map[int]float32{ 0 : 1, 16 : 2, 24 : 4 },
+		},
+		{
+			"float followed by vec2",
+			func(w *Std430Writer) { w.Float(1); w.Vec2(&vmath.Vector2{ 2, 3 }) },
+			16, map[int]float32{ 0 : 1, 8 : 2, 12 : 3 },
+		},
+		{
+			"vec3 array",
+			func(w *Std430Writer) { w.Vec3s([]vmath.Vector3{ { 1, 2, 3 }, { 4, 5, 6 } }) },
+			32, map[int]float32{ 0 : 1, 8 : 3, 12 : 0, 16 : 4, 24 : 6, 28 : 0 },
+		},
+		{
+			"vec3 array followed by float",
+			func(w *Std430Writer) { w.Vec3s([]vmath.Vector3{ { 1, 2, 3 } }); w.Float(4) },
+			20, map[int]float32{ 0 : 1, 16 : 4 },
+		},
+		{
+			"float array",
+			func(w *Std430Writer) { w.Floats([]float32{ 1, 2, 3 }) },
+			12, map[int]float32{ 0 : 1, 4 : 2, 8 : 3 },
+		},
+		{
+			"float followed by vec4",
+			func(w *Std430Writer) { w.Float(1); w.Vec4(&vmath.Vector4{ 2, 3, 4, 5 }) },
+			32, map[int]float32{ 0 : 1, 16 : 2, 28 : 5 },
+		},
+	}
+
+	for _, test := range tests {
+		var w Std430Writer
+		test.write(&w)
+
+		if w.Len() != test.size {
+			t.Errorf("%s: %d bytes, want %d", test.name, w.Len(), test.size)
+			continue
+		}
+
+		for off, want := range test.values {
+			if got := floatAt(w.Bytes(), off); got != want {
+				t.Errorf("%s: %v at offset %d, want %v", test.name, got, off, want)
+			}
+		}
+	}
+}
+
+func TestStd430Mat4(t *testing.T) {
+	var m vmath.Matrix4
+	for col := 0; col < 4; col++ {
+		for row := 0; row < 4; row++ {
+			m.SetElem(col, row, float32(4 * col + row))
+		}
+	}
+
+	var w Std430Writer
+	w.Float(-1)
+	w.Mat4(&m)
+
+	if w.Len() != 16 + 64 {
+		t.Fatalf("%d bytes, want %d", w.Len(), 16 + 64)
+	}
+
+	// column-major, starting at the next 16 byte boundary
+	for i := 0; i < 16; i++ {
+		if got := floatAt(w.Bytes(), 16 + 4*i); got != float32(i) {
+			t.Errorf("element %d is %v", i, got)
+		}
+	}
+}
+
+func TestStd430Struct(t *testing.T) {
+	// the per-draw struct of the indirect scene path:
+	// mat4 M, prevM; vec4 color; vec3 emissive; float roughness, metalness;
+	// uint materialID
+	var w Std430Writer
+	var m vmath.Matrix4
+
+	for i := 0; i < 2; i++ {
+		w.Mat4(&m)
+		w.Mat4(&m)
+		w.Vec4(&vmath.Vector4{})
+		w.Vec3(&vmath.Vector3{})
+		w.Float(0.5)
+		w.Float(0.25)
+		w.Uint(7)
+		w.Align(16)
+	}
+
+	// roughness packs into the vec3's padding
+	if floatAt(w.Bytes(), 2 * 64 + 16 + 12) != 0.5 {
+		t.Error("roughness is not in the padding of emissive")
+	}
+
+	if w.Len() != 2 * 176 {
+		t.Errorf("%d bytes for two structs, want %d", w.Len(), 2 * 176)
+	}
+
+	w.Reset()
+	if w.Len() != 0 {
+		t.Errorf("%d bytes after Reset", w.Len())
+	}
+}
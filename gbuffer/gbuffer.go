@@ -2,94 +2,138 @@ package gbuffer
 
 import (
 	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
+	"github.com/rwesterteiger/go-gltest/shader"
+	"github.com/rwesterteiger/go-gltest/texture"
 	//vmath "github.com/rwesterteiger/vectormath"
 	"log"
 )
 
 type GBuffer struct {
 	w,h gl.Sizei
-	fbo gl.Uint
-	albedoTex gl.Uint
-	normalTex gl.Uint
-	depthTex gl.Uint
-}
+	layout Layout
+	rt *rendertarget.RenderTarget // multisampled with MSAA
 
-func setTexParameters() {
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	// MSAA only: single-sampled copy of rt, see Resolve
+	resolved *rendertarget.RenderTarget
+	edgeMask *texture.Texture2D
+	edgeShader *shader.Shader
 }
 
 func Make(w,h int) (g *GBuffer) {
+	return MakeWithLayout(w, h, DefaultLayout())
+}
+
+// MakeWithLayout creates a G-buffer with the channels described by layout.
+// The lights need the albedo and normal channels, named ChannelAlbedo and
+// ChannelNormal; layouts without them are rejected.
+func MakeWithLayout(w, h int, layout *Layout) (g *GBuffer) {
 	g = new(GBuffer)
 	
 	g.w = gl.Sizei(w)
 	g.h = gl.Sizei(h)
 
-	gl.GenTextures(1, &g.albedoTex)
-	gl.GenTextures(1, &g.normalTex)
-	gl.GenTextures(1, &g.depthTex)
+	if err := layout.validate(); err != nil {
+		log.Fatal("Invalid gbuffer layout: ", err)
+	}
 
-	gl.BindTexture(gl.TEXTURE_2D, g.albedoTex);
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA16F, gl.Sizei(w), gl.Sizei(h), 0, gl.RGBA, gl.FLOAT, nil)
-	setTexParameters()
+	// own copy, the layout must not change under the generated shaders
+	g.layout = *layout
+	g.layout.Channels = append([]Channel(nil), layout.Channels...)
 
-	gl.BindTexture(gl.TEXTURE_2D, g.normalTex);
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGB16F, gl.Sizei(w), gl.Sizei(h), 0, gl.RGB, gl.FLOAT, nil);
-	setTexParameters()
+	var attachments []rendertarget.Attachment
+	for i, c := range g.layout.Channels {
+		attachments = append(attachments, rendertarget.Attachment{ Point : gl.COLOR_ATTACHMENT0 + gl.Enum(i), Format : c.Format, Samples : g.layout.Samples })
+	}
+	attachments = append(attachments, rendertarget.Attachment{ Point : gl.DEPTH_ATTACHMENT, Format : g.layout.DepthFormat, Samples : g.layout.Samples })
 
-	gl.BindTexture(gl.TEXTURE_2D, g.depthTex);
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.DEPTH_COMPONENT, gl.Sizei(w), gl.Sizei(h), 0, gl.DEPTH_COMPONENT, gl.FLOAT, nil)
-	setTexParameters()
+	var err error
+	g.rt, err = rendertarget.Make(w, h, attachments...)
 
-	gl.BindTexture(gl.TEXTURE_2D, 0)
+	if err != nil {
+		log.Fatal("Error creating gbuffer FBO: ", err)
+	}
 
-	gl.GenFramebuffers(1, &g.fbo)
-	gl.BindFramebuffer(gl.FRAMEBUFFER, g.fbo)
-	gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, g.albedoTex, 0)
-	gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT1, gl.TEXTURE_2D, g.normalTex, 0)
-	gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.DEPTH_ATTACHMENT, gl.TEXTURE_2D, g.depthTex, 0)
-	
-	drawBufs := []gl.Enum{ gl.COLOR_ATTACHMENT0, gl.COLOR_ATTACHMENT1 }
-	gl.DrawBuffers(2, &(drawBufs[0]))
+	if g.layout.Samples > 1 {
+		if err := g.makeMultisampleTargets(attachments); err != nil {
+			log.Fatal("Error creating gbuffer resolve FBO: ", err)
+		}
+	}
 
-	result := gl.CheckFramebufferStatus(gl.FRAMEBUFFER)
+	return
+}
+
+func (g *GBuffer) Delete() {
+	g.rt.Delete()
+	g.deleteMultisampleTargets()
+}
+
+func (g *GBuffer) Resize(w, h int) {
+	g.w = gl.Sizei(w)
+	g.h = gl.Sizei(h)
 
-	if result != gl.FRAMEBUFFER_COMPLETE {
-		log.Fatal("Error creating gbuffer FBO!")
+	if err := g.rt.Resize(w, h); err != nil {
+		log.Fatal("Error resizing gbuffer FBO: ", err)
 	}
 
-	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+	if err := g.resizeMultisampleTargets(); err != nil {
+		log.Fatal("Error resizing gbuffer resolve FBO: ", err)
+	}
+}
 
-	return
+func (g *GBuffer) GetSize() (w, h int) {
+	return int(g.w), int(g.h)
 }
 
-func (g *GBuffer) Delete() {
-	gl.DeleteFramebuffers(1, &g.fbo)
-	gl.DeleteTextures(1, &g.albedoTex)
-	gl.DeleteTextures(1, &g.normalTex)
-	gl.DeleteTextures(1, &g.depthTex)
+func (g *GBuffer) GetLayout() *Layout {
+	return &g.layout
 }
 
 func (g *GBuffer) Begin()  {
-	gl.BindFramebuffer(gl.FRAMEBUFFER, g.fbo)
-	gl.Viewport(0, 0, g.w, g.h)
+	g.rt.Bind()
 }
 
 func (_ *GBuffer) End() {
-	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+	rendertarget.Unbind()
+}
+
+// Clear resets all channels to 0 and depth to 1. The G-buffer has to be
+// bound.
+func (g *GBuffer) Clear() {
+	g.rt.Clear()
+}
+
+// GetTexture returns the texture of the channel called name, or 0 if the
+// layout has no such channel. With MSAA this is the resolved texture.
+func (g *GBuffer) GetTexture(name string) gl.Uint {
+	i := g.layout.Find(name)
+	if i < 0 {
+		return 0
+	}
+
+	return g.singleSampled().GetTexture(gl.COLOR_ATTACHMENT0 + gl.Enum(i))
+}
+
+// singleSampled returns the target holding single-sampled textures.
+func (g *GBuffer) singleSampled() *rendertarget.RenderTarget {
+	if g.resolved != nil {
+		return g.resolved
+	}
+	return g.rt
+}
+
+func (g *GBuffer) HasChannel(name string) bool {
+	return g.layout.Find(name) >= 0
 }
 
 func (g *GBuffer) GetAlbedoTex() gl.Uint {
-	return g.albedoTex
+	return g.GetTexture(ChannelAlbedo)
 }
 
 func (g *GBuffer) GetNormalTex() gl.Uint {
-	return g.normalTex
+	return g.GetTexture(ChannelNormal)
 }
 
 func (g *GBuffer) GetDepthTex() gl.Uint {
-	return g.depthTex
+	return g.singleSampled().GetTexture(gl.DEPTH_ATTACHMENT)
 }
-
@@ -0,0 +1,219 @@
+package gbuffer
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/texture"
+	"fmt"
+	"strings"
+)
+
+// ChannelSource selects what the scene object shader writes into a channel.
+type ChannelSource int
+
+const (
+	SourceAlbedo ChannelSource = iota // diffuse color, vec4
+	SourceNormal // eye-space normal, vec3
+	SourceMaterial // roughness and metalness, vec2
+	SourceEmissive // emitted radiance, vec3
+	SourceMaterialID // uint, needs an integer format
+	SourceVelocity // view-space motion since the previous frame, vec3
+)
+
+// Names of the channels of DefaultLayout and the usual names for the other
+// sources. Lights and post filters look channels up by these names.
+const (
+	ChannelAlbedo = "albedo"
+	ChannelNormal = "normal"
+	ChannelMaterial = "material"
+	ChannelEmissive = "emissive"
+	ChannelMaterialID = "materialID"
+	ChannelVelocity = "velocity"
+)
+
+// Channel is one color target of the G-buffer. Channel i of a layout is
+// bound to gl.COLOR_ATTACHMENT0 + i and fragment output location i.
+type Channel struct {
+	Name string
+	Source ChannelSource
+	Format gl.Enum
+}
+
+// Layout describes the targets of a G-buffer.
+type Layout struct {
+	Channels []Channel
+	DepthFormat gl.Enum
+	NormalEncoding NormalEncoding // of the SourceNormal channel
+	Samples int // > 1 makes all targets multisampled, see GBuffer.Resolve
+}
+
+// DefaultLayout has an RGBA16F albedo, an RGB16F normal and a 32 bit float
+// depth target.
+func DefaultLayout() (l *Layout) {
+	l = &Layout{ DepthFormat : gl.DEPTH_COMPONENT32F }
+	l.Add(ChannelAlbedo, SourceAlbedo, gl.RGBA16F)
+	l.Add(ChannelNormal, SourceNormal, gl.RGB16F)
+	return
+}
+
+// CompactLayout is DefaultLayout with octahedral normals in an RG16F target.
+func CompactLayout() (l *Layout) {
+	l = &Layout{ DepthFormat : gl.DEPTH_COMPONENT32F, NormalEncoding : NormalOctahedral }
+	l.Add(ChannelAlbedo, SourceAlbedo, gl.RGBA16F)
+	l.Add(ChannelNormal, SourceNormal, gl.RG16F)
+	return
+}
+
+// Add appends a channel.
+func (l *Layout) Add(name string, source ChannelSource, format gl.Enum) *Layout {
+	l.Channels = append(l.Channels, Channel{ name, source, format })
+	return l
+}
+
+// Find returns the index of the channel called name, or -1.
+func (l *Layout) Find(name string) int {
+	for i := range l.Channels {
+		if l.Channels[i].Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (l *Layout) validate() error {
+	if l.Samples < 0 {
+		return fmt.Errorf("invalid gbuffer sample count %d", l.Samples)
+	}
+
+	seen := make(map[string]bool)
+	sources := make(map[ChannelSource]int)
+
+	for _, c := range l.Channels {
+		if seen[c.Name] {
+			return fmt.Errorf("duplicate gbuffer channel %q", c.Name)
+		}
+		seen[c.Name] = true
+
+		if !isIdentifier(c.Name) {
+			return fmt.Errorf("gbuffer channel name %q is not a valid GLSL identifier", c.Name)
+		}
+
+		info, ok := texture.GetFormatInfo(c.Format)
+		if !ok || info.Depth {
+			return fmt.Errorf("gbuffer channel %q: unsupported format 0x%x", c.Name, int(c.Format))
+		}
+
+		if c.Source == SourceNormal {
+			if err := validateNormalFormat(l.NormalEncoding, c.Format, info.Channels, info.Type); err != nil {
+				return fmt.Errorf("gbuffer channel %q: %v", c.Name, err)
+			}
+		}
+
+		isInteger := info.Format == gl.RED_INTEGER
+		if (c.Source == SourceMaterialID) != isInteger {
+			return fmt.Errorf("gbuffer channel %q: material IDs need an unsigned integer format and only them", c.Name)
+		}
+
+		sources[c.Source]++
+	}
+
+	// the lights look these two up by name
+	required := []struct {
+		name string
+		source ChannelSource
+	}{
+		{ ChannelAlbedo, SourceAlbedo },
+		{ ChannelNormal, SourceNormal },
+	}
+
+	for _, r := range required {
+		i := l.Find(r.name)
+		if i < 0 || l.Channels[i].Source != r.source || sources[r.source] != 1 {
+			return fmt.Errorf("gbuffer layout needs exactly one %s channel, named %q", r.name, r.name)
+		}
+	}
+
+	return nil
+}
+
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+func (c *Channel) glslType() string {
+	switch c.Source {
+	case SourceAlbedo:
+		return "vec4"
+	case SourceMaterial:
+		return "vec2"
+	case SourceMaterialID:
+		return "uint"
+	}
+
+	return "vec3"
+}
+
+func (c *Channel) glslValue() string {
+	switch c.Source {
+	case SourceAlbedo:
+		return "vAlbedo"
+	case SourceNormal:
+		return "encodeNormal(vEyeSpaceNormal)"
+	case SourceMaterial:
+		return "vMaterial"
+	case SourceEmissive:
+		return "vEmissive"
+	case SourceMaterialID:
+		return "vMaterialID"
+	}
+
+	return "vVelocity"
+}
+
+// FragmentShaderSource generates the object fragment shader writing all
+// channels of l. It has to be linked together with NormalCodecShaderSource
+// and expects the vertex stage outputs
+//
+//	out vec3 vEyeSpaceNormal;
+//	out vec4 vAlbedo;
+//	out vec2 vMaterial;
+//	out vec3 vEmissive;
+//	flat out uint vMaterialID;
+//	out vec3 vVelocity;
+func (l *Layout) FragmentShaderSource() string {
+	var b strings.Builder
+
+	b.WriteString(`
+#version 430
+
+in vec3 vEyeSpaceNormal;
+in vec4 vAlbedo;
+in vec2 vMaterial;
+in vec3 vEmissive;
+flat in uint vMaterialID;
+in vec3 vVelocity;
+
+vec3 encodeNormal(vec3 n); // NormalCodecShaderSource
+
+`)
+
+	for i := range l.Channels {
+		c := &l.Channels[i]
+		fmt.Fprintf(&b, "layout (location = %d) out %s frag_%s;\n", i, c.glslType(), c.Name)
+	}
+
+	b.WriteString("\nvoid main(void)\n{\n")
+	for i := range l.Channels {
+		c := &l.Channels[i]
+		fmt.Fprintf(&b, "\tfrag_%s = %s;\n", c.Name, c.glslValue())
+	}
+	b.WriteString("}\n")
+
+	return b.String()
+}
@@ -0,0 +1,188 @@
+package gbuffer
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
+	"github.com/rwesterteiger/go-gltest/shader"
+	"github.com/rwesterteiger/go-gltest/texture"
+)
+
+// edgeClassifyShaderSrc marks pixels whose samples differ in depth or normal
+// with 1 in the edge mask; all others get 0. Lights shade every sample of
+// edge pixels and only sample 0 elsewhere.
+const edgeClassifyShaderSrc = `
+	#version 430
+	layout (local_size_x = 8, local_size_y = 8) in;
+
+	layout (location = 0) uniform sampler2DMS normalTex;
+	layout (location = 1) uniform sampler2DMS depthTex;
+	layout (location = 2) uniform int samples;
+
+	layout (binding = 0, r8ui) writeonly uniform uimage2D edgeMask;
+
+	// window space depth of a sloped surface varies inside a pixel, too
+	const float depthThreshold = 0.0005;
+	// normals are compared encoded, which is fine for detecting change
+	const float normalThreshold = 0.05;
+
+	void main(void) {
+		ivec2 p = ivec2(gl_GlobalInvocationID.xy);
+		if (any(greaterThanEqual(p, imageSize(edgeMask)))) {
+			return;
+		}
+
+		vec3 n0 = texelFetch(normalTex, p, 0).xyz;
+		float z0 = texelFetch(depthTex, p, 0).x;
+
+		uint edge = 0u;
+		for (int i = 1; i < samples; i++) {
+			vec3 n = texelFetch(normalTex, p, i).xyz;
+			float z = texelFetch(depthTex, p, i).x;
+
+			if (abs(z - z0) > depthThreshold || distance(n, n0) > normalThreshold) {
+				edge = 1u;
+				break;
+			}
+		}
+
+		imageStore(edgeMask, p, uvec4(edge));
+	}
+	`
+
+const edgeClassifyGroupSize = 8
+
+// MultisampleShaderSource is a fragment shader object providing
+//
+//	bool isEdgePixel();
+//
+// for lights which light multisampled G-buffers, to be attached next to their
+// own fragment shader. It reads the edge mask of GBuffer.Resolve bound by
+// SetMultisampleUniforms.
+const MultisampleShaderSource = `
+#version 430
+
+layout (location = 101) uniform usampler2D edgeMask;
+
+bool isEdgePixel() {
+	return texelFetch(edgeMask, ivec2(gl_FragCoord.xy), 0).x != 0;
+}
+`
+
+const edgeMaskUniformLocation = 101
+
+// GetSamples returns the number of samples per pixel, 1 without MSAA.
+func (g *GBuffer) GetSamples() int {
+	if g.layout.Samples > 1 {
+		return g.layout.Samples
+	}
+	return 1
+}
+
+// GetMultisampleTexture returns the multisampled texture of the channel
+// called name (a gl.TEXTURE_2D_MULTISAMPLE), or the same as GetTexture
+// without MSAA.
+func (g *GBuffer) GetMultisampleTexture(name string) gl.Uint {
+	i := g.layout.Find(name)
+	if i < 0 {
+		return 0
+	}
+
+	return g.rt.GetTexture(gl.COLOR_ATTACHMENT0 + gl.Enum(i))
+}
+
+func (g *GBuffer) GetMultisampleDepthTex() gl.Uint {
+	return g.rt.GetTexture(gl.DEPTH_ATTACHMENT)
+}
+
+// GetEdgeTex returns the R8UI edge mask written by Resolve, 0 without MSAA.
+func (g *GBuffer) GetEdgeTex() gl.Uint {
+	if g.edgeMask == nil {
+		return 0
+	}
+	return g.edgeMask.GetHandle()
+}
+
+// SetMultisampleUniforms binds the edge mask for the MultisampleShaderSource
+// part of s to unit.
+func (g *GBuffer) SetMultisampleUniforms(s *shader.Shader, unit int) {
+	texture.BindUnit(unit, g.GetEdgeTex(), texture.GetSampler(texture.NearestClamp))
+	s.ProgramUniform1i(edgeMaskUniformLocation, unit)
+}
+
+// Resolve prepares a multisampled G-buffer for lighting and post-processing:
+// it resolves every target into the single-sampled textures returned by
+// GetTexture and GetDepthTex and classifies edge pixels into the edge mask.
+// It is a no-op without MSAA. The G-buffer must not be bound.
+func (g *GBuffer) Resolve() {
+	if g.resolved == nil {
+		return
+	}
+
+	g.rt.ResolveTo(g.resolved)
+
+	texture.BindUnitTarget(0, gl.TEXTURE_2D_MULTISAMPLE, g.GetMultisampleTexture(ChannelNormal), texture.GetSampler(texture.NearestClamp))
+	texture.BindUnitTarget(1, gl.TEXTURE_2D_MULTISAMPLE, g.GetMultisampleDepthTex(), texture.GetSampler(texture.NearestClamp))
+	g.edgeShader.ProgramUniform1i(0, 0)
+	g.edgeShader.ProgramUniform1i(1, 1)
+	g.edgeShader.ProgramUniform1i(2, g.layout.Samples)
+
+	gl.BindImageTexture(0, g.edgeMask.GetHandle(), 0, gl.FALSE, 0, gl.WRITE_ONLY, gl.R8UI)
+
+	g.edgeShader.Enable()
+	gl.DispatchCompute(gl.Uint((g.w + edgeClassifyGroupSize - 1) / edgeClassifyGroupSize), gl.Uint((g.h + edgeClassifyGroupSize - 1) / edgeClassifyGroupSize), 1)
+	g.edgeShader.Disable()
+
+	// the lights read the mask with texelFetch
+	gl.MemoryBarrier(gl.TEXTURE_FETCH_BARRIER_BIT)
+
+	gl.BindImageTexture(0, 0, 0, gl.FALSE, 0, gl.WRITE_ONLY, gl.R8UI)
+	texture.UnbindUnitTarget(1, gl.TEXTURE_2D_MULTISAMPLE)
+	texture.UnbindUnitTarget(0, gl.TEXTURE_2D_MULTISAMPLE)
+}
+
+// makeMultisampleTargets creates the resolve target, edge mask and edge
+// classification shader of a multisampled G-buffer.
+func (g *GBuffer) makeMultisampleTargets(attachments []rendertarget.Attachment) (err error) {
+	single := make([]rendertarget.Attachment, len(attachments))
+	for i, a := range attachments {
+		a.Samples = 0
+		single[i] = a
+	}
+
+	if g.resolved, err = rendertarget.Make(int(g.w), int(g.h), single...); err != nil {
+		return
+	}
+
+	g.edgeMask = texture.Make2D(int(g.w), int(g.h), gl.R8UI, 1)
+
+	g.edgeShader = shader.Make()
+	g.edgeShader.AddShaderSource(edgeClassifyShaderSrc, gl.COMPUTE_SHADER)
+	g.edgeShader.Link()
+
+	return
+}
+
+func (g *GBuffer) resizeMultisampleTargets() (err error) {
+	if g.resolved == nil {
+		return
+	}
+
+	if err = g.resolved.Resize(int(g.w), int(g.h)); err != nil {
+		return
+	}
+
+	g.edgeMask.Delete()
+	g.edgeMask = texture.Make2D(int(g.w), int(g.h), gl.R8UI, 1)
+
+	return
+}
+
+func (g *GBuffer) deleteMultisampleTargets() {
+	if g.resolved == nil {
+		return
+	}
+
+	g.resolved.Delete()
+	g.edgeMask.Delete()
+	g.edgeShader.Delete()
+}
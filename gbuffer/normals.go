@@ -0,0 +1,209 @@
+package gbuffer
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/buffers"
+	"github.com/rwesterteiger/go-gltest/shader"
+	"fmt"
+	"math"
+)
+
+// NormalEncoding selects how eye-space normals are stored in the normal
+// channel.
+type NormalEncoding int
+
+const (
+	NormalRaw NormalEncoding = iota // xyz as is, needs a 3 component format
+	NormalOctahedral // octahedron mapped to the unit square, 2 components
+	NormalSpheremap // Lambert azimuthal equal-area projection, 2 components
+)
+
+func (e NormalEncoding) String() string {
+	switch e {
+	case NormalOctahedral:
+		return "octahedral"
+	case NormalSpheremap:
+		return "spheremap"
+	}
+	return "raw"
+}
+
+// location of the normalEncoding uniform declared by NormalCodecShaderSource;
+// it is set by GBuffer.SetNormalCodecUniforms
+const normalEncodingUniformLocation = 100
+
+// NormalCodecShaderSource is a fragment shader object providing
+//
+//	vec3 encodeNormal(vec3 n);
+//	vec3 decodeNormal(vec3 e);
+//
+// for the encoding of the G-buffer it is used with. Shaders reading or
+// writing the normal channel attach it next to their own fragment shader,
+// declare the prototypes they call and have the G-buffer set the uniform via
+// SetNormalCodecUniforms. Compact encodings are stored in [0,1], so they
+// work with unorm targets (RG8) as well as float ones (RG16F).
+const NormalCodecShaderSource = `
+#version 430
+
+layout (location = 100) uniform int normalEncoding; // gbuffer.NormalEncoding
+
+vec2 signNotZero(vec2 v) {
+	return vec2(v.x >= 0.0 ? 1.0 : -1.0, v.y >= 0.0 ? 1.0 : -1.0);
+}
+
+vec3 encodeNormal(vec3 n) {
+	if (normalEncoding == 1) { // octahedral
+		n /= abs(n.x) + abs(n.y) + abs(n.z);
+		vec2 e = n.z >= 0.0 ? n.xy : (1.0 - abs(n.yx)) * signNotZero(n.xy);
+		return vec3(0.5 * e + 0.5, 0.0);
+	}
+
+	if (normalEncoding == 2) { // spheremap
+		n = normalize(n);
+		float f = sqrt(8.0 * n.z + 8.0);
+		return vec3(n.xy / max(f, 1e-6) + 0.5, 0.0);
+	}
+
+	return n;
+}
+
+vec3 decodeNormal(vec3 e) {
+	if (normalEncoding == 1) {
+		vec2 f = 2.0 * e.xy - 1.0;
+		vec3 n = vec3(f, 1.0 - abs(f.x) - abs(f.y));
+		float t = max(-n.z, 0.0);
+		n.xy -= t * signNotZero(n.xy);
+		return normalize(n);
+	}
+
+	if (normalEncoding == 2) {
+		vec2 fenc = 4.0 * e.xy - 2.0;
+		float f = dot(fenc, fenc);
+		return vec3(fenc * sqrt(max(0.0, 1.0 - f / 4.0)), 1.0 - f / 2.0);
+	}
+
+	return e;
+}
+`
+
+// SetNormalCodecUniforms configures the NormalCodecShaderSource part of s for
+// this G-buffer.
+func (g *GBuffer) SetNormalCodecUniforms(s *shader.Shader) {
+	s.ProgramUniform1i(normalEncodingUniformLocation, int(g.layout.NormalEncoding))
+}
+
+func (g *GBuffer) GetNormalEncoding() NormalEncoding {
+	return g.layout.NormalEncoding
+}
+
+func validateNormalFormat(enc NormalEncoding, format gl.Enum, channels int, dataType gl.Enum) error {
+	if enc == NormalRaw && (channels < 3 || dataType != gl.HALF_FLOAT && dataType != gl.FLOAT) {
+		return fmt.Errorf("raw normals need a 3 component float format, not 0x%x", int(format))
+	}
+	if enc != NormalRaw && channels != 2 {
+		return fmt.Errorf("%v normals need a 2 component format, format 0x%x has %d", enc, int(format), channels)
+	}
+	return nil
+}
+
+// CPU mirror of the GLSL codec, used to measure the error of an encoding.
+
+func signNotZero(x float64) float64 {
+	if x >= 0 {
+		return 1
+	}
+	return -1
+}
+
+func encodeNormal(enc NormalEncoding, n [3]float64) [3]float64 {
+	switch enc {
+	case NormalOctahedral:
+		l1 := math.Abs(n[0]) + math.Abs(n[1]) + math.Abs(n[2])
+		x, y, z := n[0] / l1, n[1] / l1, n[2] / l1
+		if z < 0 {
+			x, y = (1 - math.Abs(y)) * signNotZero(x), (1 - math.Abs(x)) * signNotZero(y)
+		}
+		return [3]float64{ 0.5 * x + 0.5, 0.5 * y + 0.5, 0 }
+
+	case NormalSpheremap:
+		f := math.Max(math.Sqrt(8 * n[2] + 8), 1e-6)
+		return [3]float64{ n[0] / f + 0.5, n[1] / f + 0.5, 0 }
+	}
+
+	return n
+}
+
+func decodeNormal(enc NormalEncoding, e [3]float64) [3]float64 {
+	switch enc {
+	case NormalOctahedral:
+		x, y := 2 * e[0] - 1, 2 * e[1] - 1
+		z := 1 - math.Abs(x) - math.Abs(y)
+		t := math.Max(-z, 0)
+		x -= t * signNotZero(x)
+		y -= t * signNotZero(y)
+		l := math.Sqrt(x*x + y*y + z*z)
+		return [3]float64{ x / l, y / l, z / l }
+
+	case NormalSpheremap:
+		fx, fy := 4 * e[0] - 2, 4 * e[1] - 2
+		f := fx*fx + fy*fy
+		g := math.Sqrt(math.Max(0, 1 - f / 4))
+		return [3]float64{ fx * g, fy * g, 1 - f / 2 }
+	}
+
+	return e
+}
+
+// quantize rounds x the way storing it in a texel of the given format does.
+func quantize(format gl.Enum, x float64) float64 {
+	switch format {
+	case gl.RG8, gl.RGB8, gl.RGBA8:
+		return math.Floor(math.Max(0, math.Min(1, x)) * 255 + 0.5) / 255
+	case gl.RG16F, gl.RGB16F, gl.RGBA16F:
+		return float64(buffers.HalfToFloat32(buffers.Float32ToHalf(float32(x))))
+	}
+
+	return float64(float32(x))
+}
+
+// NormalEncodingError measures the angular error in degrees of storing unit
+// normals with enc in a target of the given format, over a Fibonacci sphere
+// of samples directions. Directions pointing straight away from the viewer
+// (z = -1) are singular for the spheremap encoding and skipped.
+func NormalEncodingError(enc NormalEncoding, format gl.Enum, samples int) (maxDeg, meanDeg float64) {
+	goldenAngle := math.Pi * (3 - math.Sqrt(5))
+	n := 0
+
+	for i := 0; i < samples; i++ {
+		z := 1 - (float64(i) + 0.5) * 2 / float64(samples)
+		r := math.Sqrt(1 - z*z)
+		phi := goldenAngle * float64(i)
+
+		if enc == NormalSpheremap && z < -0.999 {
+			continue
+		}
+
+		v := [3]float64{ r * math.Cos(phi), r * math.Sin(phi), z }
+		e := encodeNormal(enc, v)
+		for c := range e {
+			e[c] = quantize(format, e[c])
+		}
+		d := decodeNormal(enc, e)
+
+		deg := 180.0 // degenerate decode, e.g. raw normals clamped by a unorm format
+		if l := math.Sqrt(d[0]*d[0] + d[1]*d[1] + d[2]*d[2]); l > 0 {
+			cos := (v[0]*d[0] + v[1]*d[1] + v[2]*d[2]) / l
+			deg = math.Acos(math.Max(-1, math.Min(1, cos))) * 180 / math.Pi
+		}
+
+		maxDeg = math.Max(maxDeg, deg)
+		meanDeg += deg
+		n++
+	}
+
+	if n > 0 {
+		meanDeg /= float64(n)
+	}
+
+	return
+}
@@ -0,0 +1,85 @@
+package gbuffer
+
+import (
+	"github.com/rwesterteiger/go-gltest/texture"
+	vmath "github.com/rwesterteiger/vectormath"
+	"fmt"
+	"math"
+)
+
+// ReadChannel copies the channel called name to CPU memory as stored, i.e.
+// normals are still encoded. Debugging only, this stalls the pipeline.
+func (g *GBuffer) ReadChannel(name string) (*texture.FloatImage, error) {
+	tex := g.GetTexture(name)
+	if tex == 0 {
+		return nil, fmt.Errorf("gbuffer has no channel %q", name)
+	}
+
+	return texture.ReadTexture(tex, 0)
+}
+
+// ReadNormals reads the normal channel and decodes it to 3-component eye
+// space normals in [-1,1].
+func (g *GBuffer) ReadNormals() (*texture.FloatImage, error) {
+	enc, err := g.ReadChannel(ChannelNormal)
+	if err != nil {
+		return nil, err
+	}
+
+	img := texture.MakeFloatImage(enc.W, enc.H, 3)
+	for y := 0; y < enc.H; y++ {
+		for x := 0; x < enc.W; x++ {
+			var e [3]float64
+			for c, v := range enc.At(x, y) {
+				e[c] = float64(v)
+			}
+
+			n := decodeNormal(g.layout.NormalEncoding, e)
+			px := img.At(x, y)
+			px[0], px[1], px[2] = float32(n[0]), float32(n[1]), float32(n[2])
+		}
+	}
+
+	return img, nil
+}
+
+// ReadDepth reads the depth attachment as window space depth in [0,1].
+func (g *GBuffer) ReadDepth() (*texture.FloatImage, error) {
+	return texture.ReadTexture(g.GetDepthTex(), 0)
+}
+
+// ReadLinearDepth reads the depth attachment and converts it to eye space
+// distances using the projection it was rendered with.
+func (g *GBuffer) ReadLinearDepth(P *vmath.Matrix4) (*texture.FloatImage, error) {
+	img, err := g.ReadDepth()
+	if err != nil {
+		return nil, err
+	}
+
+	LinearizeDepth(img, P)
+	return img, nil
+}
+
+// LinearizeDepth converts window space depth values in img to positive eye
+// space distances in place. P may be a perspective or an orthographic
+// projection, so this works for shadow maps, too. Cleared pixels (depth 1)
+// end up at the far plane.
+func LinearizeDepth(img *texture.FloatImage, P *vmath.Matrix4) {
+	// z_ndc = (P22 * z_eye + P32) / (P23 * z_eye + P33), solved for z_eye
+	p22 := float64(P.GetElem(2, 2))
+	p32 := float64(P.GetElem(3, 2))
+	p23 := float64(P.GetElem(2, 3))
+	p33 := float64(P.GetElem(3, 3))
+
+	for i, d := range img.Pix {
+		ndc := 2 * float64(d) - 1
+
+		denom := p22 - ndc * p23
+		if math.Abs(denom) < 1e-12 {
+			img.Pix[i] = float32(math.Inf(1))
+			continue
+		}
+
+		img.Pix[i] = float32(-(ndc * p33 - p32) / denom)
+	}
+}
@@ -1,8 +1,6 @@
 package geom
 import (
-	gl "github.com/chsc/gogl/gl43"
 	"log"
-	"github.com/rwesterteiger/go-gltest/buffers"
 	"strings"
 	"strconv"
 	"os"
@@ -107,12 +105,10 @@ func parseOBJ(path string) (objData *OBJData) {
 	return
 }
 
-func makeVAOFromOBJ(obj *OBJData) (*buffers.VAO) {
+func makeMeshFromOBJ(obj *OBJData) (*Mesh) {
 	indicesToIdxMap := make(map[string]uint32) // maps a string "vtxidx/normalidx" to the index in our vertex and normal vbos
 
-	idxBuffer := make([]uint32, 0)
-	vtxBuffer := make([]vmath.Vector3, 0)
-	normalBuffer := make([]vmath.Vector3, 0)
+	mesh := new(Mesh)
 
 	for _, f := range(obj.Faces) {
 		for i := 0; i < 3; i++ {
@@ -120,36 +116,19 @@ func makeVAOFromOBJ(obj *OBJData) (*buffers.VAO) {
 			idx, ok := indicesToIdxMap[key]
 
 			if !ok {
-				idx = uint32(len(vtxBuffer))
+				idx = uint32(len(mesh.Vertices))
 				indicesToIdxMap[key] = idx
-				vtxBuffer = append(vtxBuffer, obj.Vertices[f.VtxIndices[i] - 1])
-				normalBuffer = append(normalBuffer, obj.Normals[f.NormalIndices[i] - 1])
+				mesh.Vertices = append(mesh.Vertices, obj.Vertices[f.VtxIndices[i] - 1])
+				mesh.Normals = append(mesh.Normals, obj.Normals[f.NormalIndices[i] - 1])
 			}
 
-			idxBuffer = append(idxBuffer, idx)
+			mesh.Indices = append(mesh.Indices, idx)
 		}
 	}
 
-	//fmt.Printf("vtxBuffer = %v\n", vtxBuffer)
-	vtxVBO := buffers.MakeVBOFromVec3s(vtxBuffer)
-	defer vtxVBO.Delete()
-
-	//fmt.Printf("normalBuffer = %v\n", normalBuffer)
-	normalVBO := buffers.MakeVBOFromVec3s(normalBuffer)
-	defer normalVBO.Delete()
-
-	//fmt.Printf("idxBuffer = %v\n", idxBuffer)
-	vao := buffers.MakeVAO(gl.TRIANGLES, len(idxBuffer))
-
-	vao.AttachVBO(0, vtxVBO)
-	vao.AttachVBO(1, normalVBO)
-	vao.SetIndexBuffer(idxBuffer)
-
-	return vao
+	return mesh
 }
 
 func LoadOBJ(path string, diffuseColor *vmath.Vector4) *Object {
-	vao := makeVAOFromOBJ(parseOBJ(path))
-	return MakeObject(vao, diffuseColor)
+	return MakeObjectFromMesh(makeMeshFromOBJ(parseOBJ(path)), diffuseColor)
 }
-
@@ -0,0 +1,69 @@
+package geom
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/buffers"
+	vmath "github.com/rwesterteiger/vectormath"
+)
+
+// Mesh is the CPU-side copy of an indexed triangle mesh. Objects made from a
+// Mesh keep it around so the scene can pack all meshes into shared buffers.
+type Mesh struct {
+	Vertices []vmath.Vector3
+	Normals []vmath.Vector3
+	Indices []uint32
+}
+
+func (m *Mesh) makeVAO() *buffers.VAO {
+	vtxVBO := buffers.MakeVBOFromVec3s(m.Vertices)
+	normalVBO := buffers.MakeVBOFromVec3s(m.Normals)
+
+	vao := buffers.MakeVAO(gl.TRIANGLES, len(m.Indices))
+	vao.AttachVBO(0, vtxVBO)
+	vao.AttachVBO(1, normalVBO)
+	vao.SetIndexBufferCompact(m.Indices)
+
+	return vao
+}
+
+// boundingSphere returns a sphere around the vertices, centered on their
+// bounding box.
+func (m *Mesh) boundingSphere() (center vmath.Point3, radius float32) {
+	lo, hi := m.Vertices[0], m.Vertices[0]
+	for _, v := range m.Vertices {
+		lo = vmath.Vector3{ min32(lo.X, v.X), min32(lo.Y, v.Y), min32(lo.Z, v.Z) }
+		hi = vmath.Vector3{ max32(hi.X, v.X), max32(hi.Y, v.Y), max32(hi.Z, v.Z) }
+	}
+
+	center = vmath.Point3{ (lo.X + hi.X) / 2, (lo.Y + hi.Y) / 2, (lo.Z + hi.Z) / 2 }
+
+	for _, v := range m.Vertices {
+		d := vmath.Vector3{ v.X - center.X, v.Y - center.Y, v.Z - center.Z }
+		if l := d.Length(); l > radius {
+			radius = l
+		}
+	}
+
+	return
+}
+
+func min32(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max32(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func MakeObjectFromMesh(mesh *Mesh, diffuseColor *vmath.Vector4) (o *Object) {
+	o = MakeObject(mesh.makeVAO(), diffuseColor)
+	o.mesh = mesh
+
+	return
+}
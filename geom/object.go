@@ -5,23 +5,68 @@ import (
 	vmath "github.com/rwesterteiger/vectormath"
 )
 
+// Material holds the per-object surface values written to the G-buffer
+// channels besides albedo and normal.
+type Material struct {
+	Roughness float32
+	Metalness float32
+	Emissive vmath.Vector3
+	ID uint32 // free for use by lights and post filters, e.g. to mask passes
+}
+
+var DefaultMaterial = Material{ Roughness : 0.5 }
+
 type Object struct {
 	vao *buffers.VAO
+	ownsVAO bool // false for objects made with MakeInstance
+	mesh *Mesh // CPU copy of the geometry, nil if the object was made from a bare VAO
 	diffuseColor vmath.Vector4
+	material Material
 	modelMat vmath.Matrix4
+	prevModelMat vmath.Matrix4 // model matrix of the previous frame, for velocity
+	revision uint64 // bumped whenever the model matrix changes
+
+	// object space bounding sphere, computed from the mesh on first use
+	boundsCenter vmath.Point3
+	boundsRadius float32
+	hasBounds bool
 }
 
 func MakeObject(vao *buffers.VAO, diffuseColor *vmath.Vector4) (o *Object) {
 	o = new(Object)
 	o.vao = vao
+	o.ownsVAO = true
 	vmath.V4Copy(&o.diffuseColor, diffuseColor)
+	o.material = DefaultMaterial
 	vmath.M4MakeIdentity(&o.modelMat)
+	vmath.M4MakeIdentity(&o.prevModelMat)
+
+	return
+}
+
+// MakeInstance returns a new object that shares o's mesh. The scene batches
+// objects sharing a mesh into a single instanced draw call. The shared VAO
+// stays owned by o.
+func (o *Object) MakeInstance(diffuseColor *vmath.Vector4) (inst *Object) {
+	inst = MakeObject(o.vao, diffuseColor)
+	inst.ownsVAO = false
+	inst.mesh = o.mesh
 
 	return
 }
 
 func (o *Object) Delete() {
-	o.vao.Delete()
+	if o.ownsVAO {
+		o.vao.Delete()
+	}
+}
+
+func (o *Object) GetVAO() *buffers.VAO {
+	return o.vao
+}
+
+func (o *Object) GetMesh() *Mesh {
+	return o.mesh
 }
 
 func (o *Object) Draw() {
@@ -32,11 +77,73 @@ func (o *Object) GetDiffuseColor() (*vmath.Vector4) {
 	return &o.diffuseColor
 }
 
+// SetModelMatrix moves the object. It is the only way to do so: caches
+// like shadow maps notice movement by GetRevision.
 func (o *Object) SetModelMatrix(M *vmath.Matrix4) {
+	if *M == o.modelMat {
+		return
+	}
+
 	vmath.M4Copy(&o.modelMat, M)
+	o.revision++
+}
+
+// GetRevision returns a counter which changes whenever the object moves,
+// for caches of rendered results like shadow maps.
+func (o *Object) GetRevision() uint64 {
+	return o.revision
 }
 
+// GetBounds returns a world space bounding sphere of the object. ok is false
+// for objects made from a bare VAO, whose extent is unknown.
+func (o *Object) GetBounds() (center vmath.Point3, radius float32, ok bool) {
+	if o.mesh == nil || len(o.mesh.Vertices) == 0 {
+		return
+	}
+
+	if !o.hasBounds {
+		o.boundsCenter, o.boundsRadius = o.mesh.boundingSphere()
+		o.hasBounds = true
+	}
+
+	var c vmath.Vector4
+	vmath.M4MulP3(&c, &o.modelMat, &o.boundsCenter)
+	center = vmath.Point3{ c.X, c.Y, c.Z }
+
+	// the largest scale of the model matrix
+	var scale float32
+	for col := 0; col < 3; col++ {
+		axis := vmath.Vector3{ o.modelMat.GetElem(col, 0), o.modelMat.GetElem(col, 1), o.modelMat.GetElem(col, 2) }
+		if l := axis.Length(); l > scale {
+			scale = l
+		}
+	}
+
+	return center, o.boundsRadius * scale, true
+}
+
+// GetModelMatrix returns the object's model matrix, which must not be
+// modified: changing it in place does not bump GetRevision, so cached
+// shadows would go stale. Use SetModelMatrix instead.
 func (o *Object) GetModelMatrix() (*vmath.Matrix4) {
 	return &o.modelMat
 }
 
+func (o *Object) GetPrevModelMatrix() (*vmath.Matrix4) {
+	return &o.prevModelMat
+}
+
+// EndFrame makes the current model matrix the previous one. The scene calls
+// it after each rendered frame.
+func (o *Object) EndFrame() {
+	vmath.M4Copy(&o.prevModelMat, &o.modelMat)
+}
+
+func (o *Object) GetMaterial() (*Material) {
+	return &o.material
+}
+
+func (o *Object) SetMaterial(m *Material) {
+	o.material = *m
+}
+
@@ -0,0 +1,162 @@
+// Package gldebug keeps a registry of the GL objects created by the other
+// packages so that leaked objects can be reported at shutdown, together with
+// the stack trace of their creation.
+package gldebug
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type ResourceKind int
+
+const (
+	Texture ResourceKind = iota
+	Buffer
+	VertexArray
+	Framebuffer
+	Renderbuffer
+	Program
+	Sampler
+)
+
+func (k ResourceKind) String() string {
+	switch k {
+	case Texture:
+		return "texture"
+	case Buffer:
+		return "buffer"
+	case VertexArray:
+		return "vertex array"
+	case Framebuffer:
+		return "framebuffer"
+	case Renderbuffer:
+		return "renderbuffer"
+	case Program:
+		return "program"
+	case Sampler:
+		return "sampler"
+	}
+
+	return "unknown"
+}
+
+type resourceKey struct {
+	kind ResourceKind
+	handle gl.Uint
+}
+
+type resourceInfo struct {
+	seq int // creation order, for a stable report
+	stack string
+}
+
+var (
+	mutex sync.Mutex
+	enabled bool
+	seq int
+	alive = make(map[resourceKey]resourceInfo)
+)
+
+// Enable starts recording. Objects created before Enable are not tracked.
+func Enable() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	enabled = true
+}
+
+func Enabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return enabled
+}
+
+func callerStack(skip int) string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(skip + 1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var b strings.Builder
+	for {
+		f, more := frames.Next()
+		if f.Function == "runtime.main" || f.Function == "runtime.goexit" {
+			break
+		}
+
+		fmt.Fprintf(&b, "\t%s\n\t\t%s:%d\n", f.Function, f.File, f.Line)
+
+		if !more {
+			break
+		}
+	}
+
+	return b.String()
+}
+
+// Track records the creation of a GL object. Handle 0 is ignored.
+func Track(kind ResourceKind, handle gl.Uint) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !enabled || handle == 0 {
+		return
+	}
+
+	seq++
+	alive[resourceKey{ kind, handle }] = resourceInfo{ seq : seq, stack : callerStack(2) }
+}
+
+// Untrack records the deletion of a GL object.
+func Untrack(kind ResourceKind, handle gl.Uint) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(alive, resourceKey{ kind, handle })
+}
+
+// LiveCount returns the number of tracked objects that have not been deleted.
+func LiveCount() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return len(alive)
+}
+
+// Report writes every tracked object that is still alive, in creation order,
+// and returns how many there are.
+func Report(w io.Writer) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	keys := make([]resourceKey, 0, len(alive))
+	for k := range alive {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return alive[keys[i]].seq < alive[keys[j]].seq })
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "leaked %s %d, created at:\n%s", k.kind, k.handle, alive[k].stack)
+	}
+
+	if len(keys) > 0 {
+		fmt.Fprintf(w, "%d GL objects leaked\n", len(keys))
+	}
+
+	return len(keys)
+}
+
+// ReportLeaks writes the leak report to stderr; meant to be deferred in main
+// after all other cleanup.
+func ReportLeaks() {
+	if Enabled() {
+		Report(os.Stderr)
+	}
+}
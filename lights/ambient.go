@@ -4,6 +4,7 @@ import (
 	"github.com/rwesterteiger/go-gltest/shader"
 	"github.com/rwesterteiger/go-gltest/buffers"
 	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/texture"
 	vmath "github.com/rwesterteiger/vectormath"
 	gl "github.com/chsc/gogl/gl43"
 )
@@ -29,10 +30,16 @@ const ambientLightFragShaderSrc = `
 	layout (location = 1) noperspective in vec2 tc;
 
 	layout (location = 0) uniform sampler2D albedoTex;
+	layout (location = 1) uniform sampler2D emissiveTex;
+	layout (location = 2) uniform bool hasEmissive;
 
 	void main(void)
 	{
 		fragData = 0.2 * texture2D(albedoTex, tc);
+
+		if (hasEmissive) {
+			fragData.rgb += texture2D(emissiveTex, tc).rgb;
+		}
 	}
 `
 
@@ -67,27 +74,41 @@ func (s *AmbientLight) Delete() {
 	s.fsQuadVAO.Delete()
 }
 
-func (_ *AmbientLight) NeedDepthPass() bool {
-	return false
+func (_ *AmbientLight) NumDepthPasses() int {
+	return 0
 }
 
-func (s *AmbientLight) BeginDepthPass() (projMat, viewMat *vmath.Matrix4) {
+func (s *AmbientLight) BeginDepthPass(pass int, camProjMat, camViewMat *vmath.Matrix4) (projMat, viewMat *vmath.Matrix4) {
 	return nil, nil
 }
 
-func (s *AmbientLight) EndDepthPass() {
+func (s *AmbientLight) EndDepthPass(pass int) {
 }
 
 func (s *AmbientLight) Render(gbuf *gbuffer.GBuffer, projMat, viewMat *vmath.Matrix4) {
-	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, gbuf.GetAlbedoTex())
+	// ambient light is linear in the G-buffer values, so with MSAA, lighting
+	// the resolved textures equals averaging the lit samples
+	texture.BindUnit(0, gbuf.GetAlbedoTex(), texture.GetSampler(texture.NearestClamp))
 	s.shader.ProgramUniform1i(0, 0)
 
+	// emissive surfaces are added once, here, if the layout stores them
+	hasEmissive := gbuf.HasChannel(gbuffer.ChannelEmissive)
+	if hasEmissive {
+		texture.BindUnit(1, gbuf.GetTexture(gbuffer.ChannelEmissive), texture.GetSampler(texture.NearestClamp))
+		s.shader.ProgramUniform1i(1, 1)
+		s.shader.ProgramUniform1i(2, 1)
+	} else {
+		s.shader.ProgramUniform1i(2, 0)
+	}
+
 	s.shader.Enable()
 	s.fsQuadVAO.Draw()
 	s.shader.Disable()
 
-	gl.BindTexture(gl.TEXTURE_2D, 0)
+	if hasEmissive {
+		texture.UnbindUnit(1)
+	}
+	texture.UnbindUnit(0)
 }
 
 
@@ -0,0 +1,526 @@
+package lights
+
+import (
+	"github.com/rwesterteiger/go-gltest/shadowmap"
+	"github.com/rwesterteiger/go-gltest/shader"
+	"github.com/rwesterteiger/go-gltest/buffers"
+	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/texture"
+	vmath "github.com/rwesterteiger/vectormath"
+	"math"
+	"log"
+	gl "github.com/chsc/gogl/gl43"
+)
+
+// MaxCascades is the maximum number of shadow cascades of a DirectionalLight.
+const MaxCascades = 4
+
+// directionalLightFragShaderSrc runs on a fullscreen quad, using the vertex
+// shader of the ambient light.
+const directionalLightFragShaderSrc = `
+	#version 430
+
+	layout (location = 0) out vec4 fragData;
+	layout (location = 1) noperspective in vec2 tc;
+
+#ifdef MSAA
+	layout (location = 0) uniform sampler2DMS albedoTex;
+	layout (location = 1) uniform sampler2DMS normalTex;
+	layout (location = 2) uniform sampler2DMS depthTex;
+	layout (location = 16) uniform int samples;
+
+	bool isEdgePixel(); // gbuffer.MultisampleShaderSource
+
+	#define FETCH(tex, s) texelFetch(tex, ivec2(gl_FragCoord.xy), s)
+#else
+	layout (location = 0) uniform sampler2D albedoTex;
+	layout (location = 1) uniform sampler2D normalTex;
+	layout (location = 2) uniform sampler2D depthTex;
+
+	#define FETCH(tex, s) texture2D(tex, tc)
+#endif
+	layout (location = 3) uniform sampler2DArrayShadow shadowMapTex;
+	layout (location = 4) uniform mat4 invP; // camera NDC -> viewspace
+	layout (location = 8) uniform vec3 lightDir; // eyespace direction the light travels in
+	layout (location = 9) uniform vec3 color;
+	layout (location = 10) uniform int cascades;
+	layout (location = 11) uniform vec4 splitFar; // eyespace distance where each cascade ends
+	layout (location = 12) uniform float blendBand; // fraction of a cascade blended into the next one
+	layout (location = 13) uniform float shadowTexelSize;
+	layout (location = 14) uniform float constantBias;
+	layout (location = 15) uniform vec4 normalOffset; // per cascade, in world units
+	layout (location = 20) uniform mat4 shadowPV[4]; // camera viewspace --> shadow clipspace, per cascade
+
+	const mat4 bias = mat4(0.5, 0.0, 0.0, 0.0,
+		               0.0, 0.5, 0.0, 0.0,
+			       0.0, 0.0, 0.5, 0.0,
+        	               0.5, 0.5, 0.5, 1.0);
+
+	vec3 decodeNormal(vec3 e); // gbuffer.NormalCodecShaderSource
+
+	// getCascadeShadow filters the shadow of cascade i with 3x3 PCF
+	float getCascadeShadow(int i, vec3 pos, vec3 n) {
+		pos += n * normalOffset[i];
+
+		// orthographic projection, no divide needed
+		vec4 c = bias * shadowPV[i] * vec4(pos, 1);
+		float z = c.z - constantBias;
+
+		float d = 0.0;
+		for (int y = -1; y <= 1; y++) {
+			for (int x = -1; x <= 1; x++) {
+				d += texture(shadowMapTex, vec4(c.xy + vec2(x, y) * shadowTexelSize, i, z));
+			}
+		}
+
+		return d / 9.0;
+	}
+
+	float getShadowAttenuation(vec3 pos, vec3 n) {
+		float depth = -pos.z;
+
+		int i = 0;
+		while (i < cascades && depth > splitFar[i]) {
+			i++;
+		}
+
+		// beyond the shadow distance everything is lit
+		if (i == cascades) {
+			return 1.0;
+		}
+
+		float s = getCascadeShadow(i, pos, n);
+
+		// fade into the next cascade towards the end of this one, hiding the seam
+		float begin = i > 0 ? splitFar[i-1] : 0.0;
+		float band = blendBand * (splitFar[i] - begin);
+		float f = (splitFar[i] - depth) / band;
+
+		if (f < 1.0 && i + 1 < cascades) {
+			s = mix(getCascadeShadow(i + 1, pos, n), s, f);
+		}
+
+		return s;
+	}
+
+	// shade lights G-buffer sample s
+	vec4 shade(int s)
+	{
+		float z = FETCH(depthTex, s).x;
+		if (z == 1.0) {
+			return vec4(0); // background
+		}
+
+		vec4 diffuseMaterial = FETCH(albedoTex, s);
+		vec3 n = decodeNormal(FETCH(normalTex, s).xyz); // eyespace normal
+
+		// determine eye-space position of pixel
+		vec4 pos = invP * (2 * vec4(tc, z, 1.0) - 1);
+		pos /= pos.w;
+
+		float NdotL = -dot(lightDir, n);
+		if (NdotL < 0.0) {
+			return vec4(0);
+		}
+
+		vec4 diffuse = vec4(color, 1) * diffuseMaterial * NdotL;
+
+		float specStrength = max(0.0, dot(reflect(lightDir, n), -normalize(pos.xyz)));
+		vec4 specular = vec4(color * pow(specStrength, 16), 0);
+
+		return getShadowAttenuation(pos.xyz, n) * (diffuse + specular);
+	}
+
+	void main(void)
+	{
+#ifdef MSAA
+		// edge pixels are lit per sample and averaged, all others once
+		if (isEdgePixel()) {
+			vec4 sum = vec4(0);
+			for (int i = 0; i < samples; i++) {
+				sum += shade(i);
+			}
+			fragData = sum / samples;
+			return;
+		}
+#endif
+		fragData = shade(0);
+	}
+`
+
+// DirectionalLight is a light infinitely far away, like the sun. Its shadows
+// cover the camera frustum up to the shadow distance with cascaded shadow
+// maps, each cascade fit to one slice of the frustum.
+type DirectionalLight struct {
+	dir vmath.Vector3 // world space direction the light travels in
+	color vmath.Vector3
+
+	cascades int
+	splitLambda float32
+	shadowDistance float32
+	blendBand float32
+
+	// per cascade, updated by the first depth pass of each frame
+	splits [MaxCascades+1]float32 // eyespace distances, splits[0] is the camera near plane
+	radius [MaxCascades]float32 // of the bounding sphere of the frustum slice
+	projMat [MaxCascades]vmath.Matrix4
+	viewMat [MaxCascades]vmath.Matrix4
+
+	shadowMap *shadowmap.Array
+	shadowQuality shadowmap.Quality
+	shader *shader.Shader
+	msaaShader *shader.Shader // built on first use with a multisampled G-buffer
+
+	fsQuadVAO *buffers.VAO
+}
+
+// MakeDirectionalLight creates a light shining in direction dir with
+// cascades (1 to MaxCascades) shadow cascades.
+func MakeDirectionalLight(dir, color *vmath.Vector3, cascades int) (d *DirectionalLight) {
+	if cascades < 1 || cascades > MaxCascades {
+		log.Fatalf("Invalid cascade count %d", cascades)
+	}
+
+	d = &DirectionalLight{ cascades : cascades, splitLambda : 0.75, shadowDistance : 50, blendBand : 0.1 }
+
+	vmath.V3Normalize(&d.dir, dir)
+	vmath.V3Copy(&d.color, color)
+
+	d.shadowQuality = shadowmap.QualityMedium
+	size, format := d.shadowQuality.Settings()
+	d.shadowMap = shadowmap.MakeArray(size, format, cascades)
+
+	d.shader = shader.Make()
+	d.shader.AddShaderSource(ambientLightVtxShaderSrc, gl.VERTEX_SHADER)
+	d.shader.AddShaderSource(directionalLightFragShaderSrc, gl.FRAGMENT_SHADER)
+	d.shader.AddShaderSource(gbuffer.NormalCodecShaderSource, gl.FRAGMENT_SHADER)
+	d.shader.Link()
+
+	// make fullscreen quad VAO
+	vtxs := buffers.MakeVBOFromVec2s([]vmath.Vector2{ {-1, -1}, {1, -1}, {1, 1}, {-1, 1} })
+	tcs := buffers.MakeVBOFromVec2s([]vmath.Vector2{ { 0,0 }, {1,0}, {1,1}, {0,1} })
+	indices := []uint32{ 0, 1, 2, 2, 3, 0 }
+
+	d.fsQuadVAO = buffers.MakeVAO(gl.TRIANGLES, 6)
+	d.fsQuadVAO.AttachVBO(0, vtxs)
+	d.fsQuadVAO.AttachVBO(1, tcs)
+	d.fsQuadVAO.SetIndexBuffer(indices)
+
+	return
+}
+
+func (d *DirectionalLight) Delete() {
+	d.shadowMap.Delete()
+	d.shader.Delete()
+	if d.msaaShader != nil {
+		d.msaaShader.Delete()
+	}
+	d.fsQuadVAO.Delete()
+}
+
+// SetCascadeSplitLambda blends the cascade split distances between a
+// uniform (0) and a logarithmic (1) distribution.
+func (d *DirectionalLight) SetCascadeSplitLambda(lambda float32) {
+	d.splitLambda = lambda
+}
+
+func (d *DirectionalLight) GetCascadeSplitLambda() float32 {
+	return d.splitLambda
+}
+
+// SetShadowDistance limits the shadows to this eyespace distance from the
+// camera, or the camera far plane if that is closer.
+func (d *DirectionalLight) SetShadowDistance(dist float32) {
+	d.shadowDistance = dist
+}
+
+func (d *DirectionalLight) GetShadowDistance() float32 {
+	return d.shadowDistance
+}
+
+// SetCascadeBlendBand sets the fraction at the end of each cascade which is
+// blended with the next one; 0 gives hard transitions.
+func (d *DirectionalLight) SetCascadeBlendBand(band float32) {
+	d.blendBand = band
+}
+
+func (d *DirectionalLight) GetCascadeBlendBand() float32 {
+	return d.blendBand
+}
+
+// GetCascadeSplits returns the eyespace distances where the cascades of the
+// last frame begin and end, one more than there are cascades.
+func (d *DirectionalLight) GetCascadeSplits() []float32 {
+	return d.splits[:d.cascades+1]
+}
+
+// SetShadowQuality replaces the shadow maps by ones of the size and format
+// of q.
+func (d *DirectionalLight) SetShadowQuality(q shadowmap.Quality) {
+	d.shadowQuality = q
+
+	size, format := q.Settings()
+	if size == d.shadowMap.GetSize() && format == d.shadowMap.GetFormat() {
+		return
+	}
+
+	b := d.shadowMap.GetBias()
+	d.shadowMap.Delete()
+	d.shadowMap = shadowmap.MakeArray(size, format, d.cascades)
+	d.shadowMap.SetBias(b)
+}
+
+func (d *DirectionalLight) GetShadowQuality() shadowmap.Quality {
+	return d.shadowQuality
+}
+
+func (d *DirectionalLight) GetShadowBias() shadowmap.Bias {
+	return d.shadowMap.GetBias()
+}
+
+func (d *DirectionalLight) SetShadowBias(b shadowmap.Bias) {
+	d.shadowMap.SetBias(b)
+}
+
+// SetShadowFilter only supports shadowmap.FilterPCF: the cascades have
+// no moments to filter and no single perspective for PCSS.
+func (d *DirectionalLight) SetShadowFilter(f shadowmap.Filter) {
+	if f != shadowmap.FilterPCF {
+		log.Printf("Shadow filter %v not supported by directional lights", f)
+	}
+}
+
+func (_ *DirectionalLight) GetShadowFilter() shadowmap.Filter {
+	return shadowmap.FilterPCF
+}
+
+func (d *DirectionalLight) NumShadowMaps() int {
+	return d.cascades
+}
+
+func (d *DirectionalLight) GetShadowMap(i int) ShadowMapView {
+	return ShadowMapView{ Texture : d.shadowMap.GetDepthTex(), Target : gl.TEXTURE_2D_ARRAY, Layer : i, ProjMat : &d.projMat[i] }
+}
+
+func (d *DirectionalLight) NumDepthPasses() int {
+	return d.cascades
+}
+
+// BeginDepthPass renders cascade pass. The first pass fits all cascades to
+// the camera frustum.
+func (d *DirectionalLight) BeginDepthPass(pass int, camProjMat, camViewMat *vmath.Matrix4) (projMat, viewMat *vmath.Matrix4) {
+	if pass == 0 {
+		d.updateCascades(camProjMat, camViewMat)
+	}
+
+	d.shadowMap.BeginDepthPass(pass)
+
+	// casters between the light and the near plane of a cascade are clamped
+	// to it instead of being clipped
+	gl.Enable(gl.DEPTH_CLAMP)
+
+	return &d.projMat[pass], &d.viewMat[pass]
+}
+
+func (d *DirectionalLight) EndDepthPass(pass int) {
+	gl.Disable(gl.DEPTH_CLAMP)
+	d.shadowMap.EndDepthPass()
+}
+
+// updateCascades computes the split distances with the practical split
+// scheme and fits an orthographic projection to each frustum slice.
+func (d *DirectionalLight) updateCascades(camProjMat, camViewMat *vmath.Matrix4) {
+	// near and far plane of a perspective projection
+	p22, p32 := camProjMat.GetElem(2, 2), camProjMat.GetElem(3, 2)
+	near, far := p32 / (p22 - 1), p32 / (p22 + 1)
+
+	if d.shadowDistance > near && d.shadowDistance < far {
+		far = d.shadowDistance
+	}
+
+	n := float64(d.cascades)
+	for i := 0; i <= d.cascades; i++ {
+		t := float64(i) / n
+		logSplit := float64(near) * math.Pow(float64(far / near), t)
+		uniformSplit := float64(near) + float64(far - near) * t
+		d.splits[i] = float32(float64(d.splitLambda) * logSplit + (1 - float64(d.splitLambda)) * uniformSplit)
+	}
+
+	var invP, invV vmath.Matrix4
+	vmath.M4Inverse(&invP, camProjMat)
+	vmath.M4Inverse(&invV, camViewMat)
+
+	// eyespace corners of the far plane; the frustum corners at any other
+	// distance are these scaled
+	var farCorners [4]vmath.Vector3
+	for i := range farCorners {
+		ndc := vmath.Vector4{ float32(2 * (i & 1) - 1), float32(2 * (i >> 1) - 1), 1, 1 }
+
+		var c vmath.Vector4
+		vmath.M4MulV4(&c, &invP, &ndc)
+
+		farCorners[i] = vmath.Vector3{ c.X / c.W, c.Y / c.W, c.Z / c.W }
+		vmath.V3ScalarMul(&farCorners[i], &farCorners[i], far / -farCorners[i].Z)
+	}
+
+	for i := 0; i < d.cascades; i++ {
+		d.fitCascade(i, &farCorners, far, &invV)
+	}
+}
+
+// fitCascade fits cascade i to the bounding sphere of its frustum slice. The
+// sphere does not change with the camera orientation, and the projection is
+// snapped to whole shadow map texels, so shadow edges do not shimmer while
+// the camera moves.
+func (d *DirectionalLight) fitCascade(i int, farCorners *[4]vmath.Vector3, far float32, invV *vmath.Matrix4) {
+	var corners [8]vmath.Point3
+	for j, dist := range []float32{ d.splits[i], d.splits[i+1] } {
+		for k := range farCorners {
+			s := dist / far
+			c := vmath.Point3{ farCorners[k].X * s, farCorners[k].Y * s, farCorners[k].Z * s }
+
+			var ws vmath.Vector4
+			vmath.M4MulP3(&ws, invV, &c)
+			corners[4*j+k] = vmath.Point3{ ws.X, ws.Y, ws.Z }
+		}
+	}
+
+	var center vmath.Point3
+	for _, c := range corners {
+		center.X += c.X / 8
+		center.Y += c.Y / 8
+		center.Z += c.Z / 8
+	}
+
+	var r float32
+	for _, c := range corners {
+		var diff vmath.Vector3
+		vmath.P3Sub(&diff, &c, &center)
+		if l := diff.Length(); l > r {
+			r = l
+		}
+	}
+	// rounding keeps the size from jittering with float precision
+	r = float32(math.Ceil(float64(r) * 16)) / 16
+	d.radius[i] = r
+
+	var back vmath.Vector3
+	vmath.V3ScalarMul(&back, &d.dir, -r)
+
+	var eye vmath.Point3
+	vmath.P3AddV3(&eye, &center, &back)
+
+	up := vmath.Vector3{ 0, 1, 0 }
+	if math.Abs(float64(d.dir.Y)) > 0.99 {
+		up = vmath.Vector3{ 1, 0, 0 }
+	}
+
+	vmath.M4MakeLookAt(&d.viewMat[i], &eye, &center, &up)
+	vmath.M4MakeOrthographic(&d.projMat[i], -r, r, -r, r, 0, 2 * r)
+
+	// move the projection so that the world origin falls on a texel corner
+	var PV vmath.Matrix4
+	vmath.M4Mul(&PV, &d.projMat[i], &d.viewMat[i])
+
+	var origin vmath.Vector4
+	vmath.M4MulP3(&origin, &PV, &vmath.Point3{ 0, 0, 0 })
+
+	texels := float32(d.shadowMap.GetSize()) / 2 // per NDC unit
+	x, y := origin.X * texels, origin.Y * texels
+	dx := (float32(math.Floor(float64(x) + 0.5)) - x) / texels
+	dy := (float32(math.Floor(float64(y) + 0.5)) - y) / texels
+
+	d.projMat[i].SetElem(3, 0, d.projMat[i].GetElem(3, 0) + dx)
+	d.projMat[i].SetElem(3, 1, d.projMat[i].GetElem(3, 1) + dy)
+}
+
+// shaderFor returns the light shader variant matching the sample count of
+// gbuf.
+func (d *DirectionalLight) shaderFor(gbuf *gbuffer.GBuffer) *shader.Shader {
+	if gbuf.GetSamples() <= 1 {
+		return d.shader
+	}
+
+	if d.msaaShader == nil {
+		d.msaaShader = shader.Make()
+		d.msaaShader.AddShaderSource(ambientLightVtxShaderSrc, gl.VERTEX_SHADER)
+		d.msaaShader.AddShaderSourceWithDefines(directionalLightFragShaderSrc, gl.FRAGMENT_SHADER, "MSAA")
+		d.msaaShader.AddShaderSource(gbuffer.NormalCodecShaderSource, gl.FRAGMENT_SHADER)
+		d.msaaShader.AddShaderSource(gbuffer.MultisampleShaderSource, gl.FRAGMENT_SHADER)
+		d.msaaShader.Link()
+	}
+
+	return d.msaaShader
+}
+
+func (d *DirectionalLight) Render(gbuf *gbuffer.GBuffer, projMat, viewMat *vmath.Matrix4) {
+	sh := d.shaderFor(gbuf)
+
+	var invP vmath.Matrix4
+	vmath.M4Inverse(&invP, projMat)
+	sh.ProgramUniformM4(4, &invP)
+
+	// with MSAA the samples are read directly, see gbuffer.Resolve
+	gbufTarget := gl.Enum(gl.TEXTURE_2D)
+	if gbuf.GetSamples() > 1 {
+		gbufTarget = gl.TEXTURE_2D_MULTISAMPLE
+		gbuf.SetMultisampleUniforms(sh, 4)
+		sh.ProgramUniform1i(16, gbuf.GetSamples())
+	}
+
+	texture.BindUnitTarget(0, gbufTarget, gbuf.GetMultisampleTexture(gbuffer.ChannelAlbedo), texture.GetSampler(texture.NearestClamp))
+	sh.ProgramUniform1i(0, 0)
+
+	texture.BindUnitTarget(1, gbufTarget, gbuf.GetMultisampleTexture(gbuffer.ChannelNormal), texture.GetSampler(texture.NearestClamp))
+	sh.ProgramUniform1i(1, 1)
+	gbuf.SetNormalCodecUniforms(sh)
+
+	texture.BindUnitTarget(2, gbufTarget, gbuf.GetMultisampleDepthTex(), texture.GetSampler(texture.NearestClamp))
+	sh.ProgramUniform1i(2, 2)
+
+	texture.BindUnitTarget(3, gl.TEXTURE_2D_ARRAY, d.shadowMap.GetDepthTex(), texture.GetSampler(texture.ShadowCompare))
+	sh.ProgramUniform1i(3, 3)
+	sh.ProgramUniform1f(13, d.shadowMap.GetTexelSize())
+
+	var eyeSpaceDir vmath.Vector4
+	vmath.M4MulV3(&eyeSpaceDir, viewMat, &d.dir)
+	sh.ProgramUniform3f(8, eyeSpaceDir.X, eyeSpaceDir.Y, eyeSpaceDir.Z)
+	sh.ProgramUniform3f(9, d.color.X, d.color.Y, d.color.Z)
+
+	sh.ProgramUniform1i(10, d.cascades)
+	sh.ProgramUniform4f(11, d.splits[1], d.splits[2], d.splits[3], d.splits[4])
+	sh.ProgramUniform1f(12, d.blendBand)
+
+	// a texel of cascade i covers 2 r / size world units; the orthographic
+	// depth spans 2 r, so the constant bias is the same for all cascades
+	b := d.shadowMap.GetBias()
+	sh.ProgramUniform1f(14, b.Constant)
+
+	var offsets [MaxCascades]float32
+	for i := 0; i < d.cascades; i++ {
+		offsets[i] = b.NormalOffset * 2 * d.radius[i] * d.shadowMap.GetTexelSize()
+	}
+	sh.ProgramUniform4f(15, offsets[0], offsets[1], offsets[2], offsets[3])
+
+	var invV vmath.Matrix4
+	vmath.M4Inverse(&invV, viewMat)
+	for i := 0; i < d.cascades; i++ {
+		var PV, shadowMat vmath.Matrix4
+		vmath.M4Mul(&PV, &d.projMat[i], &d.viewMat[i])
+		vmath.M4Mul(&shadowMat, &PV, &invV)
+
+		sh.ProgramUniformM4(20 + i, &shadowMat)
+	}
+
+	sh.Enable()
+	d.fsQuadVAO.Draw()
+	sh.Disable()
+
+	if gbuf.GetSamples() > 1 {
+		texture.UnbindUnit(4)
+	}
+	texture.UnbindUnitTarget(3, gl.TEXTURE_2D_ARRAY)
+	texture.UnbindUnitTarget(2, gbufTarget)
+	texture.UnbindUnitTarget(1, gbufTarget)
+	texture.UnbindUnitTarget(0, gbufTarget)
+}
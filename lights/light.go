@@ -1,16 +1,77 @@
 package lights
 
 import (
+	gl "github.com/chsc/gogl/gl43"
 	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/shadowmap"
 	vmath "github.com/rwesterteiger/vectormath"
 )
 
 type Light interface {
 	Delete()
 
-	NeedDepthPass() bool
-	BeginDepthPass() (projMat, viewMat *vmath.Matrix4)
-	EndDepthPass()
+	// NumDepthPasses returns how many times the scene has to be rendered
+	// into the light's shadow maps each frame, 0 for lights without shadows.
+	NumDepthPasses() int
+
+	// BeginDepthPass binds the target of depth pass pass and returns the
+	// matrices to render the scene with. camProjMat and camViewMat are the
+	// camera's, for lights fitting their shadow maps to the view.
+	BeginDepthPass(pass int, camProjMat, camViewMat *vmath.Matrix4) (projMat, viewMat *vmath.Matrix4)
+	EndDepthPass(pass int)
 
 	Render(gbuf *gbuffer.GBuffer, projMat, viewMat *vmath.Matrix4)
 }
+
+// ShadowMapView describes one shadow map image of a ShadowCaster.
+type ShadowMapView struct {
+	Texture gl.Uint
+	Target gl.Enum // gl.TEXTURE_2D, gl.TEXTURE_2D_ARRAY or gl.TEXTURE_CUBE_MAP
+	Layer int // layer of an array texture, face of a cube map
+	ProjMat *vmath.Matrix4 // projection the image was rendered with
+}
+
+// ShadowCaster is implemented by lights rendering shadow maps, so that they
+// can be inspected, e.g. by the scene's debug views, and tuned.
+type ShadowCaster interface {
+	NumShadowMaps() int
+	GetShadowMap(i int) ShadowMapView
+
+	GetShadowBias() shadowmap.Bias
+	SetShadowBias(b shadowmap.Bias)
+
+	// SetShadowFilter selects how shadows are filtered. Lights keep their
+	// current filter and log modes they do not support.
+	SetShadowFilter(f shadowmap.Filter)
+	GetShadowFilter() shadowmap.Filter
+}
+
+// AtlasShadowCaster is implemented by lights which can render their shadow
+// maps into tiles of a shared shadowmap.Atlas instead of maps of their own.
+type AtlasShadowCaster interface {
+	// UseShadowAtlas moves the light's shadow maps into a, or back into
+	// maps of its own for nil.
+	UseShadowAtlas(a *shadowmap.Atlas)
+
+	// UpdateShadowImportance sets the importance of the light's tiles for
+	// the next Atlas.Pack, judged from the camera.
+	UpdateShadowImportance(camProjMat, camViewMat *vmath.Matrix4)
+}
+
+// ShadowCache is implemented by lights which keep their shadow maps across
+// frames, so that depth passes whose result would not change are skipped.
+type ShadowCache interface {
+	// DepthPassMatrices returns the matrices BeginDepthPass would return,
+	// without binding anything.
+	DepthPassMatrices(pass int, camProjMat, camViewMat *vmath.Matrix4) (projMat, viewMat *vmath.Matrix4)
+
+	// DepthPassValid reports whether the target of pass still holds what
+	// it would render now. signature identifies everything the pass
+	// renders; if it changed, the light expects the pass to be rendered and
+	// remembers the new signature.
+	DepthPassValid(pass int, signature uint64) bool
+
+	// InvalidateShadowCache makes all depth passes render again, e.g. after
+	// changing what they render in ways the signature does not cover.
+	InvalidateShadowCache()
+}
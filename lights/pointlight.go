@@ -0,0 +1,553 @@
+package lights
+
+import (
+	"github.com/rwesterteiger/go-gltest/shadowmap"
+	"github.com/rwesterteiger/go-gltest/shader"
+	"github.com/rwesterteiger/go-gltest/buffers"
+	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/texture"
+	vmath "github.com/rwesterteiger/vectormath"
+	"log"
+	"math"
+	gl "github.com/chsc/gogl/gl43"
+)
+
+const pointLightVtxShaderSrc =`
+	#version 430
+
+	layout (location = 0) in vec3 vtx;
+	layout (location = 5) uniform mat4 PVM;
+
+	void main(void) {
+		gl_Position = PVM * vec4(vtx,1);
+	}
+	`
+
+// the G-buffer is read with texelFetch at the fragment position; texture
+// coordinates interpolated over the light volume would break where it is
+// clipped by the near plane
+const pointLightFragShaderSrc = `
+	#version 430
+
+	#define M_PI (3.14159265358979323846)
+
+	layout (location = 0) out vec4 fragData;
+
+#ifdef MSAA
+	layout (location = 0) uniform sampler2DMS albedoTex;
+	layout (location = 1) uniform sampler2DMS normalTex;
+	layout (location = 2) uniform sampler2DMS depthTex;
+	layout (location = 22) uniform int samples;
+
+	bool isEdgePixel(); // gbuffer.MultisampleShaderSource
+
+	#define FETCH(tex, s) texelFetch(tex, ivec2(gl_FragCoord.xy), s)
+#else
+	layout (location = 0) uniform sampler2D albedoTex;
+	layout (location = 1) uniform sampler2D normalTex;
+	layout (location = 2) uniform sampler2D depthTex;
+
+	#define FETCH(tex, s) texelFetch(tex, ivec2(gl_FragCoord.xy), 0)
+#endif
+	layout (location = 3) uniform samplerCubeShadow shadowMapTex;
+	layout (location = 4) uniform vec4 lightPosAndRadius; // xyz = eyespace pos, w = radius
+	layout (location = 9) uniform mat4 invP; // camera NDC -> viewspace
+	layout (location = 13) uniform mat4 invV; // camera viewspace -> world space
+	layout (location = 17) uniform vec3 color;
+	layout (location = 18) uniform vec2 invGBufferSize;
+	layout (location = 19) uniform vec2 shadowNearFar; // planes of the cube face projections
+	layout (location = 23) uniform float shadowTexelSize;
+	layout (location = 24) uniform float constantBias;
+	layout (location = 25) uniform float normalOffsetScale; // normal offset per unit of distance to the light
+	layout (location = 26) uniform int shadowFilter; // shadowmap.Filter
+	layout (location = 27) uniform samplerCube shadowDepthTex; // raw depths for the PCSS blocker search
+	layout (location = 28) uniform float lightSize; // world space width of the light
+
+	const vec2 poissonDisk[16] = vec2[](
+		vec2(-0.94201624, -0.39906216), vec2( 0.94558609, -0.76890725),
+		vec2(-0.09418410, -0.92938870), vec2( 0.34495938,  0.29387760),
+		vec2(-0.91588581,  0.45771432), vec2(-0.81544232, -0.87912464),
+		vec2(-0.38277543,  0.27676845), vec2( 0.97484398,  0.75648379),
+		vec2( 0.44323325, -0.97511554), vec2( 0.53742981, -0.47373420),
+		vec2(-0.26496911, -0.41893023), vec2( 0.79197514,  0.19090188),
+		vec2(-0.24188840,  0.99706507), vec2(-0.81409955,  0.91437590),
+		vec2( 0.19984126,  0.78641367), vec2( 0.14383161, -0.14100790));
+
+	vec3 decodeNormal(vec3 e); // gbuffer.NormalCodecShaderSource
+
+	float linearShadowDepth(float z) {
+		float near = shadowNearFar.x, far = shadowNearFar.y;
+		return 2 * near * far / (far + near - (2 * z - 1) * (far - near));
+	}
+
+	// getSoftShadowAttenuation estimates the penumbra width from the average
+	// depth of the blockers around direction v and filters with a kernel of
+	// that size. Both use a Poisson disk on the plane across v at distance z,
+	// so that offsets are in world units there, rotated per pixel to turn
+	// banding into noise.
+	float getSoftShadowAttenuation(vec3 v, float z, float depth) {
+		vec3 dir = normalize(v);
+		vec3 t = normalize(cross(dir, abs(dir.y) < 0.99 ? vec3(0, 1, 0) : vec3(1, 0, 0)));
+		vec3 b = cross(dir, t);
+
+		// interleaved gradient noise
+		float angle = 2 * M_PI * fract(52.9829189 * fract(dot(gl_FragCoord.xy, vec2(0.06711056, 0.00583715))));
+		mat2 rot = mat2(cos(angle), sin(angle), -sin(angle), cos(angle));
+
+		// blockers can only be where the light seen from the receiver
+		// intersects the near plane; with the near plane this close to the
+		// light that would reach around the whole cube, so the search stops
+		// 45 degrees off v
+		float near = shadowNearFar.x;
+		float searchRadius = min(lightSize * (z - near) / near, z);
+
+		float blockerSum = 0.0;
+		int blockers = 0;
+		for (int i = 0; i < 16; i++) {
+			vec2 o = rot * poissonDisk[i] * searchRadius;
+			float d = texture(shadowDepthTex, v + t * o.x + b * o.y).x;
+			if (d < depth) {
+				blockerSum += linearShadowDepth(d);
+				blockers++;
+			}
+		}
+
+		if (blockers == 0) {
+			return 1.0;
+		}
+
+		float blocker = blockerSum / blockers;
+		float filterRadius = max(lightSize * (z - blocker) / blocker, z * shadowTexelSize);
+
+		float d = 0.0;
+		for (int i = 0; i < 16; i++) {
+			vec2 o = rot * poissonDisk[i] * filterRadius;
+			d += texture(shadowMapTex, vec4(v + t * o.x + b * o.y, depth));
+		}
+
+		return d / 16.0;
+	}
+
+	float getShadowAttenuation(vec3 pos, vec3 n) {
+		// shadow map texels grow with the distance to the light
+		pos += n * normalOffsetScale * distance(pos, lightPosAndRadius.xyz);
+
+		// the cube map is indexed in world space
+		vec3 v = mat3(invV) * (pos - lightPosAndRadius.xyz);
+
+		// window space depth of pos in the face it falls on, whose view
+		// axis is the major axis of v
+		float z = max(abs(v.x), max(abs(v.y), abs(v.z)));
+		float near = shadowNearFar.x, far = shadowNearFar.y;
+		float depth = 0.5 * ((far + near) / (far - near) - 2 * far * near / ((far - near) * z)) + 0.5;
+		depth -= constantBias;
+
+		if (shadowFilter == 3) {
+			return getSoftShadowAttenuation(v, z, depth);
+		}
+
+		// taps at the corners of a cube one texel across
+		float r = z * shadowTexelSize;
+
+		float d = 0.0;
+		for (int i = 0; i < 8; i++) {
+			vec3 offset = vec3(i & 1, (i >> 1) & 1, (i >> 2) & 1) * 2 - 1;
+			d += texture(shadowMapTex, vec4(v + offset * r, depth));
+		}
+
+		return d / 8.0;
+	}
+
+	// shade lights G-buffer sample s
+	vec4 shade(int s)
+	{
+		vec4 diffuseMaterial = FETCH(albedoTex, s);
+		float z = FETCH(depthTex, s).x;
+		vec3 n = decodeNormal(FETCH(normalTex, s).xyz); // eyespace normal
+
+		// determine eye-space position of pixel
+		vec4 pos = invP * (2 * vec4(gl_FragCoord.xy * invGBufferSize, z, 1.0) - 1);
+		pos /= pos.w;
+
+		vec3 toLight = lightPosAndRadius.xyz - pos.xyz;
+		float dist = length(toLight);
+		vec3 L = toLight / dist;
+		float NdotL = dot(L, n);
+
+		if (NdotL < 0.0 || dist > lightPosAndRadius.w) {
+			return vec4(0);
+		}
+
+		// inverse square falloff, windowed to reach 0 at the radius
+		float window = clamp(1 - pow(dist / lightPosAndRadius.w, 4), 0, 1);
+		float attenuation = window * window / (dist * dist + 1);
+
+		vec4 diffuse = vec4(color, 1) * diffuseMaterial * NdotL;
+
+		float specStrength = max(0.0, dot(reflect(-L, n), -normalize(pos.xyz)));
+		vec4 specular = vec4(color * pow(specStrength, 16), 0);
+
+		return getShadowAttenuation(pos.xyz, n) * attenuation * (diffuse + specular);
+	}
+
+	void main(void)
+	{
+#ifdef MSAA
+		// edge pixels are lit per sample and averaged, all others once
+		if (isEdgePixel()) {
+			vec4 sum = vec4(0);
+			for (int i = 0; i < samples; i++) {
+				sum += shade(i);
+			}
+			fragData = sum / samples;
+			return;
+		}
+#endif
+		fragData = shade(0);
+	}
+`
+
+// tessellation of the light volume
+const (
+	pointLightSphereSegments = 16
+	pointLightSphereRings = 8
+)
+
+// view directions and up vectors of the cube map faces, in the order of
+// gl.TEXTURE_CUBE_MAP_POSITIVE_X and following
+var cubeFaceDirs = [6][2]vmath.Vector3{
+	{ { 1, 0, 0 }, { 0,-1, 0 } },
+	{ {-1, 0, 0 }, { 0,-1, 0 } },
+	{ { 0, 1, 0 }, { 0, 0, 1 } },
+	{ { 0,-1, 0 }, { 0, 0,-1 } },
+	{ { 0, 0, 1 }, { 0,-1, 0 } },
+	{ { 0, 0,-1 }, { 0,-1, 0 } },
+}
+
+// PointLight shines in all directions from a point, up to a radius. Its
+// shadows are rendered into a cube map, one depth pass per face.
+type PointLight struct {
+	pos vmath.Point3
+	radius float32
+	color vmath.Vector3
+
+	projMat vmath.Matrix4
+	viewMat [6]vmath.Matrix4
+
+	shadowMap *shadowmap.Cube
+	shadowQuality shadowmap.Quality
+	shadowFilter shadowmap.Filter
+	lightSize float32 // world space width of the light for shadowmap.FilterPCSS
+
+	// per face, see DepthPassValid
+	cacheValid [6]bool
+	cachedSignature [6]uint64
+
+	shader *shader.Shader
+	msaaShader *shader.Shader // built on first use with a multisampled G-buffer
+
+	sphereVAO *buffers.VAO
+}
+
+// MakePointLight creates a light at pos lighting everything closer than
+// radius.
+func MakePointLight(pos *vmath.Point3, radius float32, color *vmath.Vector3) (p *PointLight) {
+	p = new(PointLight)
+
+	vmath.P3Copy(&p.pos, pos)
+	vmath.V3Copy(&p.color, color)
+	p.radius = radius
+	p.updateMatrices()
+
+	p.lightSize = 0.2
+	p.shadowQuality = shadowmap.QualityMedium
+	p.shadowMap = shadowmap.MakeCube(p.shadowQuality.Settings())
+
+	p.shader = shader.Make()
+	p.shader.AddShaderSource(pointLightVtxShaderSrc, gl.VERTEX_SHADER)
+	p.shader.AddShaderSource(pointLightFragShaderSrc, gl.FRAGMENT_SHADER)
+	p.shader.AddShaderSource(gbuffer.NormalCodecShaderSource, gl.FRAGMENT_SHADER)
+	p.shader.Link()
+
+	p.makeSphereVAO()
+
+	return
+}
+
+// makeSphereVAO makes a unit UV sphere, wound counter-clockwise seen from
+// outside.
+func (p *PointLight) makeSphereVAO() {
+	var vtxs []vmath.Vector3
+	for ring := 0; ring <= pointLightSphereRings; ring++ {
+		theta := float64(ring) * math.Pi / pointLightSphereRings
+		for seg := 0; seg < pointLightSphereSegments; seg++ {
+			phi := float64(seg) * 2 * math.Pi / pointLightSphereSegments
+			vtxs = append(vtxs, vmath.Vector3{
+				float32(math.Sin(theta) * math.Cos(phi)),
+				float32(math.Cos(theta)),
+				float32(-math.Sin(theta) * math.Sin(phi)),
+			})
+		}
+	}
+
+	var indices []uint32
+	for ring := 0; ring < pointLightSphereRings; ring++ {
+		for seg := 0; seg < pointLightSphereSegments; seg++ {
+			a := uint32(ring * pointLightSphereSegments + seg)
+			b := uint32(ring * pointLightSphereSegments + (seg + 1) % pointLightSphereSegments)
+			c := a + pointLightSphereSegments
+			d := b + pointLightSphereSegments
+
+			indices = append(indices, a, c, d, d, b, a)
+		}
+	}
+
+	p.sphereVAO = buffers.MakeVAO(gl.TRIANGLES, len(indices))
+	p.sphereVAO.AttachVBO(0, buffers.MakeVBOFromVec3s(vtxs))
+	p.sphereVAO.SetIndexBuffer(indices)
+}
+
+// updateMatrices updates the cube face matrices after the position or
+// radius changed.
+func (p *PointLight) updateMatrices() {
+	// the near plane follows the radius to keep depth precision
+	vmath.M4MakePerspective(&p.projMat, math.Pi / 2, 1.0, p.radius / 100, p.radius)
+
+	for i, f := range cubeFaceDirs {
+		var lookAt vmath.Point3
+		vmath.P3AddV3(&lookAt, &p.pos, &f[0])
+		vmath.M4MakeLookAt(&p.viewMat[i], &p.pos, &lookAt, &f[1])
+	}
+}
+
+func (p *PointLight) Delete() {
+	p.shadowMap.Delete()
+	p.shader.Delete()
+	if p.msaaShader != nil {
+		p.msaaShader.Delete()
+	}
+	p.sphereVAO.Delete()
+}
+
+func (p *PointLight) SetPosition(pos *vmath.Point3) {
+	vmath.P3Copy(&p.pos, pos)
+	p.updateMatrices()
+}
+
+func (p *PointLight) GetPosition() *vmath.Point3 {
+	return &p.pos
+}
+
+func (p *PointLight) SetRadius(radius float32) {
+	p.radius = radius
+	p.updateMatrices()
+}
+
+func (p *PointLight) GetRadius() float32 {
+	return p.radius
+}
+
+func (_ *PointLight) NumDepthPasses() int {
+	return 6
+}
+
+// BeginDepthPass renders cube map face pass.
+func (p *PointLight) BeginDepthPass(pass int, camProjMat, camViewMat *vmath.Matrix4) (projMat, viewMat *vmath.Matrix4) {
+	p.shadowMap.BeginDepthPass(pass)
+	return &p.projMat, &p.viewMat[pass]
+}
+
+func (p *PointLight) EndDepthPass(pass int) {
+	p.shadowMap.EndDepthPass()
+}
+
+// SetShadowQuality replaces the shadow map by one of the size and format
+// of q.
+func (p *PointLight) SetShadowQuality(q shadowmap.Quality) {
+	p.shadowQuality = q
+
+	size, format := q.Settings()
+	if size == p.shadowMap.GetSize() && format == p.shadowMap.GetFormat() {
+		return
+	}
+
+	b := p.shadowMap.GetBias()
+	p.shadowMap.Delete()
+	p.shadowMap = shadowmap.MakeCube(size, format)
+	p.shadowMap.SetBias(b)
+	p.InvalidateShadowCache()
+}
+
+func (p *PointLight) GetShadowQuality() shadowmap.Quality {
+	return p.shadowQuality
+}
+
+func (p *PointLight) GetShadowBias() shadowmap.Bias {
+	return p.shadowMap.GetBias()
+}
+
+func (p *PointLight) SetShadowBias(b shadowmap.Bias) {
+	p.shadowMap.SetBias(b)
+	p.InvalidateShadowCache()
+}
+
+func (p *PointLight) DepthPassMatrices(pass int, camProjMat, camViewMat *vmath.Matrix4) (projMat, viewMat *vmath.Matrix4) {
+	return &p.projMat, &p.viewMat[pass]
+}
+
+func (p *PointLight) DepthPassValid(pass int, signature uint64) bool {
+	if p.cacheValid[pass] && signature == p.cachedSignature[pass] {
+		return true
+	}
+
+	p.cacheValid[pass], p.cachedSignature[pass] = true, signature
+	return false
+}
+
+func (p *PointLight) InvalidateShadowCache() {
+	p.cacheValid = [6]bool{}
+}
+
+// SetShadowFilter supports shadowmap.FilterPCF and shadowmap.FilterPCSS,
+// whose penumbrae follow SetLightSize. The cube map has no moments for VSM
+// and ESM to filter.
+func (p *PointLight) SetShadowFilter(f shadowmap.Filter) {
+	if f != shadowmap.FilterPCF && f != shadowmap.FilterPCSS {
+		log.Printf("Shadow filter %v not supported by point lights", f)
+		return
+	}
+
+	p.shadowFilter = f
+}
+
+func (p *PointLight) GetShadowFilter() shadowmap.Filter {
+	return p.shadowFilter
+}
+
+// SetLightSize sets the width of the light in world units, which the soft
+// shadows of shadowmap.FilterPCSS grow with.
+func (p *PointLight) SetLightSize(size float32) {
+	p.lightSize = size
+}
+
+func (p *PointLight) GetLightSize() float32 {
+	return p.lightSize
+}
+
+func (_ *PointLight) NumShadowMaps() int {
+	return 6
+}
+
+func (p *PointLight) GetShadowMap(i int) ShadowMapView {
+	return ShadowMapView{ Texture : p.shadowMap.GetDepthTex(), Target : gl.TEXTURE_CUBE_MAP, Layer : i, ProjMat : &p.projMat }
+}
+
+// shaderFor returns the light shader variant matching the sample count of
+// gbuf.
+func (p *PointLight) shaderFor(gbuf *gbuffer.GBuffer) *shader.Shader {
+	if gbuf.GetSamples() <= 1 {
+		return p.shader
+	}
+
+	if p.msaaShader == nil {
+		p.msaaShader = shader.Make()
+		p.msaaShader.AddShaderSource(pointLightVtxShaderSrc, gl.VERTEX_SHADER)
+		p.msaaShader.AddShaderSourceWithDefines(pointLightFragShaderSrc, gl.FRAGMENT_SHADER, "MSAA")
+		p.msaaShader.AddShaderSource(gbuffer.NormalCodecShaderSource, gl.FRAGMENT_SHADER)
+		p.msaaShader.AddShaderSource(gbuffer.MultisampleShaderSource, gl.FRAGMENT_SHADER)
+		p.msaaShader.Link()
+	}
+
+	return p.msaaShader
+}
+
+func (p *PointLight) Render(gbuf *gbuffer.GBuffer, projMat, viewMat *vmath.Matrix4) {
+	sh := p.shaderFor(gbuf)
+
+	var invP, invV vmath.Matrix4
+	vmath.M4Inverse(&invP, projMat)
+	vmath.M4Inverse(&invV, viewMat)
+	sh.ProgramUniformM4(9, &invP)
+	sh.ProgramUniformM4(13, &invV)
+
+	w, h := gbuf.GetSize()
+	sh.ProgramUniform2f(18, 1.0 / float32(w), 1.0 / float32(h))
+
+	// with MSAA the samples are read directly, see gbuffer.Resolve
+	gbufTarget := gl.Enum(gl.TEXTURE_2D)
+	if gbuf.GetSamples() > 1 {
+		gbufTarget = gl.TEXTURE_2D_MULTISAMPLE
+		gbuf.SetMultisampleUniforms(sh, 4)
+		sh.ProgramUniform1i(22, gbuf.GetSamples())
+	}
+
+	texture.BindUnitTarget(0, gbufTarget, gbuf.GetMultisampleTexture(gbuffer.ChannelAlbedo), texture.GetSampler(texture.NearestClamp))
+	sh.ProgramUniform1i(0, 0)
+
+	texture.BindUnitTarget(1, gbufTarget, gbuf.GetMultisampleTexture(gbuffer.ChannelNormal), texture.GetSampler(texture.NearestClamp))
+	sh.ProgramUniform1i(1, 1)
+	gbuf.SetNormalCodecUniforms(sh)
+
+	texture.BindUnitTarget(2, gbufTarget, gbuf.GetMultisampleDepthTex(), texture.GetSampler(texture.NearestClamp))
+	sh.ProgramUniform1i(2, 2)
+
+	texture.BindUnitTarget(3, gl.TEXTURE_CUBE_MAP, p.shadowMap.GetDepthTex(), texture.GetSampler(texture.ShadowCompare))
+	sh.ProgramUniform1i(3, 3)
+	sh.ProgramUniform1f(23, p.shadowMap.GetTexelSize())
+	sh.ProgramUniform2f(19, p.radius / 100, p.radius)
+
+	// a texel covers 2 / size world units per unit of distance, the faces
+	// having a 90 degree field of view
+	b := p.shadowMap.GetBias()
+	sh.ProgramUniform1f(24, b.Constant)
+	sh.ProgramUniform1f(25, b.NormalOffset * 2 * p.shadowMap.GetTexelSize())
+
+	// the blocker search reads the depths without compare
+	sh.ProgramUniform1i(26, int(p.shadowFilter))
+	if p.shadowFilter == shadowmap.FilterPCSS {
+		texture.BindUnitTarget(5, gl.TEXTURE_CUBE_MAP, p.shadowMap.GetDepthTex(), texture.GetSampler(texture.NearestClamp))
+	}
+	sh.ProgramUniform1i(27, 5)
+	sh.ProgramUniform1f(28, p.lightSize)
+
+	var eyeSpacePos vmath.Vector4
+	vmath.V4MakeFromP3(&eyeSpacePos, &p.pos)
+	vmath.M4MulV4(&eyeSpacePos, viewMat, &eyeSpacePos)
+
+	sh.ProgramUniform4f(4, eyeSpacePos.X, eyeSpacePos.Y, eyeSpacePos.Z, p.radius)
+	sh.ProgramUniform3f(17, p.color.X, p.color.Y, p.color.Z)
+
+	// scale the sphere so that its flat faces still enclose the radius
+	s := p.radius / float32(math.Cos(math.Pi / pointLightSphereSegments) * math.Cos(math.Pi / (2 * pointLightSphereRings)))
+
+	var T, S, M, PV, PVM vmath.Matrix4
+	vmath.M4MakeTranslation(&T, &vmath.Vector3{ p.pos.X, p.pos.Y, p.pos.Z })
+	vmath.M4MakeScale(&S, &vmath.Vector3{ s, s, s })
+	vmath.M4Mul(&M, &T, &S)
+	vmath.M4Mul(&PV, projMat, viewMat)
+	vmath.M4Mul(&PVM, &PV, &M)
+
+	sh.ProgramUniformM4(5, &PVM)
+
+	// only the back faces are drawn: each pixel is lit once, also with the
+	// camera inside the volume
+	gl.Enable(gl.CULL_FACE)
+	gl.CullFace(gl.FRONT)
+
+	sh.Enable()
+	p.sphereVAO.Draw()
+	sh.Disable()
+
+	gl.CullFace(gl.BACK)
+
+	if p.shadowFilter == shadowmap.FilterPCSS {
+		texture.UnbindUnitTarget(5, gl.TEXTURE_CUBE_MAP)
+	}
+	if gbuf.GetSamples() > 1 {
+		texture.UnbindUnit(4)
+	}
+	texture.UnbindUnitTarget(3, gl.TEXTURE_CUBE_MAP)
+	texture.UnbindUnitTarget(2, gbufTarget)
+	texture.UnbindUnitTarget(1, gbufTarget)
+	texture.UnbindUnitTarget(0, gbufTarget)
+}
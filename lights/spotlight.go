@@ -5,6 +5,7 @@ import (
 	"github.com/rwesterteiger/go-gltest/shader"
 	"github.com/rwesterteiger/go-gltest/buffers"
 	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/texture"
 	vmath "github.com/rwesterteiger/vectormath"
 	"math"
 	gl "github.com/chsc/gogl/gl43"
@@ -66,9 +67,22 @@ const spotLightFragShaderSrc = `
 	layout (location = 0) out vec4 fragData;
 	layout (location = 1) noperspective in vec2 tcNormalized;
 
+#ifdef MSAA
+	layout (location = 0) uniform sampler2DMS albedoTex;
+	layout (location = 1) uniform sampler2DMS normalTex;
+	layout (location = 2) uniform sampler2DMS depthTex;
+	layout (location = 22) uniform int samples;
+
+	bool isEdgePixel(); // gbuffer.MultisampleShaderSource
+
+	#define FETCH(tex, s) texelFetch(tex, ivec2(gl_FragCoord.xy), s)
+#else
 	layout (location = 0) uniform sampler2D albedoTex;
 	layout (location = 1) uniform sampler2D normalTex;
 	layout (location = 2) uniform sampler2D depthTex;
+
+	#define FETCH(tex, s) texture2D(tex, tcNormalized)
+#endif
 	layout (location = 3) uniform sampler2DShadow shadowMapTex;
 	layout (location = 4) uniform vec4 lightPosAndAngle; // xyz = eyespace pos, w = opening angle
 	layout (location = 9) uniform mat4 invP; // camera NDC -> viewspace
@@ -76,28 +90,130 @@ const spotLightFragShaderSrc = `
 	layout (location = 17) uniform vec3 color;
 	layout (location = 18) uniform mat4 V;
 	layout (location = 19) uniform vec3 lightDir;
+	layout (location = 23) uniform float shadowTexelSize;
+	layout (location = 24) uniform float constantBias;
+	layout (location = 25) uniform float normalOffsetScale; // normal offset per unit of distance to the light
+	layout (location = 26) uniform int shadowFilter; // shadowmap.Filter
+	layout (location = 27) uniform sampler2D shadowDepthTex; // raw depths for the PCSS blocker search
+	layout (location = 28) uniform float lightSizeUV; // light size over the shadow map width at unit distance
+	layout (location = 29) uniform vec2 shadowNearFar;
+	layout (location = 30) uniform vec3 shadowUVTransform; // xy = offset, z = scale of the map in the texture, see shadowmap.Target
+
+	const vec2 poissonDisk[16] = vec2[](
+		vec2(-0.94201624, -0.39906216), vec2( 0.94558609, -0.76890725),
+		vec2(-0.09418410, -0.92938870), vec2( 0.34495938,  0.29387760),
+		vec2(-0.91588581,  0.45771432), vec2(-0.81544232, -0.87912464),
+		vec2(-0.38277543,  0.27676845), vec2( 0.97484398,  0.75648379),
+		vec2( 0.44323325, -0.97511554), vec2( 0.53742981, -0.47373420),
+		vec2(-0.26496911, -0.41893023), vec2( 0.79197514,  0.19090188),
+		vec2(-0.24188840,  0.99706507), vec2(-0.81409955,  0.91437590),
+		vec2( 0.19984126,  0.78641367), vec2( 0.14383161, -0.14100790));
 
 	const mat4 bias = mat4(0.5, 0.0, 0.0, 0.0,
 		               0.0, 0.5, 0.0, 0.0,
 			       0.0, 0.0, 0.5, 0.0,
         	               0.5, 0.5, 0.5, 1.0); 
 
-	float getShadowAttenuation(vec3 pos) {
+	vec3 decodeNormal(vec3 e); // gbuffer.NormalCodecShaderSource
+	float momentShadow(vec2 tc, float eyeDepth); // shadowmap.MomentsShaderSource
+
+	// clampToTile keeps filter taps inside the shadow map, which may be a
+	// tile of an atlas
+	vec2 clampToTile(vec2 uv) {
+		vec2 lo = shadowUVTransform.xy + 0.5 * shadowTexelSize;
+		vec2 hi = shadowUVTransform.xy + shadowUVTransform.z - 0.5 * shadowTexelSize;
+		return clamp(uv, lo, hi);
+	}
+
+	// shadowTap is a depth compare at a texel offset from the projective
+	// shadow map coordinate c, kept inside the tile
+	float shadowTap(vec4 c, vec2 offset) {
+		vec2 uv = clampToTile(c.xy / c.w + offset * shadowTexelSize);
+		return texture(shadowMapTex, vec3(uv, c.z / c.w));
+	}
+
+	float linearShadowDepth(float z) {
+		float near = shadowNearFar.x, far = shadowNearFar.y;
+		return 2 * near * far / (far + near - (2 * z - 1) * (far - near));
+	}
+
+	// getSoftShadowAttenuation estimates the penumbra width from the average
+	// depth of the blockers around c and filters with a kernel of that size.
+	// Both use a Poisson disk, rotated per pixel to turn banding into noise.
+	float getSoftShadowAttenuation(vec4 c) {
+		vec2 uv = c.xy / c.w;
+		float z = c.z / c.w - constantBias;
+		float receiver = c.w;
+		float near = shadowNearFar.x;
+
+		// interleaved gradient noise
+		float angle = 2 * M_PI * fract(52.9829189 * fract(dot(gl_FragCoord.xy, vec2(0.06711056, 0.00583715))));
+		mat2 rot = mat2(cos(angle), sin(angle), -sin(angle), cos(angle));
+
+		// blockers can only be where the light seen from the receiver
+		// intersects the near plane
+		float searchRadius = lightSizeUV * (receiver - near) / (receiver * near);
+
+		float blockerSum = 0.0;
+		int blockers = 0;
+		for (int i = 0; i < 16; i++) {
+			float d = texture(shadowDepthTex, clampToTile(uv + rot * poissonDisk[i] * searchRadius)).x;
+			if (d < z) {
+				blockerSum += linearShadowDepth(d);
+				blockers++;
+			}
+		}
+
+		if (blockers == 0) {
+			return 1.0;
+		}
+
+		float blocker = blockerSum / blockers;
+		float filterRadius = max(lightSizeUV * (receiver - blocker) / (blocker * receiver), shadowTexelSize);
+
+		float d = 0.0;
+		for (int i = 0; i < 16; i++) {
+			d += texture(shadowMapTex, vec3(clampToTile(uv + rot * poissonDisk[i] * filterRadius), z));
+		}
+
+		return d / 16.0;
+	}
+
+	float getShadowAttenuation(vec3 pos, vec3 n) {
+		// no shadow map, e.g. no space left in the atlas
+		if (shadowFilter < 0) {
+			return 1.0;
+		}
+
+		// shadow map texels grow with the distance to the light
+		pos += n * normalOffsetScale * distance(pos, lightPosAndAngle.xyz);
+
 		vec4 vShadowCoord = bias * shadowPV * vec4(pos, 1);
-		vShadowCoord.z -= 0.02;
+		vShadowCoord.xy = vShadowCoord.xy * shadowUVTransform.z + shadowUVTransform.xy * vShadowCoord.w;
+
+		// w is the eye space depth in the light's perspective projection
+		if (shadowFilter == 1 || shadowFilter == 2) {
+			return momentShadow(vShadowCoord.xy / vShadowCoord.w, vShadowCoord.w);
+		}
+
+		if (shadowFilter == 3) {
+			return getSoftShadowAttenuation(vShadowCoord);
+		}
+
+		vShadowCoord.z -= constantBias * vShadowCoord.w;
 
 		float d = 0.0;
 
-		d += textureProjOffset(shadowMapTex, vShadowCoord, ivec2(-1,-1)).x;
-		d += textureProjOffset(shadowMapTex, vShadowCoord, ivec2( 0,-1)).x;
-		d += textureProjOffset(shadowMapTex, vShadowCoord, ivec2( 1,-1)).x;
+		d += shadowTap(vShadowCoord, vec2(-1,-1));
+		d += shadowTap(vShadowCoord, vec2( 0,-1));
+		d += shadowTap(vShadowCoord, vec2( 1,-1));
 
-		d += textureProjOffset(shadowMapTex, vShadowCoord, ivec2(-1, 0)).x;
-		d += textureProjOffset(shadowMapTex, vShadowCoord, ivec2( 1, 0)).x;
+		d += shadowTap(vShadowCoord, vec2(-1, 0));
+		d += shadowTap(vShadowCoord, vec2( 1, 0));
 
-		d += textureProjOffset(shadowMapTex, vShadowCoord, ivec2(-1, 1)).x;
-		d += textureProjOffset(shadowMapTex, vShadowCoord, ivec2( 0, 1)).x;
-		d += textureProjOffset(shadowMapTex, vShadowCoord, ivec2( 1, 1)).x;
+		d += shadowTap(vShadowCoord, vec2(-1, 1));
+		d += shadowTap(vShadowCoord, vec2( 0, 1));
+		d += shadowTap(vShadowCoord, vec2( 1, 1));
 
 		d /= 8.0;
 
@@ -105,11 +221,12 @@ const spotLightFragShaderSrc = `
 
 	}
 
-	void main(void)
+	// shade lights G-buffer sample s
+	vec4 shade(int s)
 	{
-		vec4 diffuseMaterial = texture2D(albedoTex, tcNormalized);
-		float z = texture2D(depthTex, tcNormalized).x;
-		vec3 n = texture2D(normalTex, tcNormalized).xyz; // eyespace normal
+		vec4 diffuseMaterial = FETCH(albedoTex, s);
+		float z = FETCH(depthTex, s).x;
+		vec3 n = decodeNormal(FETCH(normalTex, s).xyz); // eyespace normal
 
 		// determine eye-space position of pixel
     		vec4 vProjectedPos = 2 * vec4(tcNormalized, z, 1.0) - 1;
@@ -120,7 +237,7 @@ const spotLightFragShaderSrc = `
 		float NdotL = -dot(L, n);
 
 		if (NdotL < 0.0) {
-			discard;
+			return vec4(0);
 		}
 
 		float angle = acos(dot(lightDir, L));
@@ -130,11 +247,33 @@ const spotLightFragShaderSrc = `
 
 		float specStrength = max(0.0, dot(reflect(-lightDir, n), normalize(pos.xyz)));
 		vec4 specular = vec4(1 * pow(specStrength, 16));
-		fragData = getShadowAttenuation(pos.xyz) * attenuation * (diffuse + specular);
+		return getShadowAttenuation(pos.xyz, n) * attenuation * (diffuse + specular);
+	}
+
+	void main(void)
+	{
+#ifdef MSAA
+		// edge pixels are lit per sample and averaged, all others once
+		if (isEdgePixel()) {
+			vec4 sum = vec4(0);
+			for (int i = 0; i < samples; i++) {
+				sum += shade(i);
+			}
+			fragData = sum / samples;
+			return;
+		}
+#endif
+		fragData = shade(0);
 	}
 `
 
 
+// planes of the shadow map projection
+const (
+	spotLightNear = 1.0
+	spotLightFar = 100.0
+)
+
 type SpotLight struct {
 	pos vmath.Point3
 	projMat vmath.Matrix4
@@ -142,8 +281,25 @@ type SpotLight struct {
 	pvMat vmath.Matrix4
 	alpha float32
 
-	shadowMap *shadowmap.ShadowMap
+	shadowMap *shadowmap.ShadowMap // nil while the shadows go to atlasTile
+	shadowQuality shadowmap.Quality
+	shadowSize int // of shadowMap
+	shadowFormat gl.Enum
+	shadowBias shadowmap.Bias
+	shadowAtlas *shadowmap.Atlas // nil without atlas
+	atlasTile *shadowmap.AtlasTile // nil without atlas and while the light has a map of its own
+	shadowPriority float32
+
+	// signature of the objects in the shadow map, see DepthPassValid
+	cacheValid bool
+	cachedSignature uint64
+	cachedTileRevision uint64
+
+	shadowFilter shadowmap.Filter
+	moments *shadowmap.Moments // only with shadowmap.FilterVSM and shadowmap.FilterESM
+	lightSize float32 // world space width of the light for shadowmap.FilterPCSS
 	shader *shader.Shader
+	msaaShader *shader.Shader // built on first use with a multisampled G-buffer
 	dbgShader *shader.Shader
 
 	fsQuadVAO *buffers.VAO
@@ -164,20 +320,27 @@ func MakeSpotLight(pos, lookAt *vmath.Point3, up *vmath.Vector3, sceneBoundingSp
 	vmath.P3Sub(&diff, lookAt, pos)
 	s.alpha = float32(math.Asin(float64(sceneBoundingSphereRadius / diff.Length()))) // spotlight opening angle
 
-	vmath.M4MakePerspective(&s.projMat, 2*s.alpha, 1.0, 1.0, 100.0)
+	vmath.M4MakePerspective(&s.projMat, 2*s.alpha, 1.0, spotLightNear, spotLightFar)
 	vmath.M4MakeLookAt(&s.viewMat, pos, lookAt, up)
 	vmath.M4Mul(&s.pvMat, &s.projMat, &s.viewMat)
 
 	vmath.P3Sub(&s.dir, lookAt, pos)
 	vmath.V3Normalize(&s.dir, &s.dir)
 
-	s.shadowMap = shadowmap.Make()
+	s.shadowQuality = shadowmap.QualityMedium
+	s.shadowSize, s.shadowFormat = s.shadowQuality.Settings()
+	s.shadowBias = shadowmap.DefaultBias
+	s.shadowPriority = 1
+	s.updateShadowTargets()
+	s.lightSize = 0.2
 
 
 	// make shader to render light contribution into light accumulation buffer
 	s.shader = shader.Make()
 	s.shader.AddShaderSource(spotLightVtxShaderSrc, gl.VERTEX_SHADER)
 	s.shader.AddShaderSource(spotLightFragShaderSrc, gl.FRAGMENT_SHADER)
+	s.shader.AddShaderSource(gbuffer.NormalCodecShaderSource, gl.FRAGMENT_SHADER)
+	s.shader.AddShaderSource(shadowmap.MomentsShaderSource, gl.FRAGMENT_SHADER)
 	s.shader.Link()
 
 	s.dbgShader = shader.Make()
@@ -250,55 +413,346 @@ func (s* SpotLight) makeConeVAO() {
 }
 
 func (s *SpotLight) Delete() {
-	s.shadowMap.Delete()
+	if s.shadowMap != nil {
+		s.shadowMap.Delete()
+	}
+	if s.atlasTile != nil {
+		s.atlasTile.Release()
+	}
+	if s.moments != nil {
+		s.moments.Delete()
+	}
 	s.shader.Delete()
+	if s.msaaShader != nil {
+		s.msaaShader.Delete()
+	}
+	s.dbgShader.Delete()
 	s.fsQuadVAO.Delete()
+	s.coneVAO.Delete()
+}
+
+func (s *SpotLight) NumDepthPasses() int {
+	if s.shadowTarget() == nil {
+		return 0
+	}
+	return 1
+}
+
+func (s *SpotLight) BeginDepthPass(pass int, camProjMat, camViewMat *vmath.Matrix4) (projMat, viewMat *vmath.Matrix4) {
+	t := s.shadowTarget()
+	t.SetBias(s.shadowBias)
+	t.BeginDepthPass()
+	return &s.projMat, &s.viewMat
+}
+
+func (s *SpotLight) EndDepthPass(pass int) {
+	s.shadowTarget().EndDepthPass()
+
+	if s.moments != nil {
+		s.moments.Update(s.shadowMap.GetDepthTex(), spotLightNear, spotLightFar)
+	}
+}
+
+// SetShadowFilter selects how shadows are filtered. VSM and ESM keep
+// blurred moments of the shadow map next to it, see GetShadowMoments; the
+// penumbrae of PCSS follow SetLightSize.
+func (s *SpotLight) SetShadowFilter(f shadowmap.Filter) {
+	if f == s.shadowFilter {
+		return
+	}
+
+	if s.moments != nil {
+		s.moments.Delete()
+		s.moments = nil
+	}
+
+	s.shadowFilter = f
+	s.updateShadowTargets()
+
+	if f == shadowmap.FilterVSM || f == shadowmap.FilterESM {
+		s.moments = shadowmap.MakeMoments(s.shadowSize, f)
+	}
+}
+
+func (s *SpotLight) GetShadowFilter() shadowmap.Filter {
+	return s.shadowFilter
+}
+
+// SetLightSize sets the width of the light in world units, which the soft
+// shadows of shadowmap.FilterPCSS grow with.
+func (s *SpotLight) SetLightSize(size float32) {
+	s.lightSize = size
+}
+
+func (s *SpotLight) GetLightSize() float32 {
+	return s.lightSize
+}
+
+// GetShadowMoments returns the moments of VSM and ESM filtering, for tuning
+// their parameters, or nil. Parameter changes need InvalidateShadowCache to
+// show while the shadow map is cached.
+func (s *SpotLight) GetShadowMoments() *shadowmap.Moments {
+	return s.moments
+}
+
+// SetShadowQuality replaces the shadow map by one of the size and format
+// of q.
+func (s *SpotLight) SetShadowQuality(q shadowmap.Quality) {
+	s.shadowQuality = q
+	s.SetShadowMapFormat(q.Settings())
+}
+
+func (s *SpotLight) GetShadowQuality() shadowmap.Quality {
+	return s.shadowQuality
 }
 
-func (_ *SpotLight) NeedDepthPass() bool {
-	return true
+// SetShadowMapFormat replaces the shadow map by a size x size one with the
+// given depth format, overriding the quality setting. Atlas tiles are sized
+// by the atlas instead.
+func (s *SpotLight) SetShadowMapFormat(size int, format gl.Enum) {
+	if size == s.shadowSize && format == s.shadowFormat {
+		return
+	}
+
+	s.shadowSize, s.shadowFormat = size, format
+	if s.shadowMap != nil {
+		s.shadowMap.Delete()
+		s.shadowMap = nil
+	}
+	s.updateShadowTargets()
+
+	if s.moments != nil {
+		old := s.moments
+		s.moments = shadowmap.MakeMoments(size, old.GetFilter())
+		s.moments.SetExponent(old.GetExponent())
+		s.moments.SetLightBleedReduction(old.GetLightBleedReduction())
+		s.moments.SetBlurPasses(old.GetBlurPasses())
+		old.Delete()
+	}
+}
+
+func (s *SpotLight) GetShadowBias() shadowmap.Bias {
+	return s.shadowBias
+}
+
+func (s *SpotLight) SetShadowBias(b shadowmap.Bias) {
+	s.shadowBias = b
+	s.InvalidateShadowCache()
+}
+
+// updateShadowTargets switches between the light's own shadow map and an
+// atlas tile after the atlas or filter changed: it has a map of its own
+// without atlas and for VSM and ESM, whose moments are computed from a whole
+// map, and gives its tile back to the atlas meanwhile.
+func (s *SpotLight) updateShadowTargets() {
+	own := s.shadowAtlas == nil || s.shadowFilter == shadowmap.FilterVSM || s.shadowFilter == shadowmap.FilterESM
+
+	if own {
+		if s.shadowMap == nil {
+			s.shadowMap = shadowmap.Make(s.shadowSize, s.shadowFormat)
+		}
+		if s.atlasTile != nil {
+			s.atlasTile.Release()
+			s.atlasTile = nil
+		}
+	} else {
+		if s.shadowMap != nil {
+			s.shadowMap.Delete()
+			s.shadowMap = nil
+		}
+		if s.atlasTile == nil {
+			s.atlasTile = s.shadowAtlas.NewTile()
+		}
+	}
+
+	s.InvalidateShadowCache()
+}
+
+// shadowTarget returns the shadow map the light renders into, nil if its
+// atlas tile got no space.
+func (s *SpotLight) shadowTarget() shadowmap.Target {
+	if s.shadowMap != nil {
+		return s.shadowMap
+	}
+	if s.atlasTile != nil && s.atlasTile.IsAllocated() {
+		return s.atlasTile
+	}
+	return nil
+}
+
+func (s *SpotLight) UseShadowAtlas(a *shadowmap.Atlas) {
+	if s.atlasTile != nil {
+		s.atlasTile.Release()
+		s.atlasTile = nil
+	}
+
+	s.shadowAtlas = a
+	s.updateShadowTargets()
+}
+
+// lights closer to the camera get the largest atlas tiles, farther ones
+// tiles shrinking with the distance
+const spotLightFullImportanceDistance = 5.0
+
+func (s *SpotLight) UpdateShadowImportance(camProjMat, camViewMat *vmath.Matrix4) {
+	if s.atlasTile == nil {
+		return
+	}
+
+	var eyeSpacePos vmath.Vector4
+	vmath.M4MulP3(&eyeSpacePos, camViewMat, &s.pos)
+	d := (&vmath.Vector3{ eyeSpacePos.X, eyeSpacePos.Y, eyeSpacePos.Z }).Length()
+
+	importance := s.shadowPriority
+	if d > spotLightFullImportanceDistance {
+		importance *= spotLightFullImportanceDistance / d
+	}
+
+	s.atlasTile.SetImportance(importance)
+}
+
+// SetShadowPriority scales the importance of the light's atlas tile; 1 is
+// the default, 0 gets the smallest tile.
+func (s *SpotLight) SetShadowPriority(p float32) {
+	s.shadowPriority = p
 }
 
-func (s *SpotLight) BeginDepthPass() (projMat, viewMat *vmath.Matrix4) {
-	s.shadowMap.BeginDepthPass()
+func (s *SpotLight) GetShadowPriority() float32 {
+	return s.shadowPriority
+}
+
+func (s *SpotLight) DepthPassMatrices(pass int, camProjMat, camViewMat *vmath.Matrix4) (projMat, viewMat *vmath.Matrix4) {
 	return &s.projMat, &s.viewMat
 }
 
-func (s *SpotLight) EndDepthPass() {
-	s.shadowMap.EndDepthPass()
+func (s *SpotLight) DepthPassValid(pass int, signature uint64) bool {
+	// a moved tile has lost its contents
+	var tileRevision uint64
+	if s.shadowMap == nil && s.atlasTile != nil {
+		tileRevision = s.atlasTile.GetRevision()
+	}
+
+	if s.cacheValid && signature == s.cachedSignature && tileRevision == s.cachedTileRevision {
+		return true
+	}
+
+	s.cacheValid, s.cachedSignature, s.cachedTileRevision = true, signature, tileRevision
+	return false
+}
+
+func (s *SpotLight) InvalidateShadowCache() {
+	s.cacheValid = false
+}
+
+// shaderFor returns the light shader variant matching the sample count of
+// gbuf.
+func (s *SpotLight) shaderFor(gbuf *gbuffer.GBuffer) *shader.Shader {
+	if gbuf.GetSamples() <= 1 {
+		return s.shader
+	}
+
+	if s.msaaShader == nil {
+		s.msaaShader = shader.Make()
+		s.msaaShader.AddShaderSource(spotLightVtxShaderSrc, gl.VERTEX_SHADER)
+		s.msaaShader.AddShaderSourceWithDefines(spotLightFragShaderSrc, gl.FRAGMENT_SHADER, "MSAA")
+		s.msaaShader.AddShaderSource(gbuffer.NormalCodecShaderSource, gl.FRAGMENT_SHADER)
+		s.msaaShader.AddShaderSource(gbuffer.MultisampleShaderSource, gl.FRAGMENT_SHADER)
+		s.msaaShader.AddShaderSource(shadowmap.MomentsShaderSource, gl.FRAGMENT_SHADER)
+		s.msaaShader.Link()
+	}
+
+	return s.msaaShader
+}
+
+func (_ *SpotLight) NumShadowMaps() int {
+	return 1
+}
+
+// GetShadowMap returns the light's own shadow map or the whole atlas its tile
+// is part of.
+func (s *SpotLight) GetShadowMap(i int) ShadowMapView {
+	t := s.shadowTarget()
+	if t == nil {
+		return ShadowMapView{ Target : gl.TEXTURE_2D, ProjMat : &s.projMat }
+	}
+	return ShadowMapView{ Texture : t.GetDepthTex(), Target : gl.TEXTURE_2D, ProjMat : &s.projMat }
 }
 
 func (s *SpotLight) Render(gbuf *gbuffer.GBuffer, projMat, viewMat *vmath.Matrix4) {
+	sh := s.shaderFor(gbuf)
+
 	var invP vmath.Matrix4
 	vmath.M4Inverse(&invP, projMat)
-	s.shader.ProgramUniformM4(9, &invP)
-
-	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, gbuf.GetAlbedoTex())
-	s.shader.ProgramUniform1i(0, 0)
+	sh.ProgramUniformM4(9, &invP)
+
+	// with MSAA the samples are read directly, see gbuffer.Resolve
+	gbufTarget := gl.Enum(gl.TEXTURE_2D)
+	if gbuf.GetSamples() > 1 {
+		gbufTarget = gl.TEXTURE_2D_MULTISAMPLE
+		gbuf.SetMultisampleUniforms(sh, 4)
+		sh.ProgramUniform1i(22, gbuf.GetSamples())
+	}
 
-	gl.ActiveTexture(gl.TEXTURE1)
-	gl.BindTexture(gl.TEXTURE_2D, gbuf.GetNormalTex())
-	s.shader.ProgramUniform1i(1, 1)
+	texture.BindUnitTarget(0, gbufTarget, gbuf.GetMultisampleTexture(gbuffer.ChannelAlbedo), texture.GetSampler(texture.NearestClamp))
+	sh.ProgramUniform1i(0, 0)
+
+	texture.BindUnitTarget(1, gbufTarget, gbuf.GetMultisampleTexture(gbuffer.ChannelNormal), texture.GetSampler(texture.NearestClamp))
+	sh.ProgramUniform1i(1, 1)
+	gbuf.SetNormalCodecUniforms(sh)
+
+	texture.BindUnitTarget(2, gbufTarget, gbuf.GetMultisampleDepthTex(), texture.GetSampler(texture.NearestClamp))
+	sh.ProgramUniform1i(2, 2)
+
+	// without a shadow map everything is lit
+	t := s.shadowTarget()
+	shadowFilter := int(s.shadowFilter)
+	var shadowTex gl.Uint
+	texelSize, offsetX, offsetY, scale := float32(1), float32(0), float32(0), float32(1)
+
+	if t != nil {
+		shadowTex = t.GetDepthTex()
+		texelSize = t.GetTexelSize()
+		offsetX, offsetY, scale = t.GetUVTransform()
+		texture.BindUnit(3, shadowTex, texture.GetSampler(texture.ShadowCompare))
+	} else {
+		shadowFilter = -1
+	}
 
-	gl.ActiveTexture(gl.TEXTURE2)
-	gl.BindTexture(gl.TEXTURE_2D, gbuf.GetDepthTex())
-	s.shader.ProgramUniform1i(2, 2)
+	sh.ProgramUniform1i(3, 3)
+	sh.ProgramUniform1f(23, texelSize)
+	sh.ProgramUniform3f(30, offsetX, offsetY, scale)
+
+	// a texel covers 2 tan(alpha) / size world units per unit of distance,
+	// size being that of the map, not of the atlas holding it
+	b := s.shadowBias
+	sh.ProgramUniform1f(24, b.Constant)
+	sh.ProgramUniform1f(25, b.NormalOffset * 2 * float32(math.Tan(float64(s.alpha))) * texelSize / scale)
+
+	sh.ProgramUniform1i(26, shadowFilter)
+	if s.moments != nil {
+		s.moments.SetUniforms(sh, 5)
+	} else {
+		shadowmap.SetNoMomentsUniforms(sh, 5)
+	}
 
-	gl.ActiveTexture(gl.TEXTURE3)
-	gl.BindTexture(gl.TEXTURE_2D, s.shadowMap.GetDepthTex())
-	s.shader.ProgramUniform1i(3, 3)
+	// the blocker search reads the depths without compare
+	if s.shadowFilter == shadowmap.FilterPCSS && t != nil {
+		texture.BindUnit(6, shadowTex, texture.GetSampler(texture.NearestClamp))
+	}
+	sh.ProgramUniform1i(27, 6)
+	sh.ProgramUniform1f(28, scale * s.lightSize / (2 * float32(math.Tan(float64(s.alpha)))))
+	sh.ProgramUniform2f(29, spotLightNear, spotLightFar)
 
 	var eyeSpacePos vmath.Vector4
 	vmath.V4MakeFromP3(&eyeSpacePos, &s.pos)
 	vmath.M4MulV4(&eyeSpacePos, viewMat, &eyeSpacePos)
 
-	s.shader.ProgramUniform4f(4, eyeSpacePos.X, eyeSpacePos.Y, eyeSpacePos.Z, s.alpha)
+	sh.ProgramUniform4f(4, eyeSpacePos.X, eyeSpacePos.Y, eyeSpacePos.Z, s.alpha)
 
 	var PV vmath.Matrix4
 	vmath.M4Mul(&PV, projMat, viewMat)
 
-	s.shader.ProgramUniformM4(5, &PV)	
+	sh.ProgramUniformM4(5, &PV)	
 
 
 	var invV vmath.Matrix4
@@ -306,32 +760,38 @@ func (s *SpotLight) Render(gbuf *gbuffer.GBuffer, projMat, viewMat *vmath.Matrix
 	var shadowMat vmath.Matrix4
 	vmath.M4Mul(&shadowMat, &s.pvMat, &invV)
 
-	s.shader.ProgramUniformM4(13, &shadowMat)
-	s.shader.ProgramUniform3f(17, s.color.X, s.color.Y, s.color.Z)
-	s.shader.ProgramUniformM4(18, viewMat)
+	sh.ProgramUniformM4(13, &shadowMat)
+	sh.ProgramUniform3f(17, s.color.X, s.color.Y, s.color.Z)
+	sh.ProgramUniformM4(18, viewMat)
 
 	
 	var eyeSpaceDir vmath.Vector4
 	vmath.M4MulV3(&eyeSpaceDir, viewMat, &s.dir)
 
-	s.shader.ProgramUniform3f(19, eyeSpaceDir.X, eyeSpaceDir.Y, eyeSpaceDir.Z)
+	sh.ProgramUniform3f(19, eyeSpaceDir.X, eyeSpaceDir.Y, eyeSpaceDir.Z)
 
 
 
-	s.shader.Enable()
+	sh.Enable()
 	
 	//s.fsQuadVAO.Draw()
 	s.coneVAO.Draw()
-	s.shader.Disable()
+	sh.Disable()
 
 
-	gl.BindTexture(gl.TEXTURE_2D, 0)
-	gl.ActiveTexture(gl.TEXTURE2)
-	gl.BindTexture(gl.TEXTURE_2D, 0)
-	gl.ActiveTexture(gl.TEXTURE1)
-	gl.BindTexture(gl.TEXTURE_2D, 0)
-	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, 0)
+	if s.shadowFilter == shadowmap.FilterPCSS {
+		texture.UnbindUnit(6)
+	}
+	if s.moments != nil {
+		texture.UnbindUnit(5)
+	}
+	if gbuf.GetSamples() > 1 {
+		texture.UnbindUnit(4)
+	}
+	texture.UnbindUnit(3)
+	texture.UnbindUnitTarget(2, gbufTarget)
+	texture.UnbindUnitTarget(1, gbufTarget)
+	texture.UnbindUnitTarget(0, gbufTarget)
 /*
 
 	gl.LineWidth(2.0)
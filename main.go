@@ -5,25 +5,52 @@ import (
 	"github.com/jteeuwen/glfw"
 	//	"github.com/rwesterteiger/vectormath"
 	"log"
-	"github.com/rwesterteiger/go-gltest/shader"
-	"github.com/rwesterteiger/go-gltest/buffers"
+	//"github.com/rwesterteiger/go-gltest/shader"
+	//"github.com/rwesterteiger/go-gltest/buffers"
 	"github.com/rwesterteiger/go-gltest/geom"
 	vmath "github.com/rwesterteiger/vectormath"
 	"math"
 	"fmt"
 
-	"github.com/rwesterteiger/go-gltest/scene"
+	sc "github.com/rwesterteiger/go-gltest/scene"
 	"github.com/rwesterteiger/go-gltest/lights"
 	"github.com/rwesterteiger/go-gltest/post"
+	"github.com/rwesterteiger/go-gltest/gldebug"
+	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/texture"
 	"time"	
+	"path/filepath"
 )
 
 const (
 	Title  = "Hello Shader"
 	Width  = 1024
 	Height = 768
+
+	TrackGLResources = true // report leaked GL objects on exit
+	ReportNormalEncodingError = false // print the precision of the G-buffer normal encodings at startup
+	MSAASamples = 4 // G-buffer samples per pixel, 1 disables MSAA
+	CaptureDir = "capture" // F12 writes the G-buffer and filter outputs of the next frame below this
 )
 
+func reportNormalEncodingError() {
+	formats := []struct {
+		format gl.Enum
+		name string
+	}{ { gl.RGB16F, "RGB16F" }, { gl.RG16F, "RG16F" }, { gl.RG8, "RG8" } }
+
+	for _, enc := range []gbuffer.NormalEncoding{ gbuffer.NormalRaw, gbuffer.NormalOctahedral, gbuffer.NormalSpheremap } {
+		for _, f := range formats {
+			if (enc == gbuffer.NormalRaw) != (f.format == gl.RGB16F) {
+				continue
+			}
+
+			maxErr, meanErr := gbuffer.NormalEncodingError(enc, f.format, 100000)
+			fmt.Printf("%-10v %-6s max error %.4f deg, mean error %.4f deg\n", enc, f.name, maxErr, meanErr)
+		}
+	}
+}
+
 
 
 const vertexShaderSource = `
@@ -53,138 +80,28 @@ void main(void)
 `
 
 
-func makePlaneVAO() (*buffers.VAO) {
-	vtxs := buffers.MakeVBOFromVec3s([]vmath.Vector3{ {-10, 0, 10}, {10, 0, 10}, {10, 0, -10}, {-10, 0, -10 } })
-	normals := buffers.MakeVBOFromVec3s([]vmath.Vector3{ {0,1,0}, {0,1,0}, {0,1,0}, {0,1,0} })
-	indices := []uint32{ 0, 1, 2, 2, 3, 0 }
-
-	vao := buffers.MakeVAO(gl.TRIANGLES, 6)
-	vao.AttachVBO(0, vtxs)
-	vao.AttachVBO(1, normals)
-	vao.SetIndexBuffer(indices)
-
-	return vao
-}
-	
-func makeQuadShader() (quadShader *shader.Shader) {
-	const quadVtxShaderSrc =`
-	#version 430
-	layout (location = 0) in vec2 vtx;
-	layout (location = 1) in vec2 tc;
-
-	out vec2 vTc;
+// nextDebugStage returns the debug stage following the current one of f,
+// wrapping around to the normal output.
+func nextDebugStage(f post.PostProcessFilter) string {
+	stages := append([]string{ "" }, f.DebugStages()...)
 
-	void main(void) {
-		gl_Position = vec4(vtx.xy, 0, 1);
-		vTc = tc;
-	}
-	`
-
-	const quadFragShaderSrc = `
-	#version 430
-	layout (location = 0) out vec4 fragData;
-	in vec2 vTc;
-
-	layout (location = 0) uniform sampler2D albedoTex;
-	layout (location = 1) uniform sampler2D normalTex;
-	layout (location = 2) uniform sampler2D depthTex;
-
-	void main(void)
-	{
-		float foo = mod(vTc.x, 1.0 / 3.0);
-
-		vec2 tc = vec2(3 * mod(vTc.x, 1.0 / 3.0), vTc.y);
-
-		//float z = texture2D(depthTex, vTc).x;
-		//fragData = texture2D(albedoTex, vTc);
-		//vec3 n = texture2D(normalTex, vTc).xyz;
-
-		switch (int(vTc.x * 3)) {
-			case 0:
-				fragData = texture2D(albedoTex, tc);
-				break;
-			case 1:
-				fragData = vec4(pow(texture2D(depthTex, tc).x, 16));
-				break;
-			case 2:
-				fragData = texture2D(normalTex, tc) /2 + 0.5;
-				break;
+	for i, st := range stages {
+		if st == f.GetDebugStage() {
+			return stages[(i + 1) % len(stages)]
 		}
-
 	}
-	`
 
-	quadShader = shader.Make()
-
-	quadShader.AddShaderSource(quadVtxShaderSrc, gl.VERTEX_SHADER)
-	quadShader.AddShaderSource(quadFragShaderSrc, gl.FRAGMENT_SHADER)
-	quadShader.Link()
-
-	return
+	return ""
 }
 
-func makeAmbientBlitShader() (*shader.Shader) {
-	const vSrc =`
-	#version 430
-	layout (location = 0) in vec2 vtx;
-	layout (location = 1) in vec2 tc;
-
-	out vec2 vTc;
-
-	void main(void) {
-		gl_Position = vec4(vtx.xy, 0, 1);
-		vTc = tc;
+func makePlaneMesh() (*geom.Mesh) {
+	return &geom.Mesh{
+		Vertices : []vmath.Vector3{ {-10, 0, 10}, {10, 0, 10}, {10, 0, -10}, {-10, 0, -10 } },
+		Normals : []vmath.Vector3{ {0,1,0}, {0,1,0}, {0,1,0}, {0,1,0} },
+		Indices : []uint32{ 0, 1, 2, 2, 3, 0 },
 	}
-	`
-
-	const fSrc = `
-	#version 430
-	layout (location = 0) out vec4 fragData;
-	in vec2 vTc;
-
-	layout (location = 0) uniform sampler2D albedoTex;
-
-	void main(void)
-	{
-		fragData = 0.1 * texture2D(albedoTex, vTc);
-	}
-	`
-
-	s := shader.Make()
-
-	s.AddShaderSource(vSrc, gl.VERTEX_SHADER)
-	s.AddShaderSource(fSrc, gl.FRAGMENT_SHADER)
-	s.Link()
-
-	return s
-}
-
-
-func makeFullscreenQuadVAO() (*buffers.VAO) {
-	vtxs := buffers.MakeVBOFromVec2s([]vmath.Vector2{ {-1, -1}, {1, -1}, {1, 1}, {-1, 1} })
-	tcs := buffers.MakeVBOFromVec2s([]vmath.Vector2{ { 0,0 }, {1,0}, {1,1}, {0,1} })
-	indices := []uint32{ 0, 1, 2, 2, 3, 0 }
-
-	vao := buffers.MakeVAO(gl.TRIANGLES, 6)
-	vao.AttachVBO(0, vtxs)
-	vao.AttachVBO(1, tcs)
-	vao.SetIndexBuffer(indices)
-
-	return vao
-}
-
-func makeQuadVAO() (*buffers.VAO) {
-	vtxs := buffers.MakeVBOFromVec2s([]vmath.Vector2{ { -0.2, -0.98}, {0.98, -0.98}, {0.98, -0.6}, {-0.2, -0.6} })
-	tcs := buffers.MakeVBOFromVec2s([]vmath.Vector2{ { 0,0 }, {1,0}, {1,1}, {0,1} })
-	indices := []uint32{ 0, 1, 2, 2, 3, 0 }
-
-	vao := buffers.MakeVAO(gl.TRIANGLES, 6)
-	vao.AttachVBO(0, vtxs)
-	vao.AttachVBO(1, tcs)
-	vao.SetIndexBuffer(indices)
-
-	return vao
 }
+	
 /*
 func makeSceneRenderer() func(float32,  *vmath.Matrix4, *vmath.Matrix4) {
 	objVAO := geom.LoadOBJ("monkey.obj")
@@ -241,7 +158,6 @@ func main() {
 	glfw.OpenWindowHint(glfw.OpenGLVersionMajor, 4)
 	glfw.OpenWindowHint(glfw.OpenGLVersionMinor, 3)
 	glfw.OpenWindowHint(glfw.OpenGLProfile, glfw.OpenGLCoreProfile);
-	glfw.OpenWindowHint(glfw.WindowNoResize, 1)
 	glfw.SetSwapInterval(0)
 
 	if err := glfw.OpenWindow(Width, Height, 0, 0, 0, 0, 32, 0, glfw.Windowed); err != nil {
@@ -255,15 +171,22 @@ func main() {
 	if err := gl.Init(); err != nil {
 		log.Fatal(err)
 	}
-	
-	//quadShader := makeQuadShader()
-	//quadVAO := makeQuadVAO()
 
+	if TrackGLResources {
+		gldebug.Enable()
+		defer gldebug.ReportLeaks() // runs after all other deferred cleanup
+	}
 
-	//ambientBlitShader := makeAmbientBlitShader()
-	//fsQuadVAO := makeFullscreenQuadVAO()
+	defer texture.DeleteSamplers()
 
-	scene := scene.Make(Width, Height)
+	if ReportNormalEncodingError {
+		reportNormalEncodingError()
+	}
+	
+	gbufLayout := gbuffer.DefaultLayout()
+	gbufLayout.Samples = MSAASamples
+
+	scene := sc.MakeWithGBufferLayout(Width, Height, gbufLayout)
 	defer scene.Delete()
 
 	var zNear float32 = 0.1
@@ -283,16 +206,16 @@ func main() {
 	vmath.M4MulT3(&modelMatrixMonkey, &modelMatrixMonkey, &blenderToGLXForm)
 
 
-	monkey := geom.LoadOBJ("monkey.obj", &vmath.Vector4{1,1,1,1})
-	monkey.SetModelMatrix(&modelMatrixMonkey)
-	scene.AddObject(monkey)
+	monkeyMesh := geom.LoadOBJ("monkey.obj", &vmath.Vector4{1,1,1,1})
+	monkeyMesh.SetModelMatrix(&modelMatrixMonkey)
+	scene.AddObject(monkeyMesh)
 
 
 	var monkeyArrayTrans vmath.Transform3
 	vmath.T3MakeTranslation(&monkeyArrayTrans, &vmath.Vector3{0,0,-2})
 	vmath.M4MulT3(&modelMatrixMonkey, &modelMatrixMonkey, &monkeyArrayTrans)
 
-	monkey = geom.LoadOBJ("monkey.obj", &vmath.Vector4{1,1,1,1})
+	monkey := monkeyMesh.MakeInstance(&vmath.Vector4{1,1,1,1})
 	monkey.SetModelMatrix(&modelMatrixMonkey)
 	scene.AddObject(monkey)
 
@@ -300,17 +223,21 @@ func main() {
 	vmath.M4MulT3(&modelMatrixMonkey, &modelMatrixMonkey, &monkeyArrayTrans)
 
 	vmath.M4MulT3(&modelMatrixMonkey, &modelMatrixMonkey, &monkeyArrayTrans)
-	monkey = geom.LoadOBJ("monkey.obj", &vmath.Vector4{1,1,1,1})
+	monkey = monkeyMesh.MakeInstance(&vmath.Vector4{1,1,1,1})
 	monkey.SetModelMatrix(&modelMatrixMonkey)
 	scene.AddObject(monkey)
 
-	scene.AddObject(geom.MakeObject(makePlaneVAO(), &vmath.Vector4{1,1,1,1}))
+	scene.AddObject(geom.MakeObjectFromMesh(makePlaneMesh(), &vmath.Vector4{1,1,1,1}))
+
+	scene.EnableShadowAtlas(4096, gl.DEPTH_COMPONENT24)
 
 	scene.AddLight(lights.MakeAmbientLight())
 
 	scene.AddLight(lights.MakeSpotLight(&vmath.Point3{0, 3,-2}, &vmath.Point3{0,0,-2}, &vmath.Vector3{0,0,-1}, 2, &vmath.Vector3{0.5,0,0}))
 	scene.AddLight(lights.MakeSpotLight(&vmath.Point3{0, 3, 0}, &vmath.Point3{0,0, 0}, &vmath.Vector3{0,0,-1}, 2, &vmath.Vector3{0,0.5,0}))
 	scene.AddLight(lights.MakeSpotLight(&vmath.Point3{0, 3, 2}, &vmath.Point3{0,0, 2}, &vmath.Vector3{0,0,-1}, 2, &vmath.Vector3{0,0,0.5}))
+	scene.AddLight(lights.MakeDirectionalLight(&vmath.Vector3{-1,-2,-1}, &vmath.Vector3{0.3,0.3,0.25}, 3))
+	scene.AddLight(lights.MakePointLight(&vmath.Point3{1.5,1,0}, 4, &vmath.Vector3{1,0.8,0.5}))
 
 	//scene.AddLight(lights.MakeSpotLight(&vmath.Point3{2, 2, 2}, &vmath.Point3{0,0.0,0}, &vmath.Vector3{0,0,-1}, 1.5, &vmath.Vector3{0.5,0,0}))
 	//scene.AddLight(lights.MakeSpotLight(&vmath.Point3{-2,2, 2}, &vmath.Point3{0,0.0,0}, &vmath.Vector3{0,0,-1}, 1.5, &vmath.Vector3{0,0.5,0}))
@@ -322,6 +249,47 @@ func main() {
 	blurFilter := post.MakeBlurFilter(Width, Height)
 	scene.AddPostFilter(blurFilter)
 
+	// the callback runs during SwapBuffers; apply the new size before the next frame
+	resizeW, resizeH := 0, 0
+	glfw.SetWindowSizeCallback(func(w, h int) {
+		resizeW, resizeH = w, h
+	})
+
+	// keys 0-8 select a debug view, [ and ] the light or post filter it
+	// shows, S steps through the debug stages of the selected post filter
+	postFilters := []post.PostProcessFilter{ dofFilter, blurFilter }
+	captureRequested := false
+
+	glfw.SetKeyCallback(func(key, state int) {
+		if state != glfw.KeyPress {
+			return
+		}
+
+		view, index := scene.GetDebugView()
+
+		switch {
+		case key == glfw.KeyF12:
+			captureRequested = true
+			return
+		case key >= '0' && key < '0' + int(sc.DebugViewCount):
+			view = sc.DebugView(key - '0')
+		case key == '[' && index > 0:
+			index--
+		case key == ']':
+			index++
+		case key == 'S' && view == sc.DebugViewPostFilter && index < len(postFilters):
+			f := postFilters[index]
+			f.SetDebugStage(nextDebugStage(f))
+			fmt.Printf("Post filter %d debug stage: %q\n", index, f.GetDebugStage())
+			return
+		default:
+			return
+		}
+
+		scene.SetDebugView(view, index)
+		fmt.Printf("Debug view: %v, index %d\n", view, index)
+	})
+
 	var t float32 = 0.0
 
 	startTime := time.Now()
@@ -335,62 +303,26 @@ func main() {
 			startTime = thisFrameTime
 		}
 
+		if resizeW != 0 || resizeH != 0 {
+			scene.Resize(resizeW, resizeH)
+			resizeW, resizeH = 0, 0
+		}
+
 		camX := float32(-3 * math.Sin(float64(t)))
 		camZ := 0.7 +  float32(-3 * math.Cos(float64(t)))
 
 		scene.SetCameraLookAt(&vmath.Point3{camX, 2, camZ}, &vmath.Point3{0,0.6,0.7}, &vmath.Vector3{0,1,0})
 
+		if captureRequested {
+			dir := filepath.Join(CaptureDir, fmt.Sprintf("frame%06d", frameCount))
+			fmt.Printf("Capturing frame to %s\n", dir)
+			scene.CaptureNextFrame(dir)
+			captureRequested = false
+		}
+
 		gl.Clear(gl.DEPTH_BUFFER_BIT | gl.COLOR_BUFFER_BIT)
 		scene.Render()
 
-		//blurFilter.BeginRender()
-
-		//gl.ActiveTexture(gl.TEXTURE0)
-		//gl.BindTexture(gl.TEXTURE_2D, gbuf.GetAlbedoTex())
-
-		//ambientBlitShader.ProgramUniform1i(0,0)
-		//ambientBlitShader.Enable()
-
-
-		//fsQuadVAO.Draw()
-
-		//ambientBlitShader.Disable()
-
-
-		//blurFilter.EndRender()
-		//blurFilter.DisplayBlurResult()
-
-		// bind textures
-/*
-		gl.ActiveTexture(gl.TEXTURE0)
-		gl.BindTexture(gl.TEXTURE_2D, gbuf.GetAlbedoTex())
-
-		gl.ActiveTexture(gl.TEXTURE1)
-		gl.BindTexture(gl.TEXTURE_2D, gbuf.GetNormalTex())
-
-		gl.ActiveTexture(gl.TEXTURE2)
-		gl.BindTexture(gl.TEXTURE_2D, gbuf.GetDepthTex())
-	
-		quadShader.ProgramUniform1i(0, 0)
-		quadShader.ProgramUniform1i(1, 1)
-		quadShader.ProgramUniform1i(2, 2)
-
-		quadShader.Enable()
-		quadVAO.Draw()
-		quadShader.Disable()
-
-		gl.BindTexture(gl.TEXTURE_2D, 0)
-		gl.ActiveTexture(gl.TEXTURE2)
-		gl.BindTexture(gl.TEXTURE_2D, 0)
-		gl.ActiveTexture(gl.TEXTURE1)
-		gl.BindTexture(gl.TEXTURE_2D, 0)
-		gl.ActiveTexture(gl.TEXTURE0)
-		gl.BindTexture(gl.TEXTURE_2D, 0)
-
-		
-	
-		
-*/
 
 	t = 16.4;
 		
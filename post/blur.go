@@ -7,6 +7,8 @@ import (
 	"github.com/rwesterteiger/go-gltest/shader"
 	//"github.com/rwesterteiger/go-gltest/buffers"
 	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
+	"github.com/rwesterteiger/go-gltest/texture"
 )
 
 const vtxShaderSrc =`
@@ -135,31 +137,22 @@ const blendFragShaderSrc = `
 	void main(void) {
 		vec3 blurredColor = texture2D(blurredTex, vTc).rgb;
 		fragData = vec4(toneMap(vTc) + blurredColor, 1);
-
-		if (vTc.x > 0.4 && vTc.y > 0.8) {
-			float y = 5 * (vTc.y - 0.8);
-
-			if (vTc.x > 0.8) {
-				fragData = texture2D(blurredTex, vec2(5*(vTc.x-0.8), y));
-			} else if (vTc.x > 0.6) {
-				fragData = vec4(toneMap(vec2(5 * (vTc.x - 0.6), y)), 1);
-			} else {
-				fragData = texture2D(sceneTex, vec2(5 * (vTc.x - 0.4), y));
-			}
-		}
 	}
 `
 
 
+// debug stages of BlurFilter, both at quarter resolution
+const (
+	BlurStageBrightPass = "brightpass"
+	BlurStageBlurred = "blurred"
+)
+
 type BlurFilter struct {
 	PostProcessFilterBase
 
-	blurFBOs [2]gl.Uint
-	blurTexs [2]gl.Uint
 
 	downSampleShader *shader.Shader
-	blurXShader *shader.Shader
-	blurYShader *shader.Shader
+	blur *GaussianBlur
 	blendShader *shader.Shader
 
 
@@ -173,44 +166,12 @@ func MakeBlurFilter(w, h int) (b *BlurFilter) {
 	b.PostProcessFilterBase.init(w,h)
 
 
-	// blur FBOs
-	for i := 0; i < 2; i++ {
-		gl.GenTextures(1, &(b.blurTexs[i]))
-
-		gl.BindTexture(gl.TEXTURE_2D, b.blurTexs[i]);
-		gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA16F, gl.Sizei(w) / 4, gl.Sizei(h) / 4, 0, gl.RGBA, gl.FLOAT, nil)
-		setTexParameters()
-
-	
-		gl.BindTexture(gl.TEXTURE_2D, 0)
-	
-		gl.GenFramebuffers(1, &(b.blurFBOs[i]))
-		gl.BindFramebuffer(gl.FRAMEBUFFER, b.blurFBOs[i])
-		gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, b.blurTexs[i], 0)
-	
-		drawBufs := []gl.Enum{ gl.COLOR_ATTACHMENT0 }
-		gl.DrawBuffers(1, &(drawBufs[0]))
-
-		checkFramebuffer()
-
-		gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
-	}
-
 	b.downSampleShader = shader.Make()
 	b.downSampleShader.AddShaderSource(vtxShaderSrc, gl.VERTEX_SHADER)
 	b.downSampleShader.AddShaderSource(downSampleFragShaderSrc, gl.FRAGMENT_SHADER)
 	b.downSampleShader.Link()
 
-	b.blurXShader = shader.Make()
-	b.blurXShader.AddShaderSource(vtxShaderSrc, gl.VERTEX_SHADER)
-	b.blurXShader.AddShaderSource(blurXFragShaderSrc, gl.FRAGMENT_SHADER)
-	b.blurXShader.Link()
-
-
-	b.blurYShader = shader.Make()
-	b.blurYShader.AddShaderSource(vtxShaderSrc, gl.VERTEX_SHADER)
-	b.blurYShader.AddShaderSource(blurYFragShaderSrc, gl.FRAGMENT_SHADER)
-	b.blurYShader.Link()
+	b.blur = MakeGaussianBlur()
 	
 
 	b.blendShader = shader.Make()
@@ -222,8 +183,17 @@ func MakeBlurFilter(w, h int) (b *BlurFilter) {
 	return
 }
 
+func (_ *BlurFilter) DebugStages() []string {
+	return []string{ BlurStageBrightPass, BlurStageBlurred }
+}
+
 func (b *BlurFilter) Delete() {
 	b.PostProcessFilterBase.delete()
+
+
+	b.downSampleShader.Delete()
+	b.blur.Delete()
+	b.blendShader.Delete()
 }
 /*
 func (b *BlurFilter) BeginRender() {
@@ -237,49 +207,39 @@ func (b *BlurFilter) EndRender() {
 }
 */
 
-func (b *BlurFilter) Apply(gbuf *gbuffer.GBuffer, inputTex gl.Uint, P, V *vmath.Matrix4) (outputTex gl.Uint) {
-	gl.BindFramebuffer(gl.FRAMEBUFFER, b.blurFBOs[0])
+func (b *BlurFilter) Apply(gbuf *gbuffer.GBuffer, inputTex gl.Uint, P, V *vmath.Matrix4) (output *rendertarget.RenderTarget) {
+	// quarter resolution ping-pong buffers
+	var blurTargets [2]*rendertarget.RenderTarget
+	for i := range blurTargets {
+		blurTargets[i] = b.acquire(b.w / 4, b.h / 4, gl.RGBA16F)
+	}
+
+	blurTargets[0].Bind()
 	
-	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, inputTex);
+	texture.BindUnit(0, inputTex, texture.GetSampler(texture.LinearClamp))
 
 	b.downSampleShader.ProgramUniform1i(0, 0)
 	b.downSampleShader.ProgramUniform2f(1, 1.0 / float32(b.w), 1.0 / float32(b.h))
 
 	b.downSampleShader.Enable()
-	b.fsQuadVAO.Draw() // downsample input texture into blurFBOs[0]
+	b.fsQuadVAO.Draw() // downsample input texture into blurTargets[0]
 	b.downSampleShader.Disable()
 
+	b.stage(BlurStageBrightPass, blurTargets[0])
+
 
 	
 	for i := 0; i < 4; i++ {
-	gl.BindFramebuffer(gl.FRAMEBUFFER, b.blurFBOs[1])
-
-	gl.BindTexture(gl.TEXTURE_2D, b.blurTexs[0])
-	b.blurXShader.ProgramUniform1i(0, 0)
-	b.blurXShader.ProgramUniform2f(1, 1.0 / float32(b.w/4), 1.0 / float32(b.h/4))
-
-	b.blurXShader.Enable()
-	b.fsQuadVAO.Draw()
-	b.blurXShader.Disable()
-
-	gl.BindFramebuffer(gl.FRAMEBUFFER, b.blurFBOs[0])
-
-	gl.BindTexture(gl.TEXTURE_2D, b.blurTexs[1])
-	b.blurYShader.ProgramUniform1i(0, 0)
-	b.blurYShader.ProgramUniform2f(1, 1.0 / float32(b.w/4), 1.0 / float32(b.h/4))
-
-	b.blurYShader.Enable()
-	b.fsQuadVAO.Draw()
-	b.blurYShader.Disable()
+		b.blur.Apply(blurTargets[0], blurTargets[1])
 	}
 
-	gl.BindFramebuffer(gl.FRAMEBUFFER, b.outputFBO)
+	b.stage(BlurStageBlurred, blurTargets[0])
+
+	output = b.acquireOutput()
+	output.Bind()
 
-	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, inputTex)
-	gl.ActiveTexture(gl.TEXTURE1)
-	gl.BindTexture(gl.TEXTURE_2D, b.blurTexs[0])
+	texture.BindUnit(0, inputTex, texture.GetSampler(texture.LinearClamp))
+	texture.BindUnit(1, blurTargets[0].GetTexture(gl.COLOR_ATTACHMENT0), texture.GetSampler(texture.LinearClamp))
 
 	b.blendShader.ProgramUniform1i(0,0)
 	b.blendShader.ProgramUniform1i(1,1)
@@ -288,12 +248,16 @@ func (b *BlurFilter) Apply(gbuf *gbuffer.GBuffer, inputTex gl.Uint, P, V *vmath.
 	b.fsQuadVAO.Draw()
 	b.blendShader.Disable()
 
-	gl.BindTexture(gl.TEXTURE_2D, 0);
-	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, 0);
+	texture.UnbindUnit(1)
+	texture.UnbindUnit(0)
 
-	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
-	return b.outputTex
+	rendertarget.Unbind()
+
+	for i := range blurTargets {
+		b.pool.Release(blurTargets[i])
+	}
+
+	return b.finish(output)
 
 /*
 	gl.BindFramebuffer(gl.DRAW_FRAMEBUFFER, 0) // keep reading from b.blurFBOs[1] but write to default FBO
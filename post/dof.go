@@ -7,6 +7,8 @@ import (
 	"github.com/rwesterteiger/go-gltest/shader"
 	//"github.com/rwesterteiger/go-gltest/buffers"
 	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
+	"github.com/rwesterteiger/go-gltest/texture"
 )
 
 const dofVtxShaderSrc =`
@@ -122,21 +124,18 @@ func MakeDoFFilter(w, h int, focusDistance float32) (d *DoFFilter) {
 
 func (b *DoFFilter) Delete() {
 	b.PostProcessFilterBase.delete()
+	b.dofShader.Delete()
 }
 
-func (b *DoFFilter) Apply(gbuf *gbuffer.GBuffer, inputTex gl.Uint, P, V *vmath.Matrix4) (outputTex gl.Uint) {
-	gl.BindFramebuffer(gl.FRAMEBUFFER, b.outputFBO)
+func (b *DoFFilter) Apply(gbuf *gbuffer.GBuffer, inputTex gl.Uint, P, V *vmath.Matrix4) (output *rendertarget.RenderTarget) {
+	output = b.acquireOutput()
+	output.Bind()
 	
-	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, inputTex);
-	//gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR);
-	//gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR_MIPMAP_LINEAR);
-	//gl.GenerateMipmap(gl.TEXTURE_2D)
+	texture.BindUnit(0, inputTex, texture.GetSampler(texture.LinearClamp))
 
 	b.dofShader.ProgramUniform1i(0, 0)
 
-	gl.ActiveTexture(gl.TEXTURE1)
-	gl.BindTexture(gl.TEXTURE_2D, gbuf.GetDepthTex());
+	texture.BindUnit(1, gbuf.GetDepthTex(), texture.GetSampler(texture.NearestClamp))
 	b.dofShader.ProgramUniform1i(1, 1)
 
 	b.dofShader.ProgramUniform1f(2, b.focusDistance)
@@ -149,7 +148,12 @@ func (b *DoFFilter) Apply(gbuf *gbuffer.GBuffer, inputTex gl.Uint, P, V *vmath.M
 	b.fsQuadVAO.Draw() // downsample input texture into blurFBOs[0]
 	b.dofShader.Disable()
 
-	return b.outputTex
+	texture.UnbindUnit(1)
+	texture.UnbindUnit(0)
+
+	rendertarget.Unbind()
+
+	return
 }
 
 
@@ -0,0 +1,71 @@
+package post
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/shader"
+	"github.com/rwesterteiger/go-gltest/buffers"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
+	"github.com/rwesterteiger/go-gltest/texture"
+)
+
+// GaussianBlur is the separable 9-tap gaussian kernel of BlurFilter, usable
+// on any render target, e.g. for filtering shadow map moments.
+type GaussianBlur struct {
+	blurXShader *shader.Shader
+	blurYShader *shader.Shader
+
+	fsQuadVAO *buffers.VAO
+}
+
+func MakeGaussianBlur() (g *GaussianBlur) {
+	g = new(GaussianBlur)
+
+	g.blurXShader = shader.Make()
+	g.blurXShader.AddShaderSource(vtxShaderSrc, gl.VERTEX_SHADER)
+	g.blurXShader.AddShaderSource(blurXFragShaderSrc, gl.FRAGMENT_SHADER)
+	g.blurXShader.Link()
+
+	g.blurYShader = shader.Make()
+	g.blurYShader.AddShaderSource(vtxShaderSrc, gl.VERTEX_SHADER)
+	g.blurYShader.AddShaderSource(blurYFragShaderSrc, gl.FRAGMENT_SHADER)
+	g.blurYShader.Link()
+
+	g.fsQuadVAO = makeFullscreenQuadVAO()
+
+	return
+}
+
+func (g *GaussianBlur) Delete() {
+	g.blurXShader.Delete()
+	g.blurYShader.Delete()
+	g.fsQuadVAO.Delete()
+}
+
+// Apply blurs the first color attachment of rt in place, horizontally into
+// tmp and back vertically; tmp must have the size and format of rt. Leaves
+// rt bound.
+func (g *GaussianBlur) Apply(rt, tmp *rendertarget.RenderTarget) {
+	w, h := rt.GetSize()
+
+	tmp.Bind()
+
+	texture.BindUnit(0, rt.GetTexture(gl.COLOR_ATTACHMENT0), texture.GetSampler(texture.LinearClamp))
+	g.blurXShader.ProgramUniform1i(0, 0)
+	g.blurXShader.ProgramUniform2f(1, 1.0 / float32(w), 1.0 / float32(h))
+
+	g.blurXShader.Enable()
+	g.fsQuadVAO.Draw()
+	g.blurXShader.Disable()
+
+	rt.Bind()
+
+	texture.BindUnit(0, tmp.GetTexture(gl.COLOR_ATTACHMENT0), texture.GetSampler(texture.LinearClamp))
+	g.blurYShader.ProgramUniform1i(0, 0)
+	g.blurYShader.ProgramUniform2f(1, 1.0 / float32(w), 1.0 / float32(h))
+
+	g.blurYShader.Enable()
+	g.fsQuadVAO.Draw()
+	g.blurYShader.Disable()
+
+	texture.UnbindUnit(0)
+}
@@ -2,6 +2,7 @@ package post
 
 import (
 	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
 	"github.com/rwesterteiger/go-gltest/gbuffer"
 	"github.com/rwesterteiger/go-gltest/buffers"
 	vmath "github.com/rwesterteiger/vectormath"
@@ -9,16 +10,37 @@ import (
 )
 
 type PostProcessFilter interface {
-	Apply(gbuf *gbuffer.GBuffer, inputTex gl.Uint, P, V *vmath.Matrix4) (outputTex gl.Uint)
+	// Apply renders into a target acquired from the filter's pool. The
+	// caller releases it to that pool once the result has been consumed.
+	Apply(gbuf *gbuffer.GBuffer, inputTex gl.Uint, P, V *vmath.Matrix4) (output *rendertarget.RenderTarget)
+
+	// UsePool sets the pool the filter takes its intermediate and output
+	// targets from; it has to be called before the first Apply.
+	UsePool(pool *rendertarget.Pool)
+
+	// Resize changes the size of the filter output.
+	Resize(w, h int)
+
+	// DebugStages lists the intermediate results of the filter which
+	// SetDebugStage can select.
+	DebugStages() []string
+
+	// SetDebugStage makes Apply return the named intermediate result
+	// instead of the final output; "" restores the normal output.
+	SetDebugStage(name string)
+	GetDebugStage() string
+
 	Delete()
 }
 
 type PostProcessFilterBase struct {
 	w, h int
 
-	outputFBO gl.Uint
-	outputTex gl.Uint
+	pool *rendertarget.Pool
 	fsQuadVAO *buffers.VAO
+
+	debugStage string
+	debugOutput *rendertarget.RenderTarget // copy of the selected stage during Apply
 }
 
 func makeFullscreenQuadVAO() (*buffers.VAO) {
@@ -33,47 +55,77 @@ func makeFullscreenQuadVAO() (*buffers.VAO) {
 }
 
 
-func setTexParameters() {
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
-}
+func (f *PostProcessFilterBase) init(w, h int) {
+	f.w = w
+	f.h = h
 
-func checkFramebuffer() {
-	result := gl.CheckFramebufferStatus(gl.FRAMEBUFFER)
+	f.fsQuadVAO = makeFullscreenQuadVAO()
+}
 
-	if result != gl.FRAMEBUFFER_COMPLETE {
-		log.Fatal("Error creating gbuffer FBO!")
-	}
+func (f *PostProcessFilterBase) UsePool(pool *rendertarget.Pool) {
+	f.pool = pool
 }
 
-func (f *PostProcessFilterBase) init(w, h int) {
+func (f *PostProcessFilterBase) Resize(w, h int) {
 	f.w = w
 	f.h = h
+}
+
+// acquire takes a w x h target from the pool.
+func (f *PostProcessFilterBase) acquire(w, h int, format gl.Enum) *rendertarget.RenderTarget {
+	if f.pool == nil {
+		log.Fatal("Post-process filter applied without a render target pool!")
+	}
 
-	// input FBO
-	gl.GenTextures(1, &f.outputTex)
+	return f.pool.Acquire(w, h, format)
+}
 
-	gl.BindTexture(gl.TEXTURE_2D, f.outputTex);
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA16F, gl.Sizei(w), gl.Sizei(h), 0, gl.RGBA, gl.FLOAT, nil)
-	setTexParameters()
+func (f *PostProcessFilterBase) acquireOutput() *rendertarget.RenderTarget {
+	return f.acquire(f.w, f.h, gl.RGBA16F)
+}
 
-	gl.BindTexture(gl.TEXTURE_2D, 0)
+// DebugStages returns nil, filters with intermediate results override it.
+func (_ *PostProcessFilterBase) DebugStages() []string {
+	return nil
+}
 
-	gl.GenFramebuffers(1, &f.outputFBO)
-	gl.BindFramebuffer(gl.FRAMEBUFFER, f.outputFBO)
-	gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, f.outputTex, 0)
-	
-	drawBufs := []gl.Enum{ gl.COLOR_ATTACHMENT0 }
-	gl.DrawBuffers(1, &(drawBufs[0]))
+func (f *PostProcessFilterBase) SetDebugStage(name string) {
+	f.debugStage = name
+}
 
-	checkFramebuffer()
+func (f *PostProcessFilterBase) GetDebugStage() string {
+	return f.debugStage
+}
 
-	f.fsQuadVAO = makeFullscreenQuadVAO()
+// stage offers the intermediate result rt under name. If it is the selected
+// debug stage it is copied, as filters go on to overwrite their
+// intermediate targets.
+func (f *PostProcessFilterBase) stage(name string, rt *rendertarget.RenderTarget) {
+	if f.debugStage == "" || name != f.debugStage {
+		return
+	}
+
+	if f.debugOutput == nil {
+		w, h := rt.GetSize()
+		f.debugOutput = f.acquire(w, h, gl.RGBA16F)
+	}
+
+	rt.BlitTo(f.debugOutput, gl.COLOR_BUFFER_BIT, gl.NEAREST)
+}
+
+// finish returns what Apply is to return: output, or the copy of the
+// selected debug stage in its place.
+func (f *PostProcessFilterBase) finish(output *rendertarget.RenderTarget) *rendertarget.RenderTarget {
+	if f.debugOutput == nil {
+		return output
+	}
+
+	f.pool.Release(output)
+	output, f.debugOutput = f.debugOutput, nil
+
+	return output
 }
 
 func (f *PostProcessFilterBase) delete() {
-	gl.DeleteFramebuffers(1, &f.outputFBO)
-	gl.DeleteTextures(1, &f.outputTex)
+	f.fsQuadVAO.Delete()
 }
@@ -0,0 +1,177 @@
+package rendertarget
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/texture"
+	"log"
+)
+
+// targets not acquired for this many frames are freed by EndFrame
+const poolMaxIdleFrames = 3
+
+type poolKey struct {
+	w, h int
+	format gl.Enum
+}
+
+type poolEntry struct {
+	rt *RenderTarget
+	key poolKey
+	bytes int
+	lastUsed int // frame number
+}
+
+// PoolStats summarizes the memory held by a Pool. Bytes are estimated from
+// the texel size of the formats.
+type PoolStats struct {
+	Targets int // allocated render targets
+	InUse int // currently acquired render targets
+	Bytes int // memory of all allocated targets
+	InUseBytes int // memory of the acquired targets
+	PeakBytes int // maximum of Bytes so far
+	PeakInUseBytes int // maximum of InUseBytes so far
+	Allocations int // Acquire calls which had to create a target
+	Reuses int // Acquire calls served from the pool
+}
+
+// Pool hands out single-attachment render targets for transient passes.
+// Targets are acquired by size and format, released as soon as their
+// contents have been consumed and then reused by later passes of the same or
+// following frames.
+type Pool struct {
+	free map[poolKey][]*poolEntry
+	inUse map[*RenderTarget]*poolEntry
+	frame int
+	stats PoolStats
+}
+
+func MakePool() (p *Pool) {
+	p = new(Pool)
+	p.free = make(map[poolKey][]*poolEntry)
+	p.inUse = make(map[*RenderTarget]*poolEntry)
+	return
+}
+
+func attachmentPointForFormat(format gl.Enum) gl.Enum {
+	info, _ := texture.GetFormatInfo(format)
+
+	switch {
+	case info.Depth && info.Stencil:
+		return gl.DEPTH_STENCIL_ATTACHMENT
+	case info.Depth:
+		return gl.DEPTH_ATTACHMENT
+	}
+
+	return gl.COLOR_ATTACHMENT0
+}
+
+// Acquire returns a w x h render target with a single texture of the given
+// format, attached to gl.COLOR_ATTACHMENT0 (or the depth/depth-stencil
+// attachment for depth formats). Its contents are undefined.
+func (p *Pool) Acquire(w, h int, format gl.Enum) *RenderTarget {
+	key := poolKey{ w, h, format }
+
+	var e *poolEntry
+	if free := p.free[key]; len(free) > 0 {
+		e = free[len(free) - 1]
+		p.free[key] = free[:len(free) - 1]
+		p.stats.Reuses++
+	} else {
+		rt, err := Make(w, h, Attachment{ Point : attachmentPointForFormat(format), Format : format })
+		if err != nil {
+			log.Fatal("Error creating pooled render target: ", err)
+		}
+
+		info, _ := texture.GetFormatInfo(format)
+		e = &poolEntry{ rt : rt, key : key, bytes : w * h * info.BytesPerPixel }
+
+		p.stats.Allocations++
+		p.stats.Targets++
+		p.stats.Bytes += e.bytes
+		if p.stats.Bytes > p.stats.PeakBytes {
+			p.stats.PeakBytes = p.stats.Bytes
+		}
+	}
+
+	e.lastUsed = p.frame
+	p.inUse[e.rt] = e
+
+	p.stats.InUse++
+	p.stats.InUseBytes += e.bytes
+	if p.stats.InUseBytes > p.stats.PeakInUseBytes {
+		p.stats.PeakInUseBytes = p.stats.InUseBytes
+	}
+
+	return e.rt
+}
+
+// Release returns rt to the pool. rt must have been acquired from p.
+func (p *Pool) Release(rt *RenderTarget) {
+	e, ok := p.inUse[rt]
+	if !ok {
+		log.Fatal("Releasing a render target not acquired from this pool!")
+	}
+
+	delete(p.inUse, rt)
+	p.free[e.key] = append(p.free[e.key], e)
+
+	p.stats.InUse--
+	p.stats.InUseBytes -= e.bytes
+}
+
+// EndFrame frees targets which have not been acquired for a few frames, so
+// that sizes and formats which are no longer requested (e.g. after a
+// resize) do not pile up.
+func (p *Pool) EndFrame() {
+	p.frame++
+
+	for key, free := range p.free {
+		kept := free[:0]
+
+		for _, e := range free {
+			if p.frame - e.lastUsed > poolMaxIdleFrames {
+				p.deleteEntry(e)
+			} else {
+				kept = append(kept, e)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(p.free, key)
+		} else {
+			p.free[key] = kept
+		}
+	}
+}
+
+// Purge frees all targets which are not currently acquired.
+func (p *Pool) Purge() {
+	for key, free := range p.free {
+		for _, e := range free {
+			p.deleteEntry(e)
+		}
+		delete(p.free, key)
+	}
+}
+
+func (p *Pool) deleteEntry(e *poolEntry) {
+	e.rt.Delete()
+	p.stats.Targets--
+	p.stats.Bytes -= e.bytes
+}
+
+func (p *Pool) Stats() PoolStats {
+	return p.stats
+}
+
+// Delete frees all targets, including acquired ones.
+func (p *Pool) Delete() {
+	for rt, e := range p.inUse {
+		p.deleteEntry(e)
+		delete(p.inUse, rt)
+	}
+	p.stats.InUse = 0
+	p.stats.InUseBytes = 0
+
+	p.Purge()
+}
@@ -0,0 +1,420 @@
+// Package rendertarget builds framebuffer objects from attachment
+// descriptions.
+package rendertarget
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/gldebug"
+	"github.com/rwesterteiger/go-gltest/texture"
+	"fmt"
+	"sort"
+)
+
+// Attachment describes one image of a render target. Either Format is set
+// and the render target allocates (and owns) the texture, or Texture names
+// an existing texture which is only attached.
+type Attachment struct {
+	Point gl.Enum // gl.COLOR_ATTACHMENTi, gl.DEPTH_ATTACHMENT, gl.DEPTH_STENCIL_ATTACHMENT
+	Format gl.Enum // sized internal format of an owned texture
+	W, H int // size of an owned texture, 0 = size of the render target
+	Levels int // mip levels of an owned texture, 0 = 1
+	Layers int // > 0 allocates a gl.TEXTURE_2D_ARRAY with that many layers
+	Samples int // > 1 allocates a gl.TEXTURE_2D_MULTISAMPLE with that many samples
+	Cube bool // allocates a gl.TEXTURE_CUBE_MAP, Layer selects the face
+
+	Level int // mip level rendered to
+	Layer int // layer rendered to if the texture is layered, face of a cube map
+
+	Texture gl.Uint // existing texture, not owned
+	Target gl.Enum // target of Texture, 0 = gl.TEXTURE_2D
+
+	internalFormat gl.Enum // Format, or queried from Texture by build
+}
+
+// IncompleteError is returned if the framebuffer is not complete.
+type IncompleteError struct {
+	Status gl.Enum
+}
+
+func (e *IncompleteError) Error() string {
+	return fmt.Sprintf("framebuffer incomplete: %s (0x%x)", statusString(e.Status), int(e.Status))
+}
+
+func statusString(status gl.Enum) string {
+	switch status {
+	case gl.FRAMEBUFFER_UNDEFINED:
+		return "GL_FRAMEBUFFER_UNDEFINED"
+	case gl.FRAMEBUFFER_INCOMPLETE_ATTACHMENT:
+		return "GL_FRAMEBUFFER_INCOMPLETE_ATTACHMENT"
+	case gl.FRAMEBUFFER_INCOMPLETE_MISSING_ATTACHMENT:
+		return "GL_FRAMEBUFFER_INCOMPLETE_MISSING_ATTACHMENT"
+	case gl.FRAMEBUFFER_INCOMPLETE_DRAW_BUFFER:
+		return "GL_FRAMEBUFFER_INCOMPLETE_DRAW_BUFFER"
+	case gl.FRAMEBUFFER_INCOMPLETE_READ_BUFFER:
+		return "GL_FRAMEBUFFER_INCOMPLETE_READ_BUFFER"
+	case gl.FRAMEBUFFER_UNSUPPORTED:
+		return "GL_FRAMEBUFFER_UNSUPPORTED"
+	case gl.FRAMEBUFFER_INCOMPLETE_MULTISAMPLE:
+		return "GL_FRAMEBUFFER_INCOMPLETE_MULTISAMPLE"
+	case gl.FRAMEBUFFER_INCOMPLETE_LAYER_TARGETS:
+		return "GL_FRAMEBUFFER_INCOMPLETE_LAYER_TARGETS"
+	}
+
+	return "unknown status"
+}
+
+type RenderTarget struct {
+	w, h int
+	fbo gl.Uint
+	attachments []Attachment
+	textures []gl.Uint // one per attachment
+}
+
+// Make creates a w x h render target. Color attachments are enabled as draw
+// buffers in the order of their attachment points; without any color
+// attachment drawing and reading are disabled (depth-only target).
+func Make(w, h int, attachments ...Attachment) (rt *RenderTarget, err error) {
+	// own copy, build fills in internal formats
+	attachments = append([]Attachment(nil), attachments...)
+	rt = &RenderTarget{ w : w, h : h, attachments : attachments, textures : make([]gl.Uint, len(attachments)) }
+
+	gl.GenFramebuffers(1, &rt.fbo)
+	gldebug.Track(gldebug.Framebuffer, rt.fbo)
+
+	if err = rt.build(); err != nil {
+		rt.Delete()
+		return nil, err
+	}
+
+	return
+}
+
+func (a *Attachment) owned() bool {
+	return a.Texture == 0
+}
+
+func (a *Attachment) target() gl.Enum {
+	switch {
+	case a.owned() && a.Layers > 0:
+		return gl.TEXTURE_2D_ARRAY
+	case a.owned() && a.Cube:
+		return gl.TEXTURE_CUBE_MAP
+	case a.owned() && a.Samples > 1:
+		return gl.TEXTURE_2D_MULTISAMPLE
+	case a.owned() || a.Target == 0:
+		return gl.TEXTURE_2D
+	}
+
+	return a.Target
+}
+
+func (a *Attachment) isColor() bool {
+	return a.Point != gl.DEPTH_ATTACHMENT && a.Point != gl.STENCIL_ATTACHMENT && a.Point != gl.DEPTH_STENCIL_ATTACHMENT
+}
+
+// build allocates missing owned textures at the current size and attaches
+// everything.
+func (rt *RenderTarget) build() error {
+	gl.BindFramebuffer(gl.FRAMEBUFFER, rt.fbo)
+
+	for i := range rt.attachments {
+		a := &rt.attachments[i]
+
+		if a.owned() {
+			if rt.textures[i] == 0 {
+				rt.allocate(i)
+			}
+			a.internalFormat = a.Format
+		} else {
+			rt.textures[i] = a.Texture
+			if a.internalFormat == 0 {
+				a.internalFormat = queryInternalFormat(a)
+			}
+		}
+
+		switch a.target() {
+		case gl.TEXTURE_2D, gl.TEXTURE_2D_MULTISAMPLE:
+			gl.FramebufferTexture2D(gl.FRAMEBUFFER, a.Point, a.target(), rt.textures[i], gl.Int(a.Level))
+		case gl.TEXTURE_CUBE_MAP:
+			gl.FramebufferTexture2D(gl.FRAMEBUFFER, a.Point, gl.TEXTURE_CUBE_MAP_POSITIVE_X + gl.Enum(a.Layer), rt.textures[i], gl.Int(a.Level))
+		default:
+			gl.FramebufferTextureLayer(gl.FRAMEBUFFER, a.Point, rt.textures[i], gl.Int(a.Level), gl.Int(a.Layer))
+		}
+	}
+
+	rt.setDrawBuffers()
+
+	status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+
+	if status != gl.FRAMEBUFFER_COMPLETE {
+		return &IncompleteError{ status }
+	}
+
+	return nil
+}
+
+// queryInternalFormat returns the internal format of the external texture
+// of a at the level rendered to.
+func queryInternalFormat(a *Attachment) gl.Enum {
+	target := a.target()
+	gl.BindTexture(target, a.Texture)
+	defer gl.BindTexture(target, 0)
+
+	levelTarget := target
+	if target == gl.TEXTURE_CUBE_MAP {
+		levelTarget = gl.TEXTURE_CUBE_MAP_POSITIVE_X + gl.Enum(a.Layer)
+	}
+
+	var format gl.Int
+	gl.GetTexLevelParameteriv(levelTarget, gl.Int(a.Level), gl.TEXTURE_INTERNAL_FORMAT, &format)
+	return gl.Enum(format)
+}
+
+// setDrawBuffers enables all color attachments of the bound rt as draw
+// buffers in attachment point order and reads from the first one.
+func (rt *RenderTarget) setDrawBuffers() {
+	var drawBufs []gl.Enum
+	for _, a := range rt.sortedColorAttachments() {
+		drawBufs = append(drawBufs, a.Point)
+	}
+
+	if len(drawBufs) > 0 {
+		gl.DrawBuffers(gl.Sizei(len(drawBufs)), &(drawBufs[0]))
+		gl.ReadBuffer(drawBufs[0])
+	} else {
+		gl.DrawBuffer(gl.NONE)
+		gl.ReadBuffer(gl.NONE)
+	}
+}
+
+func (rt *RenderTarget) allocate(i int) {
+	a := &rt.attachments[i]
+
+	w, h := a.W, a.H
+	if w == 0 || h == 0 {
+		w, h = rt.w, rt.h
+	}
+
+	levels := a.Levels
+	if levels == 0 {
+		levels = 1
+	}
+
+	gl.GenTextures(1, &rt.textures[i])
+	gldebug.Track(gldebug.Texture, rt.textures[i])
+
+	target := a.target()
+	gl.BindTexture(target, rt.textures[i])
+
+	switch target {
+	case gl.TEXTURE_2D_ARRAY:
+		gl.TexStorage3D(target, gl.Sizei(levels), a.Format, gl.Sizei(w), gl.Sizei(h), gl.Sizei(a.Layers))
+	case gl.TEXTURE_2D_MULTISAMPLE:
+		gl.TexStorage2DMultisample(target, gl.Sizei(a.Samples), a.Format, gl.Sizei(w), gl.Sizei(h), gl.TRUE)
+	default:
+		gl.TexStorage2D(target, gl.Sizei(levels), a.Format, gl.Sizei(w), gl.Sizei(h))
+	}
+
+	gl.BindTexture(target, 0)
+}
+
+func (rt *RenderTarget) deleteOwned() {
+	for i := range rt.attachments {
+		if rt.attachments[i].owned() && rt.textures[i] != 0 {
+			gldebug.Untrack(gldebug.Texture, rt.textures[i])
+			gl.DeleteTextures(1, &rt.textures[i])
+		}
+		rt.textures[i] = 0
+	}
+}
+
+func (rt *RenderTarget) Delete() {
+	if rt.fbo == 0 {
+		return
+	}
+
+	rt.deleteOwned()
+
+	gldebug.Untrack(gldebug.Framebuffer, rt.fbo)
+	gl.DeleteFramebuffers(1, &rt.fbo)
+	rt.fbo = 0
+}
+
+// Resize reallocates all owned textures which follow the size of the render
+// target. Textures of explicitly sized and external attachments are kept.
+func (rt *RenderTarget) Resize(w, h int) error {
+	if w == rt.w && h == rt.h {
+		return nil
+	}
+
+	rt.w, rt.h = w, h
+
+	for i := range rt.attachments {
+		if a := &rt.attachments[i]; a.owned() && (a.W == 0 || a.H == 0) {
+			gldebug.Untrack(gldebug.Texture, rt.textures[i])
+			gl.DeleteTextures(1, &rt.textures[i])
+			rt.textures[i] = 0
+		}
+	}
+
+	return rt.build()
+}
+
+func (rt *RenderTarget) GetSize() (w, h int) {
+	return rt.w, rt.h
+}
+
+func (rt *RenderTarget) GetFBO() gl.Uint {
+	return rt.fbo
+}
+
+// GetTexture returns the texture attached at point, or 0.
+func (rt *RenderTarget) GetTexture(point gl.Enum) gl.Uint {
+	for i := range rt.attachments {
+		if rt.attachments[i].Point == point {
+			return rt.textures[i]
+		}
+	}
+
+	return 0
+}
+
+// Bind makes rt the current draw and read framebuffer and sets the viewport
+// to the size of the rendered mip level.
+func (rt *RenderTarget) Bind() {
+	w, h := rt.w, rt.h
+	if len(rt.attachments) > 0 {
+		w, h = rt.attachments[0].W, rt.attachments[0].H
+		if w == 0 || h == 0 {
+			w, h = rt.w, rt.h
+		}
+		w, h = w >> uint(rt.attachments[0].Level), h >> uint(rt.attachments[0].Level)
+	}
+
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	gl.BindFramebuffer(gl.FRAMEBUFFER, rt.fbo)
+	gl.Viewport(0, 0, gl.Sizei(w), gl.Sizei(h))
+}
+
+// Unbind makes the default framebuffer current again.
+func Unbind() {
+	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+}
+
+// BlitTo copies the buffers in mask (gl.COLOR_BUFFER_BIT copies color
+// attachment 0) from rt to dst, scaling with filter if the sizes differ.
+// dst == nil blits to the default framebuffer, which has to be w x h then.
+// Leaves the default framebuffer bound.
+func (rt *RenderTarget) BlitTo(dst *RenderTarget, mask gl.Bitfield, filter gl.Enum) {
+	var dstFBO gl.Uint
+	dstW, dstH := rt.w, rt.h
+	if dst != nil {
+		dstFBO = dst.fbo
+		dstW, dstH = dst.w, dst.h
+	}
+
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, rt.fbo)
+	gl.BindFramebuffer(gl.DRAW_FRAMEBUFFER, dstFBO)
+	gl.BlitFramebuffer(0, 0, gl.Int(rt.w), gl.Int(rt.h), 0, 0, gl.Int(dstW), gl.Int(dstH), mask, filter)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+}
+
+// ResolveTo copies every color attachment of rt to the color attachment of
+// dst with the same rank in attachment point order, and depth if both have
+// it. Multisampled attachments are resolved, which is what it is for: dst
+// is a single-sampled twin of a multisampled rt. Leaves the default
+// framebuffer bound.
+func (rt *RenderTarget) ResolveTo(dst *RenderTarget) {
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, rt.fbo)
+	gl.BindFramebuffer(gl.DRAW_FRAMEBUFFER, dst.fbo)
+
+	srcColors, dstColors := rt.sortedColorAttachments(), dst.sortedColorAttachments()
+
+	// a blit writes all draw buffers, so they are enabled one at a time
+	for i := 0; i < len(srcColors) && i < len(dstColors); i++ {
+		gl.ReadBuffer(srcColors[i].Point)
+		gl.DrawBuffer(dstColors[i].Point)
+		gl.BlitFramebuffer(0, 0, gl.Int(rt.w), gl.Int(rt.h), 0, 0, gl.Int(dst.w), gl.Int(dst.h), gl.COLOR_BUFFER_BIT, gl.NEAREST)
+	}
+
+	if rt.hasDepth() && dst.hasDepth() {
+		gl.BlitFramebuffer(0, 0, gl.Int(rt.w), gl.Int(rt.h), 0, 0, gl.Int(dst.w), gl.Int(dst.h), gl.DEPTH_BUFFER_BIT, gl.NEAREST)
+	}
+
+	// restore the per-framebuffer draw and read buffer state
+	gl.BindFramebuffer(gl.FRAMEBUFFER, dst.fbo)
+	dst.setDrawBuffers()
+	gl.BindFramebuffer(gl.FRAMEBUFFER, rt.fbo)
+	rt.setDrawBuffers()
+	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+}
+
+func (rt *RenderTarget) hasDepth() bool {
+	for i := range rt.attachments {
+		if p := rt.attachments[i].Point; p == gl.DEPTH_ATTACHMENT || p == gl.DEPTH_STENCIL_ATTACHMENT {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Clear clears all color attachments to 0 and depth/stencil to 1/0. rt has
+// to be bound.
+func (rt *RenderTarget) Clear() {
+	rt.ClearColor(0, 0, 0, 0)
+	rt.ClearDepthStencil(1, 0)
+}
+
+// ClearColor clears all color attachments to (r, g, b, a). rt has to be
+// bound.
+func (rt *RenderTarget) ClearColor(r, g, b, a float32) {
+	color := []gl.Float{ gl.Float(r), gl.Float(g), gl.Float(b), gl.Float(a) }
+	zero := []gl.Uint{ 0, 0, 0, 0 }
+
+	// draw buffer n is the n-th color attachment in attachment point order
+	n := 0
+	for _, a := range rt.sortedColorAttachments() {
+		if info, _ := texture.GetFormatInfo(a.internalFormat); info.Format == gl.RED_INTEGER {
+			gl.ClearBufferuiv(gl.COLOR, gl.Int(n), &(zero[0])) // integer targets are always cleared to 0
+		} else {
+			gl.ClearBufferfv(gl.COLOR, gl.Int(n), &(color[0]))
+		}
+		n++
+	}
+}
+
+func (rt *RenderTarget) sortedColorAttachments() (colors []*Attachment) {
+	for i := range rt.attachments {
+		if rt.attachments[i].isColor() {
+			colors = append(colors, &rt.attachments[i])
+		}
+	}
+
+	sort.Slice(colors, func(i, j int) bool { return colors[i].Point < colors[j].Point })
+	return
+}
+
+// ClearDepthStencil clears the depth and stencil attachments, if present.
+// rt has to be bound.
+func (rt *RenderTarget) ClearDepthStencil(depth float32, stencil int) {
+	for i := range rt.attachments {
+		switch rt.attachments[i].Point {
+		case gl.DEPTH_ATTACHMENT:
+			d := gl.Float(depth)
+			gl.ClearBufferfv(gl.DEPTH, 0, &d)
+		case gl.STENCIL_ATTACHMENT:
+			s := gl.Int(stencil)
+			gl.ClearBufferiv(gl.STENCIL, 0, &s)
+		case gl.DEPTH_STENCIL_ATTACHMENT:
+			gl.ClearBufferfi(gl.DEPTH_STENCIL, 0, gl.Float(depth), gl.Int(stencil))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package scene
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/texture"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// CaptureNextFrame makes the next Render write all intermediate images to
+// dir: every G-buffer channel, linear depth, the lighting result and the
+// output of each post filter. Each image is written raw as EXR and
+// tonemapped or normalized as PNG. Readback stalls the pipeline, so
+// captured frames are slow.
+func (s *Scene) CaptureNextFrame(dir string) {
+	s.captureDir = dir
+}
+
+// capturing reports whether the frame being rendered is to be captured.
+func (s *Scene) capturing() bool {
+	return s.captureDir != ""
+}
+
+func (s *Scene) captureGBuffer() {
+	if err := os.MkdirAll(s.captureDir, 0755); err != nil {
+		log.Print("Capture failed: ", err)
+		s.captureDir = ""
+		return
+	}
+
+	for _, c := range s.gbuf.GetLayout().Channels {
+		var img *texture.FloatImage
+		var err error
+		mode := texture.PNGClamp
+
+		switch c.Source {
+		case gbuffer.SourceNormal:
+			img, err = s.gbuf.ReadNormals()
+			mode = texture.PNGNormalize
+		case gbuffer.SourceEmissive:
+			img, err = s.gbuf.ReadChannel(c.Name)
+			mode = texture.PNGTonemap
+		case gbuffer.SourceMaterialID, gbuffer.SourceVelocity:
+			img, err = s.gbuf.ReadChannel(c.Name)
+			mode = texture.PNGNormalize
+		default:
+			img, err = s.gbuf.ReadChannel(c.Name)
+		}
+
+		s.writeCapture(c.Name, img, err, mode)
+	}
+
+	img, err := s.gbuf.ReadLinearDepth(&s.camProjMat)
+	s.writeCapture("depth", img, err, texture.PNGNormalize)
+}
+
+// captureTexture writes an HDR color texture, e.g. a post filter output.
+func (s *Scene) captureTexture(name string, tex gl.Uint) {
+	img, err := texture.ReadTexture(tex, 0)
+	s.writeCapture(name, img, err, texture.PNGTonemap)
+}
+
+func (s *Scene) writeCapture(name string, img *texture.FloatImage, err error, mode texture.PNGMode) {
+	if err == nil {
+		err = texture.WriteEXR(filepath.Join(s.captureDir, name + ".exr"), img)
+	}
+	if err == nil {
+		err = texture.WritePNG(filepath.Join(s.captureDir, name + ".png"), img, mode)
+	}
+
+	if err != nil {
+		log.Printf("Capture of %s failed: %v", name, err)
+	}
+}
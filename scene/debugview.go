@@ -0,0 +1,270 @@
+package scene
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/lights"
+	"github.com/rwesterteiger/go-gltest/post"
+	"github.com/rwesterteiger/go-gltest/shader"
+	"github.com/rwesterteiger/go-gltest/texture"
+	vmath "github.com/rwesterteiger/vectormath"
+)
+
+// DebugView selects what Render shows instead of the final image.
+type DebugView int
+
+const (
+	DebugViewNone DebugView = iota
+	DebugViewAlbedo
+	DebugViewNormals // eye space normals, decoded from the G-buffer encoding
+	DebugViewDepth // linear eye space depth, black at the near and white at the far plane
+	DebugViewPosition // eye space position reconstructed from depth, as fract(pos)
+	DebugViewLighting // light accumulation buffer before post-processing
+	DebugViewLight // contribution of the light selected by the debug index
+	DebugViewShadowMap // linear depth of the shadow maps of the light selected by the debug index, side by side
+	DebugViewPostFilter // output of the post filter selected by the debug index
+
+	DebugViewCount
+)
+
+func (v DebugView) String() string {
+	switch v {
+	case DebugViewNone:
+		return "none"
+	case DebugViewAlbedo:
+		return "albedo"
+	case DebugViewNormals:
+		return "normals"
+	case DebugViewDepth:
+		return "depth"
+	case DebugViewPosition:
+		return "position"
+	case DebugViewLighting:
+		return "lighting"
+	case DebugViewLight:
+		return "light"
+	case DebugViewShadowMap:
+		return "shadow map"
+	case DebugViewPostFilter:
+		return "post filter"
+	}
+
+	return "unknown"
+}
+
+// modes of debugFragShaderSrc
+const (
+	debugModeTonemap = iota
+	debugModeColor
+	debugModeNormal
+	debugModeDepth
+	debugModePosition
+)
+
+const debugFragShaderSrc = `
+	#version 430
+	layout (location = 0) out vec4 fragData;
+	in vec2 vTc;
+
+	layout (location = 0) uniform sampler2D inTex;
+	layout (location = 1) uniform int mode;
+	layout (location = 2) uniform mat4 invP;
+	layout (location = 6) uniform sampler2DArray inArray;
+	layout (location = 7) uniform int layer; // >= 0 reads inArray instead of inTex
+	layout (location = 8) uniform samplerCube inCube;
+	layout (location = 9) uniform int face; // >= 0 reads this face of inCube instead of inTex
+
+	vec3 decodeNormal(vec3 e);
+
+	// cubeDir returns the direction of vTc on face, after the face
+	// selection table of the GL specification
+	vec3 cubeDir(int face) {
+		vec2 st = 2 * vTc - 1;
+		switch (face) {
+		case 0: return vec3( 1, -st.y, -st.x);
+		case 1: return vec3(-1, -st.y,  st.x);
+		case 2: return vec3(st.x,  1,  st.y);
+		case 3: return vec3(st.x, -1, -st.y);
+		case 4: return vec3( st.x, -st.y,  1);
+		}
+		return vec3(-st.x, -st.y, -1);
+	}
+
+	float eyeDepth(float z) {
+		vec4 pos = invP * vec4(2 * vec3(vTc, z) - 1, 1);
+		return -pos.z / pos.w;
+	}
+
+	void main(void)
+	{
+		vec4 texel;
+		if (face >= 0) {
+			texel = texture(inCube, cubeDir(face));
+		} else if (layer >= 0) {
+			texel = texture(inArray, vec3(vTc, layer));
+		} else {
+			texel = texture(inTex, vTc);
+		}
+
+		switch (mode) {
+		case 0: // tonemap
+			fragData = vec4(texel.rgb / (1 + texel.rgb), 1);
+			break;
+		case 1: // color
+			fragData = vec4(texel.rgb, 1);
+			break;
+		case 2: // normal
+			fragData = vec4(0.5 * decodeNormal(texel.xyz) + 0.5, 1);
+			break;
+		case 3: { // depth
+			float near = eyeDepth(0), far = eyeDepth(1);
+			fragData = vec4(vec3((eyeDepth(texel.x) - near) / (far - near)), 1);
+			break;
+		}
+		case 4: { // position
+			vec4 pos = invP * vec4(2 * vec3(vTc, texel.x) - 1, 1);
+			fragData = vec4(texel.x < 1 ? fract(pos.xyz / pos.w) : vec3(0), 1);
+			break;
+		}
+		}
+	}
+	`
+
+func makeDebugShader() (s *shader.Shader) {
+	const vSrc =`
+	#version 430
+	layout (location = 0) in vec2 vtx;
+	layout (location = 1) in vec2 tc;
+
+	out vec2 vTc;
+
+	void main(void) {
+		gl_Position = vec4(vtx.xy, 0, 1);
+		vTc = tc;
+	}
+	`
+
+	s = shader.Make()
+	s.AddShaderSource(vSrc, gl.VERTEX_SHADER)
+	s.AddShaderSource(debugFragShaderSrc, gl.FRAGMENT_SHADER)
+	s.AddShaderSource(gbuffer.NormalCodecShaderSource, gl.FRAGMENT_SHADER)
+	s.Link()
+
+	return
+}
+
+// SetDebugView makes Render show v instead of the final image. index selects
+// the light for DebugViewLight and DebugViewShadowMap and the post filter for
+// DebugViewPostFilter; a post filter's intermediate results are selected
+// with its SetDebugStage. Views which do not exist, like the shadow map of
+// a light without one, show black.
+func (s *Scene) SetDebugView(v DebugView, index int) {
+	s.debugView, s.debugIndex = v, index
+}
+
+func (s *Scene) GetDebugView() (v DebugView, index int) {
+	return s.debugView, s.debugIndex
+}
+
+// renderLight reports whether light i contributes to the light accumulation
+// buffer in the current debug view.
+func (s *Scene) renderLight(i int) bool {
+	return s.debugView != DebugViewLight || i == s.debugIndex
+}
+
+// activePostFilters returns the post filters applied in the current debug
+// view.
+func (s *Scene) activePostFilters() []post.PostProcessFilter {
+	switch s.debugView {
+	case DebugViewLighting, DebugViewLight:
+		return nil
+	case DebugViewPostFilter:
+		if s.debugIndex >= 0 && s.debugIndex < len(s.postFilters) {
+			return s.postFilters[:s.debugIndex+1]
+		}
+		return nil
+	}
+
+	return s.postFilters
+}
+
+// drawDebugView draws the current debug view to the default framebuffer.
+// output holds the light accumulation or post filter result.
+func (s *Scene) drawDebugView(output gl.Uint) {
+	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+	gl.Viewport(0, 0, gl.Sizei(s.w), gl.Sizei(s.h))
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+
+	switch s.debugView {
+	case DebugViewAlbedo:
+		s.drawDebugTexture(s.gbuf.GetAlbedoTex(), gl.TEXTURE_2D, 0, debugModeColor, &s.camProjMat)
+	case DebugViewNormals:
+		s.drawDebugTexture(s.gbuf.GetNormalTex(), gl.TEXTURE_2D, 0, debugModeNormal, &s.camProjMat)
+	case DebugViewDepth:
+		s.drawDebugTexture(s.gbuf.GetDepthTex(), gl.TEXTURE_2D, 0, debugModeDepth, &s.camProjMat)
+	case DebugViewPosition:
+		s.drawDebugTexture(s.gbuf.GetDepthTex(), gl.TEXTURE_2D, 0, debugModePosition, &s.camProjMat)
+	case DebugViewLighting, DebugViewLight:
+		s.drawDebugTexture(output, gl.TEXTURE_2D, 0, debugModeTonemap, &s.camProjMat)
+	case DebugViewShadowMap:
+		if s.debugIndex < 0 || s.debugIndex >= len(s.lights) {
+			break
+		}
+
+		caster, ok := s.lights[s.debugIndex].(lights.ShadowCaster)
+		if !ok {
+			break
+		}
+
+		// one tile per shadow map
+		n := caster.NumShadowMaps()
+		for i := 0; i < n; i++ {
+			v := caster.GetShadowMap(i)
+			gl.Viewport(gl.Int(i * s.w / n), 0, gl.Sizei(s.w / n), gl.Sizei(s.h))
+			s.drawDebugTexture(v.Texture, v.Target, v.Layer, debugModeDepth, v.ProjMat)
+		}
+	case DebugViewPostFilter:
+		if s.debugIndex >= 0 && s.debugIndex < len(s.postFilters) {
+			s.drawDebugTexture(output, gl.TEXTURE_2D, 0, debugModeColor, &s.camProjMat)
+		}
+	}
+}
+
+// drawDebugTexture draws layer of tex (a gl.TEXTURE_2D, gl.TEXTURE_2D_ARRAY
+// or gl.TEXTURE_CUBE_MAP, whose layers are its faces) into the current
+// viewport. P is the projection the depth of depth modes was rendered with.
+func (s *Scene) drawDebugTexture(tex gl.Uint, target gl.Enum, layer int, mode int, P *vmath.Matrix4) {
+	if tex == 0 {
+		return
+	}
+
+	var invP vmath.Matrix4
+	vmath.M4Inverse(&invP, P)
+
+	// depth textures are sampled raw, without the compare state of shadow maps
+	unit, face := 0, -1
+	switch target {
+	case gl.TEXTURE_2D_ARRAY:
+		unit = 1
+	case gl.TEXTURE_CUBE_MAP:
+		unit, face, layer = 2, layer, -1
+	default:
+		layer = -1
+	}
+	texture.BindUnitTarget(unit, target, tex, texture.GetSampler(texture.NearestClamp))
+
+	s.debugShader.ProgramUniform1i(0, 0)
+	s.debugShader.ProgramUniform1i(1, mode)
+	s.debugShader.ProgramUniformM4(2, &invP)
+	s.debugShader.ProgramUniform1i(6, 1)
+	s.debugShader.ProgramUniform1i(7, layer)
+	s.debugShader.ProgramUniform1i(8, 2)
+	s.debugShader.ProgramUniform1i(9, face)
+	s.gbuf.SetNormalCodecUniforms(s.debugShader)
+
+	s.debugShader.Enable()
+	s.fsQuadVAO.Draw()
+	s.debugShader.Disable()
+
+	texture.UnbindUnitTarget(unit, target)
+}
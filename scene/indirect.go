@@ -0,0 +1,223 @@
+package scene
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/buffers"
+	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/geom"
+	"github.com/rwesterteiger/go-gltest/shader"
+	vmath "github.com/rwesterteiger/vectormath"
+)
+
+const (
+	drawDataBindingPoint = 0
+	drawDataSize = 176 // std430 size of struct DrawData
+	drawIDAttribIdx = 2
+)
+
+const objIndirectVertexShaderSource = `
+#version 430
+
+layout (location = 0) in vec3 vtx;
+layout (location = 1) in vec3 normal;
+layout (location = 2) in uint drawID; // per instance, starts at the command's baseInstance
+
+out vec3 vEyeSpaceNormal;
+out vec4 vAlbedo;
+out vec2 vMaterial;
+out vec3 vEmissive;
+flat out uint vMaterialID;
+out vec3 vVelocity;
+
+layout (location = 0) uniform mat4 P;
+layout (location = 4) uniform mat4 V;
+layout (location = 17) uniform mat4 prevV;
+
+struct DrawData {
+	mat4 M;
+	mat4 prevM;
+	vec4 diffuseColor;
+	vec3 emissive;
+	float roughness;
+	float metalness;
+	uint materialID;
+};
+
+layout (std430, binding = 0) readonly buffer DrawDataBlock {
+	DrawData draws[];
+};
+
+void main(void) {
+	DrawData d = draws[drawID];
+
+	vec4 eyePos = V * d.M * vec4(vtx,1);
+	vec4 prevEyePos = prevV * d.prevM * vec4(vtx,1);
+
+	gl_Position = P * eyePos;
+	vEyeSpaceNormal = (V * d.M * vec4(normal, 0)).xyz;
+	vAlbedo = d.diffuseColor;
+	vMaterial = vec2(d.roughness, d.metalness);
+	vEmissive = d.emissive;
+	vMaterialID = d.materialID;
+	vVelocity = eyePos.xyz - prevEyePos.xyz;
+}
+`
+
+// meshPool packs the geometry of all scene objects into one interleaved
+// vertex buffer and one index buffer, so that a whole pass can be drawn with
+// a single MultiDrawElementsIndirect call. Command i draws objects[i]; its
+// matrices, color and material are looked up in the per-draw SSBO at index
+// i, which reaches the shader as a per-instance attribute read from
+// BaseInstance i (gl_DrawIDARB would need GL_ARB_shader_draw_parameters,
+// which GL 4.3 does not guarantee).
+type meshPool struct {
+	vao *buffers.VAO
+
+	objects []*geom.Object
+	cmds []buffers.DrawElementsIndirectCommand
+	indirectBuf *buffers.IndirectBuffer
+
+	drawData *buffers.SSBO
+	drawDataWriter buffers.Std430Writer
+
+	fallback []*geom.Object // objects without a CPU-side mesh, drawn directly
+}
+
+func makeIndirectObjShader(objFragShaderSource string) (s *shader.Shader) {
+	s = shader.Make()
+	s.AddShaderSource(objIndirectVertexShaderSource, gl.VERTEX_SHADER)
+	s.AddShaderSource(objFragShaderSource, gl.FRAGMENT_SHADER)
+	s.AddShaderSource(gbuffer.NormalCodecShaderSource, gl.FRAGMENT_SHADER)
+	s.Link()
+
+	return
+}
+
+func makeMeshPool(objects []*geom.Object) (p *meshPool) {
+	p = new(meshPool)
+
+	type meshRange struct {
+		firstIndex, nIndices, baseVertex int
+	}
+
+	ranges := make(map[*geom.Mesh]meshRange)
+
+	var vtxData buffers.VertexWriter
+	var indices []uint32
+	nVertices := 0
+
+	for _, o := range objects {
+		mesh := o.GetMesh()
+
+		if mesh == nil {
+			p.fallback = append(p.fallback, o)
+			continue
+		}
+
+		r, ok := ranges[mesh]
+		if !ok {
+			r = meshRange{ firstIndex : len(indices), nIndices : len(mesh.Indices), baseVertex : nVertices }
+			ranges[mesh] = r
+
+			for i := range mesh.Vertices {
+				v, n := &mesh.Vertices[i], &mesh.Normals[i]
+				vtxData.Float(v.X, v.Y, v.Z, n.X, n.Y, n.Z)
+			}
+			nVertices += len(mesh.Vertices)
+			indices = append(indices, mesh.Indices...)
+		}
+
+		p.cmds = append(p.cmds, buffers.DrawElementsIndirectCommand{
+			Count : uint32(r.nIndices),
+			InstanceCount : 1,
+			FirstIndex : uint32(r.firstIndex),
+			BaseVertex : int32(r.baseVertex),
+			BaseInstance : uint32(len(p.objects)),
+		})
+		p.objects = append(p.objects, o)
+	}
+
+	if len(p.objects) == 0 {
+		return
+	}
+
+	layout := buffers.MakeVertexLayout().AddFloat(0, 3).AddFloat(1, 3)
+	p.vao = buffers.MakeVAO(gl.TRIANGLES, len(indices))
+	p.vao.AttachInterleavedVBO(buffers.MakeVBO(vtxData.Bytes(), layout))
+	p.vao.SetIndexBuffer(indices)
+
+	var drawIDs buffers.VertexWriter
+	for i := range p.objects {
+		drawIDs.Uint32(uint32(i))
+	}
+	p.vao.AttachInstancedVBO(buffers.MakeVBO(drawIDs.Bytes(), buffers.MakeVertexLayout().AddInteger(drawIDAttribIdx, 1, gl.UNSIGNED_INT)), 1)
+
+	p.indirectBuf = buffers.MakeIndirectBuffer(len(p.cmds))
+	p.indirectBuf.Upload(p.cmds)
+
+	p.drawData = buffers.MakeSSBO(len(p.objects) * drawDataSize, drawDataBindingPoint)
+
+	return
+}
+
+func (p *meshPool) Delete() {
+	if p.vao == nil {
+		return
+	}
+
+	p.vao.Delete()
+	p.indirectBuf.Delete()
+	p.drawData.Delete()
+}
+
+// updateDrawData uploads the current matrices, colors and materials.
+func (p *meshPool) updateDrawData() {
+	w := &p.drawDataWriter
+	w.Reset()
+
+	for _, o := range p.objects {
+		m := o.GetMaterial()
+
+		w.Mat4(o.GetModelMatrix())
+		w.Mat4(o.GetPrevModelMatrix())
+		w.Vec4(o.GetDiffuseColor())
+		w.Vec3(&m.Emissive)
+		w.Float(m.Roughness)
+		w.Float(m.Metalness)
+		w.Uint(m.ID)
+		w.Align(16) // array stride of DrawData
+	}
+
+	p.drawData.Upload(w)
+}
+
+func (s *Scene) doRenderIndirect(P, V, prevV *vmath.Matrix4) {
+	if s.meshPool == nil {
+		s.meshPool = makeMeshPool(s.objects)
+	}
+	p := s.meshPool
+
+	if p.vao != nil {
+		p.updateDrawData()
+		p.drawData.Bind()
+
+		sh := s.objIndirectShader
+		sh.ProgramUniformM4(objUniformP, P)
+		sh.ProgramUniformM4(objUniformV, V)
+		sh.ProgramUniformM4(objUniformPrevV, prevV)
+
+		sh.Enable()
+		p.vao.MultiDrawIndirect(p.indirectBuf)
+		sh.Disable()
+	}
+
+	s.doRenderDirect(P, V, prevV, p.fallback)
+}
+
+// invalidateMeshPool makes the next indirect pass repack all meshes.
+func (s *Scene) invalidateMeshPool() {
+	if s.meshPool != nil {
+		s.meshPool.Delete()
+		s.meshPool = nil
+	}
+}
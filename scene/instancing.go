@@ -0,0 +1,168 @@
+package scene
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/buffers"
+	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/geom"
+	"github.com/rwesterteiger/go-gltest/shader"
+	vmath "github.com/rwesterteiger/vectormath"
+)
+
+// per-instance attributes live behind the per-vertex ones (0 = vtx, 1 = normal)
+const (
+	instanceColorAttribIdx = 2
+	instanceModelMatAttribIdx = 3 // mat4, uses 3..6
+	instancePrevModelMatAttribIdx = 7 // mat4, uses 7..10
+	instanceMaterialAttribIdx = 11
+	instanceEmissiveAttribIdx = 12
+	instanceMaterialIDAttribIdx = 13
+)
+
+const objInstancedVertexShaderSource = `
+#version 430
+layout (location = 0) in vec3 vtx;
+layout (location = 1) in vec3 normal;
+layout (location = 2) in vec4 instanceColor;
+layout (location = 3) in mat4 instanceM;
+layout (location = 7) in mat4 instancePrevM;
+layout (location = 11) in vec2 instanceMaterial;
+layout (location = 12) in vec3 instanceEmissive;
+layout (location = 13) in uint instanceMaterialID;
+
+out vec3 vEyeSpaceNormal;
+out vec4 vAlbedo;
+out vec2 vMaterial;
+out vec3 vEmissive;
+flat out uint vMaterialID;
+out vec3 vVelocity;
+
+layout (location = 0) uniform mat4 P;
+layout (location = 4) uniform mat4 V;
+layout (location = 17) uniform mat4 prevV;
+
+void main(void) {
+	vec4 eyePos = V * instanceM * vec4(vtx,1);
+	vec4 prevEyePos = prevV * instancePrevM * vec4(vtx,1);
+
+	gl_Position = P * eyePos;
+	vEyeSpaceNormal = (V * instanceM * vec4(normal, 0)).xyz;
+	vAlbedo = instanceColor;
+	vMaterial = instanceMaterial;
+	vEmissive = instanceEmissive;
+	vMaterialID = instanceMaterialID;
+	vVelocity = eyePos.xyz - prevEyePos.xyz;
+}
+`
+
+// instanceBuffer holds color, matrices and material of every object sharing
+// one mesh VAO. It is attached to that VAO as instanced vertex attributes.
+type instanceBuffer struct {
+	vbo *buffers.VBO
+	capacity int // in instances
+	data buffers.VertexWriter
+}
+
+func makeInstanceLayout() *buffers.VertexLayout {
+	return buffers.MakeVertexLayout().
+		AddFloat(instanceColorAttribIdx, 4).
+		AddMat4(instanceModelMatAttribIdx).
+		AddMat4(instancePrevModelMatAttribIdx).
+		AddFloat(instanceMaterialAttribIdx, 2).
+		AddFloat(instanceEmissiveAttribIdx, 3).
+		AddInteger(instanceMaterialIDAttribIdx, 1, gl.UNSIGNED_INT)
+}
+
+func makeInstancedObjShader(objFragShaderSource string) (s *shader.Shader) {
+	s = shader.Make()
+	s.AddShaderSource(objInstancedVertexShaderSource, gl.VERTEX_SHADER)
+	s.AddShaderSource(objFragShaderSource, gl.FRAGMENT_SHADER)
+	s.AddShaderSource(gbuffer.NormalCodecShaderSource, gl.FRAGMENT_SHADER)
+	s.Link()
+
+	return
+}
+
+// batchByVAO groups objects sharing a mesh, keeping the order in which each
+// mesh first appears.
+func batchByVAO(objects []*geom.Object) (batches [][]*geom.Object) {
+	batchIdx := make(map[*buffers.VAO]int)
+
+	for _, o := range objects {
+		idx, ok := batchIdx[o.GetVAO()]
+
+		if !ok {
+			idx = len(batches)
+			batchIdx[o.GetVAO()] = idx
+			batches = append(batches, nil)
+		}
+
+		batches[idx] = append(batches[idx], o)
+	}
+
+	return
+}
+
+func (s *Scene) getInstanceBuffer(vao *buffers.VAO, nInstances int) *instanceBuffer {
+	ib, ok := s.instanceBufs[vao]
+
+	if !ok || ib.capacity < nInstances {
+		// the VAO deletes the VBO it replaces
+		if !ok {
+			ib = new(instanceBuffer)
+			s.instanceBufs[vao] = ib
+		}
+
+		layout := makeInstanceLayout()
+		ib.capacity = nInstances
+		ib.vbo = buffers.MakeDynamicVBO(nInstances * layout.Stride, layout)
+		vao.AttachInstancedVBO(ib.vbo, 1)
+	}
+
+	return ib
+}
+
+func (s *Scene) doRenderInstanced(P, V, prevV *vmath.Matrix4) {
+	var singles []*geom.Object
+
+	sh := s.objInstancedShader
+	sh.ProgramUniformM4(objUniformP, P)
+	sh.ProgramUniformM4(objUniformV, V)
+	sh.ProgramUniformM4(objUniformPrevV, prevV)
+
+	for _, batch := range batchByVAO(s.objects) {
+		if len(batch) == 1 {
+			singles = append(singles, batch[0])
+			continue
+		}
+
+		vao := batch[0].GetVAO()
+		ib := s.getInstanceBuffer(vao, len(batch))
+
+		ib.data.Reset()
+		for _, o := range batch {
+			c, m := o.GetDiffuseColor(), o.GetMaterial()
+			ib.data.Float(c.X, c.Y, c.Z, c.W)
+			ib.data.Mat4(o.GetModelMatrix())
+			ib.data.Mat4(o.GetPrevModelMatrix())
+			ib.data.Float(m.Roughness, m.Metalness, m.Emissive.X, m.Emissive.Y, m.Emissive.Z)
+			ib.data.Uint32(m.ID)
+		}
+		ib.vbo.OrphanAndUpdate(ib.data.Bytes())
+
+		sh.Enable()
+		vao.DrawInstanced(len(batch))
+		sh.Disable()
+	}
+
+	s.doRenderDirect(P, V, prevV, singles)
+}
+
+func (s *Scene) deleteInstanceBuffers() {
+	// the VBOs may already be gone together with the object VAOs owning them,
+	// VBO.Delete copes with that
+	for _, ib := range s.instanceBufs {
+		ib.vbo.Delete()
+	}
+	s.instanceBufs = make(map[*buffers.VAO]*instanceBuffer)
+}
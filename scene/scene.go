@@ -4,15 +4,19 @@ import (
 	gl "github.com/chsc/gogl/gl43"
 	//"github.com/jteeuwen/glfw"
 	//	"github.com/rwesterteiger/vectormath"
-	"log"
+	//"log"
 	//"github.com/rwesterteiger/go-gltest/buffers"
 	"github.com/rwesterteiger/go-gltest/geom"
 	"github.com/rwesterteiger/go-gltest/shader"
 	vmath "github.com/rwesterteiger/vectormath"
 	"github.com/rwesterteiger/go-gltest/gbuffer"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
+	"github.com/rwesterteiger/go-gltest/texture"
 	"github.com/rwesterteiger/go-gltest/buffers"
 	"github.com/rwesterteiger/go-gltest/post"
 	"github.com/rwesterteiger/go-gltest/lights"
+	"github.com/rwesterteiger/go-gltest/shadowmap"
+	"fmt"
 )
 
 const objVertexShaderSource = `
@@ -23,38 +27,61 @@ layout (location = 1) in vec3 normal;
 out vec4 vAmbient;
 out vec3 vEyeSpaceNormal;
 out vec4 vAlbedo;
+out vec2 vMaterial;
+out vec3 vEmissive;
+flat out uint vMaterialID;
+out vec3 vVelocity;
 
 layout (location = 0) uniform mat4 P;
 layout (location = 4) uniform mat4 V;
 layout (location = 8) uniform mat4 M;
 
 layout (location = 12) uniform vec4 diffuseColor;
+
+layout (location = 13) uniform mat4 prevM;
+layout (location = 17) uniform mat4 prevV;
+
+layout (location = 21) uniform vec2 material; // roughness, metalness
+layout (location = 22) uniform vec3 emissive;
+layout (location = 23) uniform uint materialID;
 		
 void main(void) {
-	gl_Position = P * V * M * vec4(vtx,1);
+	vec4 eyePos = V * M * vec4(vtx,1);
+	vec4 prevEyePos = prevV * prevM * vec4(vtx,1);
+
+	gl_Position = P * eyePos;
 	vEyeSpaceNormal = (V * M * vec4(normal, 0)).xyz;
 	vAlbedo = diffuseColor;
+	vMaterial = material;
+	vEmissive = emissive;
+	vMaterialID = materialID;
+	vVelocity = eyePos.xyz - prevEyePos.xyz;
 }
 `
 
-const objFragShaderSource = `
-#version 430
-
-#define M_PI (3.14159265358979323846)
-
-layout (location = 0) out vec4 fragAlbedo;
-layout (location = 1) out vec3 fragNormal;
-
-in vec3 vEyeSpaceNormal;
-in vec4 vAlbedo;
+// uniform locations of objVertexShaderSource; the instanced and indirect
+// variants share P, V and prevV
+const (
+	objUniformP = 0
+	objUniformV = 4
+	objUniformM = 8
+	objUniformDiffuseColor = 12
+	objUniformPrevM = 13
+	objUniformPrevV = 17
+	objUniformMaterial = 21
+	objUniformEmissive = 22
+	objUniformMaterialID = 23
+)
 
-void main(void)
-{
-	fragAlbedo = vAlbedo;
-	fragNormal = vEyeSpaceNormal;
-}
-`
+// RenderPath selects how Scene submits its objects. The default is
+// RenderPathDirect.
+type RenderPath int
 
+const (
+	RenderPathDirect RenderPath = iota // one draw call with uniform updates per object
+	RenderPathInstanced // objects sharing a mesh are drawn with a single instanced draw call
+	RenderPathIndirect // all objects are packed into shared buffers and drawn with one MultiDrawElementsIndirect call
+)
 
 type Scene struct {
 	w int
@@ -62,66 +89,77 @@ type Scene struct {
 
 	camProjMat vmath.Matrix4 
 	camViewMat vmath.Matrix4 
+	prevCamViewMat vmath.Matrix4 // for velocity
+	renderedFrames int
+
+	// kept to recompute camProjMat on resize
+	hasPerspective bool
+	camFovy, camNear, camFar float32
 
 	objects []*geom.Object
 	lights []lights.Light
 
+	shadowAtlas *shadowmap.Atlas // nil unless enabled by EnableShadowAtlas
+	shadowCachingDisabled bool
+
 	objShader *shader.Shader
 	gbuf *gbuffer.GBuffer
 
-	// scene is rendered into this for filtering
-	outputFBO gl.Uint
-	outputTex gl.Uint
+	renderPath RenderPath
+	objInstancedShader *shader.Shader
+	instanceBufs map[*buffers.VAO]*instanceBuffer
+	objIndirectShader *shader.Shader
+	meshPool *meshPool // built lazily, reset whenever objects are added
+
+	// transient targets of the lighting and post-processing passes
+	rtPool *rendertarget.Pool
 
 	postFilters []post.PostProcessFilter
 
 	fsQuadVAO *buffers.VAO
 	blitShader *shader.Shader	
-}
 
-func makeColorFBO(w, h int) (fbo gl.Uint, colorTex gl.Uint) {
-	gl.GenTextures(1, &colorTex)
-
-	gl.BindTexture(gl.TEXTURE_2D, colorTex);
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA16F, gl.Sizei(w), gl.Sizei(h), 0, gl.RGBA, gl.FLOAT, nil)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
-	gl.BindTexture(gl.TEXTURE_2D, 0)
-
-	gl.GenFramebuffers(1, &fbo)
-	gl.BindFramebuffer(gl.FRAMEBUFFER, fbo)
-	gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.TEXTURE_2D, colorTex, 0)
-	
-	drawBufs := []gl.Enum{ gl.COLOR_ATTACHMENT0 }
-	gl.DrawBuffers(1, &(drawBufs[0]))
-	
-	result := gl.CheckFramebufferStatus(gl.FRAMEBUFFER)
-
-	if result != gl.FRAMEBUFFER_COMPLETE {
-		log.Fatal("Error creating gbuffer FBO!")
-	}
+	captureDir string // set by CaptureNextFrame, cleared after the frame
 
-	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
-	return
+	debugView DebugView
+	debugIndex int
+	debugShader *shader.Shader
 }
 
 func Make(w, h int) (s *Scene) {
+	return MakeWithGBufferLayout(w, h, gbuffer.DefaultLayout())
+}
+
+// MakeWithGBufferLayout creates a scene whose G-buffer has the channels
+// described by layout. The object shaders write all of them.
+func MakeWithGBufferLayout(w, h int, layout *gbuffer.Layout) (s *Scene) {
 	s = new(Scene)
+	s.w, s.h = w, h
 
 	vmath.M4MakeIdentity(&s.camProjMat)
 	vmath.M4MakeIdentity(&s.camViewMat)
+	vmath.M4MakeIdentity(&s.prevCamViewMat)
+
+	s.gbuf = gbuffer.MakeWithLayout(w, h, layout)
+	objFragShaderSource := s.gbuf.GetLayout().FragmentShaderSource()
 
 	s.objShader = shader.Make()
 	s.objShader.AddShaderSource(objVertexShaderSource, gl.VERTEX_SHADER)
 	s.objShader.AddShaderSource(objFragShaderSource, gl.FRAGMENT_SHADER)
+	s.objShader.AddShaderSource(gbuffer.NormalCodecShaderSource, gl.FRAGMENT_SHADER)
 	s.objShader.Link()
 
-	s.gbuf = gbuffer.Make(w,h)
-	s.outputFBO, s.outputTex = makeColorFBO(w,h)
+	s.objInstancedShader = makeInstancedObjShader(objFragShaderSource)
+	s.instanceBufs = make(map[*buffers.VAO]*instanceBuffer)
+	s.objIndirectShader = makeIndirectObjShader(objFragShaderSource)
+
+	for _, sh := range []*shader.Shader{ s.objShader, s.objInstancedShader, s.objIndirectShader } {
+		s.gbuf.SetNormalCodecUniforms(sh)
+	}
+	s.rtPool = rendertarget.MakePool()
 	s.fsQuadVAO = makeFullscreenQuadVAO()
 	s.blitShader = makeBlitShader()
+	s.debugShader = makeDebugShader()
 	return
 }
 
@@ -183,49 +221,119 @@ func (s *Scene) Delete() {
 		l.Delete()
 	}
 
+	// the lights have released their tiles
+	if s.shadowAtlas != nil {
+		s.shadowAtlas.Delete()
+	}
+
 	for _,f := range s.postFilters {
 		f.Delete()
 	}
 
 	s.objShader.Delete()
+	s.objInstancedShader.Delete()
+	s.deleteInstanceBuffers()
+	s.objIndirectShader.Delete()
+	s.invalidateMeshPool()
 	s.gbuf.Delete()
+
+	s.rtPool.Delete()
+
 	s.fsQuadVAO.Delete()
 	s.blitShader.Delete()
+	s.debugShader.Delete()
 }
 
 func (s *Scene) AddObject(obj *geom.Object) {
 	s.objects = append(s.objects, obj)
+	s.invalidateMeshPool()
 }
 
 func (s *Scene) AddLight(light lights.Light) {
 	s.lights = append(s.lights, light)
+
+	if c, ok := light.(lights.AtlasShadowCaster); ok && s.shadowAtlas != nil {
+		c.UseShadowAtlas(s.shadowAtlas)
+	}
 }
 
 func (s *Scene) AddPostFilter(f post.PostProcessFilter) {
+	f.UsePool(s.rtPool)
 	s.postFilters = append(s.postFilters, f)
 }
 
 func (s *Scene) SetCameraPerspective(fovyRadians, aspect, zNear, zFar float32) {
 	vmath.M4MakePerspective(&s.camProjMat, fovyRadians, aspect, zNear, zFar)
+
+	s.hasPerspective = true
+	s.camFovy, s.camNear, s.camFar = fovyRadians, zNear, zFar
+}
+
+// Resize reallocates all screen-sized buffers for a w x h viewport and
+// updates the camera aspect ratio. Sizes of 0 (minimized window) are
+// ignored.
+func (s *Scene) Resize(w, h int) {
+	if w <= 0 || h <= 0 || (w == s.w && h == s.h) {
+		return
+	}
+
+	s.w, s.h = w, h
+	s.gbuf.Resize(w, h)
+
+	for _, f := range s.postFilters {
+		f.Resize(w, h)
+	}
+
+	// drop the targets of the old size right away instead of letting them idle out
+	s.rtPool.Purge()
+
+	if s.hasPerspective {
+		vmath.M4MakePerspective(&s.camProjMat, s.camFovy, float32(w) / float32(h), s.camNear, s.camFar)
+	}
+}
+
+func (s *Scene) GetSize() (w, h int) {
+	return s.w, s.h
 }
 
 func (s *Scene) SetCameraLookAt(eyePos, lookAtPos *vmath.Point3, upVec *vmath.Vector3) {
 	vmath.M4MakeLookAt(&s.camViewMat, eyePos, lookAtPos, upVec)
 }
 
-func (s *Scene) doRender(P, V *vmath.Matrix4) {
+func (s *Scene) SetRenderPath(p RenderPath) {
+	s.renderPath = p
+}
+
+// doRender draws all objects. prevV is the view matrix of the previous
+// frame, used for the velocity channel.
+func (s *Scene) doRender(P, V, prevV *vmath.Matrix4) {
+	switch s.renderPath {
+	case RenderPathInstanced:
+		s.doRenderInstanced(P, V, prevV)
+	case RenderPathIndirect:
+		s.doRenderIndirect(P, V, prevV)
+	default:
+		s.doRenderDirect(P, V, prevV, s.objects)
+	}
+}
+
+func (s *Scene) doRenderDirect(P, V, prevV *vmath.Matrix4, objects []*geom.Object) {
 	sh := s.objShader
-	sh.ProgramUniformM4(0, P)
-	sh.ProgramUniformM4(4, V)
-	
-	sh.BindFragDataLocation(0, "fragAlbedo")
-	sh.BindFragDataLocation(1, "fragNormal")
+	sh.ProgramUniformM4(objUniformP, P)
+	sh.ProgramUniformM4(objUniformV, V)
+	sh.ProgramUniformM4(objUniformPrevV, prevV)
 
 	sh.Enable()
 
-	for _, o := range s.objects {
-		sh.ProgramUniformM4(8, o.GetModelMatrix())
-		sh.ProgramUniformF4(12, o.GetDiffuseColor())
+	for _, o := range objects {
+		m := o.GetMaterial()
+
+		sh.ProgramUniformM4(objUniformM, o.GetModelMatrix())
+		sh.ProgramUniformF4(objUniformDiffuseColor, o.GetDiffuseColor())
+		sh.ProgramUniformM4(objUniformPrevM, o.GetPrevModelMatrix())
+		sh.ProgramUniform2f(objUniformMaterial, m.Roughness, m.Metalness)
+		sh.ProgramUniform3f(objUniformEmissive, m.Emissive.X, m.Emissive.Y, m.Emissive.Z)
+		sh.ProgramUniform1ui(objUniformMaterialID, m.ID)
 		o.Draw()
 	}
 
@@ -238,47 +346,95 @@ func (s *Scene) Render() {
 
 	gl.Enable(gl.DEPTH_TEST)
 
+	s.packShadowAtlas()
+
 	for _, l := range s.lights {
-		if l.NeedDepthPass() {
-			projMat, viewMat := l.BeginDepthPass()
-			s.doRender(projMat, viewMat)
-			l.EndDepthPass()
+		for pass := 0; pass < l.NumDepthPasses(); pass++ {
+			if s.depthPassCached(l, pass) {
+				continue
+			}
+
+			projMat, viewMat := l.BeginDepthPass(pass, &s.camProjMat, &s.camViewMat)
+			s.doRender(projMat, viewMat, viewMat)
+			l.EndDepthPass(pass)
 		}
 	}
 
 
+	if s.renderedFrames == 0 {
+		// no history yet, report zero camera motion
+		vmath.M4Copy(&s.prevCamViewMat, &s.camViewMat)
+	}
+
 	s.gbuf.Begin()
-	gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
-	s.doRender(&s.camProjMat, &s.camViewMat)
+	s.gbuf.Clear()
+	s.doRender(&s.camProjMat, &s.camViewMat, &s.prevCamViewMat)
 	s.gbuf.End()
+	s.gbuf.Resolve()
+
+	if s.capturing() {
+		s.captureGBuffer()
+	}
 
-	gl.BindFramebuffer(gl.FRAMEBUFFER, s.outputFBO)
+	// scene is rendered into this for filtering
+	output := s.rtPool.Acquire(s.w, s.h, gl.RGBA16F)
+	output.Bind()
 	gl.Clear(gl.COLOR_BUFFER_BIT)
 
 	gl.Disable(gl.DEPTH_TEST)
 	gl.Enable(gl.BLEND)
 	gl.BlendFunc(gl.ONE, gl.ONE)
 
-	for _, l := range s.lights {
-		l.Render(s.gbuf, &s.camProjMat, &s.camViewMat)
+	for i, l := range s.lights {
+		if s.renderLight(i) {
+			l.Render(s.gbuf, &s.camProjMat, &s.camViewMat)
+		}
 	}
 
 	gl.Disable(gl.BLEND)
 
 	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
 
-	tex := s.outputTex
+	if s.capturing() {
+		s.captureTexture("lighting", output.GetTexture(gl.COLOR_ATTACHMENT0))
+	}
+
+	for i, f := range s.activePostFilters() {
+		filtered := f.Apply(s.gbuf, output.GetTexture(gl.COLOR_ATTACHMENT0), &s.camProjMat, &s.camViewMat)
+		s.rtPool.Release(output)
+		output = filtered
 
-	for _, f := range s.postFilters {
-		tex = f.Apply(s.gbuf, tex, &s.camProjMat, &s.camViewMat)
+		if s.capturing() {
+			s.captureTexture(fmt.Sprintf("post%d", i), output.GetTexture(gl.COLOR_ATTACHMENT0))
+		}
 	}
 
 	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
 
-	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, tex)
-	s.blitShader.ProgramUniform1i(0,0)
-	s.blitShader.Enable()
-	s.fsQuadVAO.Draw()
-	s.blitShader.Disable()
+	if s.debugView != DebugViewNone {
+		s.drawDebugView(output.GetTexture(gl.COLOR_ATTACHMENT0))
+	} else {
+		texture.BindUnit(0, output.GetTexture(gl.COLOR_ATTACHMENT0), texture.GetSampler(texture.LinearClamp))
+		s.blitShader.ProgramUniform1i(0,0)
+		s.blitShader.Enable()
+		s.fsQuadVAO.Draw()
+		s.blitShader.Disable()
+		texture.UnbindUnit(0)
+	}
+
+	s.rtPool.Release(output)
+	s.rtPool.EndFrame()
+
+	for _, o := range s.objects {
+		o.EndFrame()
+	}
+	vmath.M4Copy(&s.prevCamViewMat, &s.camViewMat)
+	s.renderedFrames++
+	s.captureDir = ""
+}
+
+// GetRenderTargetPoolStats reports the memory used by the transient render
+// targets of the lighting and post-processing passes.
+func (s *Scene) GetRenderTargetPoolStats() rendertarget.PoolStats {
+	return s.rtPool.Stats()
 }
@@ -0,0 +1,157 @@
+package scene
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/lights"
+	"github.com/rwesterteiger/go-gltest/shadowmap"
+	vmath "github.com/rwesterteiger/vectormath"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// EnableShadowAtlas makes all lights implementing lights.AtlasShadowCaster,
+// present and future, share one size x size shadow map atlas instead of
+// rendering into maps of their own.
+func (s *Scene) EnableShadowAtlas(size int, format gl.Enum) {
+	if s.shadowAtlas != nil {
+		s.useShadowAtlas(nil)
+		s.shadowAtlas.Delete()
+	}
+
+	s.shadowAtlas = shadowmap.MakeAtlas(size, format)
+	s.useShadowAtlas(s.shadowAtlas)
+}
+
+// DisableShadowAtlas moves the shadows of all lights back into maps of their
+// own.
+func (s *Scene) DisableShadowAtlas() {
+	if s.shadowAtlas == nil {
+		return
+	}
+
+	s.useShadowAtlas(nil)
+	s.shadowAtlas.Delete()
+	s.shadowAtlas = nil
+}
+
+func (s *Scene) GetShadowAtlas() *shadowmap.Atlas {
+	return s.shadowAtlas
+}
+
+func (s *Scene) useShadowAtlas(a *shadowmap.Atlas) {
+	for _, l := range s.lights {
+		if c, ok := l.(lights.AtlasShadowCaster); ok {
+			c.UseShadowAtlas(a)
+		}
+	}
+}
+
+// packShadowAtlas sizes the atlas tiles by the importance of their lights
+// as seen from the current camera.
+func (s *Scene) packShadowAtlas() {
+	if s.shadowAtlas == nil {
+		return
+	}
+
+	for _, l := range s.lights {
+		if c, ok := l.(lights.AtlasShadowCaster); ok {
+			c.UpdateShadowImportance(&s.camProjMat, &s.camViewMat)
+		}
+	}
+
+	s.shadowAtlas.Pack()
+}
+
+// SetShadowCaching enables skipping the depth passes of lights implementing
+// lights.ShadowCache whose frustum contents did not change since they were
+// last rendered. It is on by default.
+func (s *Scene) SetShadowCaching(enabled bool) {
+	s.shadowCachingDisabled = !enabled
+}
+
+func (s *Scene) GetShadowCaching() bool {
+	return !s.shadowCachingDisabled
+}
+
+// depthPassCached reports whether depth pass pass of l can be skipped.
+func (s *Scene) depthPassCached(l lights.Light, pass int) bool {
+	c, ok := l.(lights.ShadowCache)
+	if !ok {
+		return false
+	}
+
+	if s.shadowCachingDisabled {
+		c.InvalidateShadowCache()
+		return false
+	}
+
+	projMat, viewMat := c.DepthPassMatrices(pass, &s.camProjMat, &s.camViewMat)
+	return c.DepthPassValid(pass, s.shadowSignature(projMat, viewMat))
+}
+
+// shadowSignature hashes everything a depth pass with P and V renders: the
+// matrices, and the index and revision of every object which may be inside
+// the frustum. Objects without bounds are always counted in.
+func (s *Scene) shadowSignature(P, V *vmath.Matrix4) uint64 {
+	var PV vmath.Matrix4
+	vmath.M4Mul(&PV, P, V)
+	planes := frustumPlanes(&PV)
+
+	h := fnv.New64a()
+	var buf [8]byte
+
+	for _, m := range []*vmath.Matrix4{ P, V } {
+		for col := 0; col < 4; col++ {
+			for row := 0; row < 4; row++ {
+				binary.LittleEndian.PutUint32(buf[:4], math.Float32bits(m.GetElem(col, row)))
+				h.Write(buf[:4])
+			}
+		}
+	}
+
+	for i, o := range s.objects {
+		if center, radius, ok := o.GetBounds(); ok && !sphereInFrustum(&planes, &center, radius) {
+			continue
+		}
+
+		binary.LittleEndian.PutUint64(buf[:], uint64(i))
+		h.Write(buf[:])
+		binary.LittleEndian.PutUint64(buf[:], o.GetRevision())
+		h.Write(buf[:])
+	}
+
+	return h.Sum64()
+}
+
+// frustumPlanes extracts the six planes of the frustum of PV, normals
+// pointing inwards, xyz normalized.
+func frustumPlanes(PV *vmath.Matrix4) (planes [6]vmath.Vector4) {
+	row := func(r int) vmath.Vector4 {
+		return vmath.Vector4{ PV.GetElem(0, r), PV.GetElem(1, r), PV.GetElem(2, r), PV.GetElem(3, r) }
+	}
+
+	r3 := row(3)
+	for i := 0; i < 3; i++ {
+		ri := row(i)
+		planes[2*i] = vmath.Vector4{ r3.X + ri.X, r3.Y + ri.Y, r3.Z + ri.Z, r3.W + ri.W }
+		planes[2*i+1] = vmath.Vector4{ r3.X - ri.X, r3.Y - ri.Y, r3.Z - ri.Z, r3.W - ri.W }
+	}
+
+	for i := range planes {
+		p := &planes[i]
+		l := (&vmath.Vector3{ p.X, p.Y, p.Z }).Length()
+		p.X, p.Y, p.Z, p.W = p.X / l, p.Y / l, p.Z / l, p.W / l
+	}
+
+	return
+}
+
+func sphereInFrustum(planes *[6]vmath.Vector4, center *vmath.Point3, radius float32) bool {
+	for _, p := range planes {
+		if p.X * center.X + p.Y * center.Y + p.Z * center.Z + p.W < -radius {
+			return false
+		}
+	}
+	return true
+}
@@ -1,9 +1,11 @@
 package shader
 import (
 	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/gldebug"
 	vmath "github.com/rwesterteiger/vectormath"
 	"fmt"
 	"log"
+	"strings"
 )
 
 type Shader struct {
@@ -12,6 +14,7 @@ type Shader struct {
 
 func Make() (*Shader) {
 	s := &Shader{ program : gl.CreateProgram() }
+	gldebug.Track(gldebug.Program, s.program)
 
 	return s
 }
@@ -37,7 +40,31 @@ func (s *Shader) AddShaderSource(src string, sType gl.Enum) {
 	gl.AttachShader(s.program, obj)
 }
 
+// AddShaderSourceWithDefines is AddShaderSource with a #define line for
+// each of defines (e.g. "MSAA" or "SAMPLES 4") inserted after the #version
+// directive, for compiling variants of one source.
+func (s *Shader) AddShaderSourceWithDefines(src string, sType gl.Enum, defines ...string) {
+	var header string
+	for _, d := range defines {
+		header += "#define " + d + "\n"
+	}
+
+	// #version has to stay the first directive
+	pos := 0
+	if v := strings.Index(src, "#version"); v >= 0 {
+		if nl := strings.Index(src[v:], "\n"); nl >= 0 {
+			pos = v + nl + 1
+		} else {
+			pos = len(src)
+			header = "\n" + header
+		}
+	}
+
+	s.AddShaderSource(src[:pos] + header + src[pos:], sType)
+}
+
 func (s *Shader) Delete() {
+	gldebug.Untrack(gldebug.Program, s.program)
 	gl.DeleteProgram(s.program)
 }
 
@@ -115,3 +142,7 @@ func (s *Shader) ProgramUniform1i(location int, x int) {
 	gl.ProgramUniform1i(s.program, gl.Int(location), gl.Int(x))
 }
 
+
+func (s *Shader) ProgramUniform1ui(location int, x uint32) {
+	gl.ProgramUniform1ui(s.program, gl.Int(location), gl.Uint(x))
+}
@@ -0,0 +1,94 @@
+package shadowmap
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
+	"log"
+)
+
+// Array is a set of equally sized shadow maps stored in the layers of one
+// gl.TEXTURE_2D_ARRAY, e.g. the cascades of a directional light. Shaders
+// sample it with a sampler2DArrayShadow.
+type Array struct {
+	size int
+	format gl.Enum
+	bias Bias
+	rts []*rendertarget.RenderTarget // one per layer, the first owns the texture
+}
+
+// MakeArray creates layers size x size shadow maps, see Make for the
+// supported formats.
+func MakeArray(size int, format gl.Enum, layers int) (a *Array) {
+	checkSizeAndFormat(size, format)
+
+	if layers <= 0 {
+		log.Fatalf("Invalid shadowmap layer count %d", layers)
+	}
+
+	a = &Array{ size : size, format : format, bias : DefaultBias }
+
+	first, err := rendertarget.Make(size, size, rendertarget.Attachment{ Point : gl.DEPTH_ATTACHMENT, Format : format, Layers : layers })
+	if err != nil {
+		log.Fatal("Error creating shadowmap array FBO: ", err)
+	}
+	a.rts = append(a.rts, first)
+
+	tex := first.GetTexture(gl.DEPTH_ATTACHMENT)
+	for i := 1; i < layers; i++ {
+		rt, err := rendertarget.Make(size, size, rendertarget.Attachment{ Point : gl.DEPTH_ATTACHMENT, Texture : tex, Target : gl.TEXTURE_2D_ARRAY, Layer : i })
+		if err != nil {
+			log.Fatal("Error creating shadowmap array FBO: ", err)
+		}
+		a.rts = append(a.rts, rt)
+	}
+
+	return
+}
+
+func (a *Array) Delete() {
+	// the first target owns the texture, so it goes last
+	for i := len(a.rts) - 1; i >= 0; i-- {
+		a.rts[i].Delete()
+	}
+}
+
+func (a *Array) GetDepthTex() gl.Uint {
+	return a.rts[0].GetTexture(gl.DEPTH_ATTACHMENT)
+}
+
+func (a *Array) GetLayers() int {
+	return len(a.rts)
+}
+
+func (a *Array) GetSize() int {
+	return a.size
+}
+
+func (a *Array) GetFormat() gl.Enum {
+	return a.format
+}
+
+func (a *Array) GetTexelSize() float32 {
+	return 1.0 / float32(a.size)
+}
+
+func (a *Array) GetBias() Bias {
+	return a.bias
+}
+
+func (a *Array) SetBias(b Bias) {
+	a.bias = b
+}
+
+// BeginDepthPass binds and clears layer and enables the slope-scaled bias.
+func (a *Array) BeginDepthPass(layer int) {
+	a.rts[layer].Bind()
+	gl.Clear(gl.DEPTH_BUFFER_BIT)
+
+	a.bias.enableSlopeScale()
+}
+
+func (a *Array) EndDepthPass() {
+	gl.Disable(gl.POLYGON_OFFSET_FILL)
+	rendertarget.Unbind()
+}
@@ -0,0 +1,258 @@
+package shadowmap
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
+	"log"
+	"sort"
+)
+
+// Target is a 2D shadow map a light renders into and samples: a ShadowMap
+// of its own or a tile of an Atlas.
+type Target interface {
+	GetDepthTex() gl.Uint
+
+	// GetTexelSize returns the size of one texel of the whole texture in
+	// texture coordinates.
+	GetTexelSize() float32
+
+	// GetUVTransform returns how coordinates in [0,1] of the shadow map map
+	// into the texture: uv * scale + offset.
+	GetUVTransform() (offsetX, offsetY, scale float32)
+
+	GetBias() Bias
+	SetBias(b Bias)
+
+	BeginDepthPass()
+	EndDepthPass()
+}
+
+func (s *ShadowMap) GetUVTransform() (offsetX, offsetY, scale float32) {
+	return 0, 0, 1
+}
+
+// Atlas is one large depth texture shared by the shadow maps of many lights,
+// each rendering into a square tile. Pack sizes the tiles by the importance
+// of their lights and places them with a buddy allocator, so tiles are
+// powers of two in size and aligned to their size.
+type Atlas struct {
+	size int
+	format gl.Enum
+	minTile, maxTile int
+	rt *rendertarget.RenderTarget
+	tiles []*AtlasTile // in the order they were made
+}
+
+// AtlasTile is the part of an Atlas one shadow map renders into. Its size
+// and position change only with Atlas.Pack.
+type AtlasTile struct {
+	atlas *Atlas
+	x, y, size int // size 0 if the tile did not fit
+	importance float32
+	revision uint64 // bumped whenever the tile moves
+	bias Bias
+}
+
+// MakeAtlas creates a size x size atlas, size being a power of two; see Make
+// for the supported formats.
+func MakeAtlas(size int, format gl.Enum) (a *Atlas) {
+	checkSizeAndFormat(size, format)
+
+	if size & (size - 1) != 0 {
+		log.Fatalf("Shadowmap atlas size %d is not a power of two", size)
+	}
+
+	a = &Atlas{ size : size, format : format, minTile : 128, maxTile : size / 2 }
+	if a.minTile > a.maxTile {
+		a.minTile = a.maxTile
+	}
+
+	var err error
+	a.rt, err = rendertarget.Make(size, size, rendertarget.Attachment{ Point : gl.DEPTH_ATTACHMENT, Format : format })
+
+	if err != nil {
+		log.Fatal("Error creating shadowmap atlas FBO: ", err)
+	}
+
+	return
+}
+
+func (a *Atlas) Delete() {
+	a.rt.Delete()
+}
+
+func (a *Atlas) GetDepthTex() gl.Uint {
+	return a.rt.GetTexture(gl.DEPTH_ATTACHMENT)
+}
+
+func (a *Atlas) GetSize() int {
+	return a.size
+}
+
+func (a *Atlas) GetFormat() gl.Enum {
+	return a.format
+}
+
+// SetTileSizeRange limits the tile sizes, both powers of two. Tiles of
+// importance 1 get max texels, tiles which do not fit at min get none.
+func (a *Atlas) SetTileSizeRange(min, max int) {
+	if min <= 0 || min & (min - 1) != 0 || max & (max - 1) != 0 || min > max || max > a.size {
+		log.Fatalf("Invalid shadowmap atlas tile size range %d to %d", min, max)
+	}
+
+	a.minTile, a.maxTile = min, max
+}
+
+// NewTile adds a tile to the atlas; it gets space with the next Pack.
+func (a *Atlas) NewTile() (t *AtlasTile) {
+	t = &AtlasTile{ atlas : a, importance : 1, bias : DefaultBias }
+	a.tiles = append(a.tiles, t)
+	return
+}
+
+// wantedSize returns the power of two tile size for importance.
+func (a *Atlas) wantedSize(importance float32) int {
+	size := a.minTile
+	for size < a.maxTile && float32(size) < importance * float32(a.maxTile) {
+		size *= 2
+	}
+	return size
+}
+
+// Pack assigns space to all tiles. Larger tiles are placed first; tiles of
+// equal size keep the order they were made in, so that tiles only move when
+// some tile changes size. Tiles which do not fit are shrunk down to the
+// minimum size, then left without space.
+func (a *Atlas) Pack() {
+	wanted := make([]int, len(a.tiles))
+	order := make([]int, len(a.tiles))
+	for i, t := range a.tiles {
+		wanted[i] = a.wantedSize(t.importance)
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return wanted[order[i]] > wanted[order[j]]
+	})
+
+	// free blocks by size
+	free := map[int][][2]int{ a.size : { { 0, 0 } } }
+
+	for _, i := range order {
+		t := a.tiles[i]
+
+		x, y, size := 0, 0, wanted[i]
+		for ; size >= a.minTile; size /= 2 {
+			var ok bool
+			if x, y, ok = a.allocate(free, size); ok {
+				break
+			}
+		}
+
+		if size < a.minTile {
+			x, y, size = 0, 0, 0
+		}
+
+		if x != t.x || y != t.y || size != t.size {
+			t.x, t.y, t.size = x, y, size
+			t.revision++
+		}
+	}
+}
+
+// allocate takes a size x size block from free, splitting larger blocks
+// into quarters as needed.
+func (a *Atlas) allocate(free map[int][][2]int, size int) (x, y int, ok bool) {
+	if size > a.size {
+		return
+	}
+
+	if blocks := free[size]; len(blocks) > 0 {
+		free[size] = blocks[1:]
+		return blocks[0][0], blocks[0][1], true
+	}
+
+	if x, y, ok = a.allocate(free, 2 * size); !ok {
+		return
+	}
+
+	free[size] = append(free[size], [2]int{ x + size, y }, [2]int{ x, y + size }, [2]int{ x + size, y + size })
+	return
+}
+
+// Release removes t from its atlas.
+func (t *AtlasTile) Release() {
+	tiles := t.atlas.tiles
+	for i := range tiles {
+		if tiles[i] == t {
+			t.atlas.tiles = append(tiles[:i], tiles[i+1:]...)
+			break
+		}
+	}
+}
+
+// SetImportance sets how much of the atlas the tile should get with the
+// next Pack, in [0,1].
+func (t *AtlasTile) SetImportance(importance float32) {
+	t.importance = importance
+}
+
+func (t *AtlasTile) GetImportance() float32 {
+	return t.importance
+}
+
+// IsAllocated reports whether the last Pack found space for the tile.
+func (t *AtlasTile) IsAllocated() bool {
+	return t.size > 0
+}
+
+// GetRect returns the texel position and size of the tile.
+func (t *AtlasTile) GetRect() (x, y, size int) {
+	return t.x, t.y, t.size
+}
+
+// GetRevision returns a counter which changes whenever the tile moves, which
+// invalidates its contents.
+func (t *AtlasTile) GetRevision() uint64 {
+	return t.revision
+}
+
+func (t *AtlasTile) GetDepthTex() gl.Uint {
+	return t.atlas.GetDepthTex()
+}
+
+func (t *AtlasTile) GetTexelSize() float32 {
+	return 1.0 / float32(t.atlas.size)
+}
+
+func (t *AtlasTile) GetUVTransform() (offsetX, offsetY, scale float32) {
+	n := float32(t.atlas.size)
+	return float32(t.x) / n, float32(t.y) / n, float32(t.size) / n
+}
+
+func (t *AtlasTile) GetBias() Bias {
+	return t.bias
+}
+
+func (t *AtlasTile) SetBias(b Bias) {
+	t.bias = b
+}
+
+// BeginDepthPass binds the atlas with viewport and scissor set to the tile,
+// clears the tile and enables the slope-scaled bias.
+func (t *AtlasTile) BeginDepthPass() {
+	t.atlas.rt.Bind()
+
+	gl.Viewport(gl.Int(t.x), gl.Int(t.y), gl.Sizei(t.size), gl.Sizei(t.size))
+	gl.Enable(gl.SCISSOR_TEST)
+	gl.Scissor(gl.Int(t.x), gl.Int(t.y), gl.Sizei(t.size), gl.Sizei(t.size))
+	gl.Clear(gl.DEPTH_BUFFER_BIT)
+
+	t.bias.enableSlopeScale()
+}
+
+func (t *AtlasTile) EndDepthPass() {
+	gl.Disable(gl.POLYGON_OFFSET_FILL)
+	gl.Disable(gl.SCISSOR_TEST)
+	rendertarget.Unbind()
+}
@@ -0,0 +1,88 @@
+package shadowmap
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
+	"log"
+)
+
+// Cube is an omnidirectional shadow map stored in the six faces of one
+// gl.TEXTURE_CUBE_MAP, in the order of gl.TEXTURE_CUBE_MAP_POSITIVE_X and
+// following. Shaders sample it with a samplerCubeShadow.
+type Cube struct {
+	size int
+	format gl.Enum
+	bias Bias
+	rts [6]*rendertarget.RenderTarget // one per face, the first owns the texture
+}
+
+// MakeCube creates a cube shadow map with size x size faces, see Make for
+// the supported formats.
+func MakeCube(size int, format gl.Enum) (c *Cube) {
+	checkSizeAndFormat(size, format)
+
+	c = &Cube{ size : size, format : format, bias : DefaultBias }
+
+	var err error
+	c.rts[0], err = rendertarget.Make(size, size, rendertarget.Attachment{ Point : gl.DEPTH_ATTACHMENT, Format : format, Cube : true })
+	if err != nil {
+		log.Fatal("Error creating shadowmap cube FBO: ", err)
+	}
+
+	tex := c.rts[0].GetTexture(gl.DEPTH_ATTACHMENT)
+	for i := 1; i < len(c.rts); i++ {
+		c.rts[i], err = rendertarget.Make(size, size, rendertarget.Attachment{ Point : gl.DEPTH_ATTACHMENT, Texture : tex, Target : gl.TEXTURE_CUBE_MAP, Layer : i })
+		if err != nil {
+			log.Fatal("Error creating shadowmap cube FBO: ", err)
+		}
+	}
+
+	// filter across face edges instead of clamping at them
+	gl.Enable(gl.TEXTURE_CUBE_MAP_SEAMLESS)
+
+	return
+}
+
+func (c *Cube) Delete() {
+	// the first target owns the texture, so it goes last
+	for i := len(c.rts) - 1; i >= 0; i-- {
+		c.rts[i].Delete()
+	}
+}
+
+func (c *Cube) GetDepthTex() gl.Uint {
+	return c.rts[0].GetTexture(gl.DEPTH_ATTACHMENT)
+}
+
+func (c *Cube) GetSize() int {
+	return c.size
+}
+
+func (c *Cube) GetFormat() gl.Enum {
+	return c.format
+}
+
+func (c *Cube) GetTexelSize() float32 {
+	return 1.0 / float32(c.size)
+}
+
+func (c *Cube) GetBias() Bias {
+	return c.bias
+}
+
+func (c *Cube) SetBias(b Bias) {
+	c.bias = b
+}
+
+// BeginDepthPass binds and clears face and enables the slope-scaled bias.
+func (c *Cube) BeginDepthPass(face int) {
+	c.rts[face].Bind()
+	gl.Clear(gl.DEPTH_BUFFER_BIT)
+
+	c.bias.enableSlopeScale()
+}
+
+func (c *Cube) EndDepthPass() {
+	gl.Disable(gl.POLYGON_OFFSET_FILL)
+	rendertarget.Unbind()
+}
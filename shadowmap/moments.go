@@ -0,0 +1,265 @@
+package shadowmap
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/buffers"
+	"github.com/rwesterteiger/go-gltest/post"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
+	"github.com/rwesterteiger/go-gltest/shader"
+	"github.com/rwesterteiger/go-gltest/texture"
+	vmath "github.com/rwesterteiger/vectormath"
+	"log"
+)
+
+// Filter selects how a light filters its shadow map.
+type Filter int
+
+const (
+	FilterPCF Filter = iota // depth compares of the shadow map itself
+	FilterVSM // variance shadow maps, from blurred depth and squared depth
+	FilterESM // exponential shadow maps, from blurred exp(c * depth)
+	FilterPCSS // percentage-closer soft shadows, penumbrae growing with the distance to the blocker
+)
+
+func (f Filter) String() string {
+	switch f {
+	case FilterPCF:
+		return "PCF"
+	case FilterVSM:
+		return "VSM"
+	case FilterESM:
+		return "ESM"
+	case FilterPCSS:
+		return "PCSS"
+	}
+
+	return "unknown"
+}
+
+// Default parameters of new Moments, see the setters.
+const (
+	DefaultESMExponent = 80
+	DefaultLightBleedReduction = 0.2
+	DefaultMomentBlurPasses = 1
+)
+
+const momentsVtxShaderSrc = `
+	#version 430
+	layout (location = 0) in vec2 vtx;
+
+	void main(void) {
+		gl_Position = vec4(vtx.xy, 0, 1);
+	}
+	`
+
+// momentsFragShaderSrc converts a perspective shadow map into moments of
+// linear depth in [0,1] between the near and the far plane.
+const momentsFragShaderSrc = `
+	#version 430
+	layout (location = 0) out vec4 fragData;
+
+	layout (location = 0) uniform sampler2D depthTex;
+	layout (location = 1) uniform vec2 nearFar;
+	layout (location = 2) uniform int mode; // Filter
+	layout (location = 3) uniform float exponent;
+
+	void main(void) {
+		float z = texelFetch(depthTex, ivec2(gl_FragCoord.xy), 0).x;
+
+		float near = nearFar.x, far = nearFar.y;
+		float eyeDepth = 2 * near * far / (far + near - (2 * z - 1) * (far - near));
+		float d = (eyeDepth - near) / (far - near);
+
+		if (mode == 2) {
+			fragData = vec4(exp(exponent * d), 0, 0, 0);
+		} else {
+			fragData = vec4(d, d * d, 0, 0);
+		}
+	}
+	`
+
+// MomentsShaderSource is a fragment shader object providing
+//
+//	float momentShadow(vec2 tc, float eyeDepth);
+//
+// for lights filtering shadows with Moments, to be attached next to their own
+// fragment shader. tc is the shadow map coordinate and eyeDepth the distance
+// of the receiver along the view axis of the light. It reads the moments
+// bound by Moments.SetUniforms.
+const MomentsShaderSource = `
+#version 430
+
+layout (location = 110) uniform sampler2D momentTex;
+layout (location = 111) uniform int momentFilter; // shadowmap.Filter
+layout (location = 112) uniform vec2 momentNearFar;
+layout (location = 113) uniform float momentExponent;
+layout (location = 114) uniform float lightBleedReduction;
+
+float momentShadow(vec2 tc, float eyeDepth) {
+	float d = (eyeDepth - momentNearFar.x) / (momentNearFar.y - momentNearFar.x);
+	vec2 m = texture(momentTex, tc).xy;
+
+	if (momentFilter == 2) {
+		return clamp(m.x * exp(-momentExponent * d), 0, 1);
+	}
+
+	if (d <= m.x) {
+		return 1.0;
+	}
+
+	// Chebyshev upper bound of the lit fraction
+	float variance = max(m.y - m.x * m.x, 0.00002);
+	float delta = d - m.x;
+	float p = variance / (variance + delta * delta);
+
+	// cut off the tail of p, which shows as light bleeding between casters
+	return clamp((p - lightBleedReduction) / (1 - lightBleedReduction), 0, 1);
+}
+`
+
+const momentsUniformLocation = 110
+
+// Moments holds the filterable moments of a shadow map for variance and
+// exponential shadow maps, blurred with post.GaussianBlur.
+type Moments struct {
+	filter Filter
+	near, far float32
+	exponent float32
+	lightBleedReduction float32
+	blurPasses int
+
+	rt, tmp *rendertarget.RenderTarget
+	shader *shader.Shader
+	blur *post.GaussianBlur
+	fsQuadVAO *buffers.VAO
+}
+
+// MakeMoments creates size x size moments for filter, FilterVSM or
+// FilterESM.
+func MakeMoments(size int, filter Filter) (m *Moments) {
+	var format gl.Enum
+	switch filter {
+	case FilterVSM:
+		format = gl.RG32F
+	case FilterESM:
+		format = gl.R32F
+	default:
+		log.Fatalf("Shadow filter %v does not use moments", filter)
+	}
+
+	m = &Moments{ filter : filter, exponent : DefaultESMExponent, lightBleedReduction : DefaultLightBleedReduction, blurPasses : DefaultMomentBlurPasses }
+
+	var err error
+	if m.rt, err = rendertarget.Make(size, size, rendertarget.Attachment{ Point : gl.COLOR_ATTACHMENT0, Format : format }); err != nil {
+		log.Fatal("Error creating shadowmap moments FBO: ", err)
+	}
+	if m.tmp, err = rendertarget.Make(size, size, rendertarget.Attachment{ Point : gl.COLOR_ATTACHMENT0, Format : format }); err != nil {
+		log.Fatal("Error creating shadowmap moments FBO: ", err)
+	}
+
+	m.shader = shader.Make()
+	m.shader.AddShaderSource(momentsVtxShaderSrc, gl.VERTEX_SHADER)
+	m.shader.AddShaderSource(momentsFragShaderSrc, gl.FRAGMENT_SHADER)
+	m.shader.Link()
+
+	m.blur = post.MakeGaussianBlur()
+
+	vtxs := buffers.MakeVBOFromVec2s([]vmath.Vector2{ {-1, -1}, {1, -1}, {1, 1}, {-1, 1} })
+	indices := []uint32{ 0, 1, 2, 2, 3, 0 }
+
+	m.fsQuadVAO = buffers.MakeVAO(gl.TRIANGLES, 6)
+	m.fsQuadVAO.AttachVBO(0, vtxs)
+	m.fsQuadVAO.SetIndexBuffer(indices)
+
+	return
+}
+
+func (m *Moments) Delete() {
+	m.rt.Delete()
+	m.tmp.Delete()
+	m.shader.Delete()
+	m.blur.Delete()
+	m.fsQuadVAO.Delete()
+}
+
+func (m *Moments) GetFilter() Filter {
+	return m.filter
+}
+
+func (m *Moments) GetTexture() gl.Uint {
+	return m.rt.GetTexture(gl.COLOR_ATTACHMENT0)
+}
+
+// SetExponent sets c of ESM; larger values give sharper contact shadows
+// but overflow sooner.
+func (m *Moments) SetExponent(c float32) {
+	m.exponent = c
+}
+
+func (m *Moments) GetExponent() float32 {
+	return m.exponent
+}
+
+// SetLightBleedReduction sets the fraction of the VSM visibility which is
+// treated as shadow, in [0,1).
+func (m *Moments) SetLightBleedReduction(amount float32) {
+	m.lightBleedReduction = amount
+}
+
+func (m *Moments) GetLightBleedReduction() float32 {
+	return m.lightBleedReduction
+}
+
+// SetBlurPasses sets how often the moments are blurred, 0 for none.
+func (m *Moments) SetBlurPasses(n int) {
+	m.blurPasses = n
+}
+
+func (m *Moments) GetBlurPasses() int {
+	return m.blurPasses
+}
+
+// Update computes the moments of depthTex, a shadow map rendered with a
+// perspective projection with the given near and far plane, and blurs them.
+func (m *Moments) Update(depthTex gl.Uint, near, far float32) {
+	m.near, m.far = near, far
+
+	m.rt.Bind()
+
+	texture.BindUnit(0, depthTex, texture.GetSampler(texture.NearestClamp))
+	m.shader.ProgramUniform1i(0, 0)
+	m.shader.ProgramUniform2f(1, near, far)
+	m.shader.ProgramUniform1i(2, int(m.filter))
+	m.shader.ProgramUniform1f(3, m.exponent)
+
+	m.shader.Enable()
+	m.fsQuadVAO.Draw()
+	m.shader.Disable()
+
+	texture.UnbindUnit(0)
+
+	for i := 0; i < m.blurPasses; i++ {
+		m.blur.Apply(m.rt, m.tmp)
+	}
+
+	rendertarget.Unbind()
+}
+
+// SetUniforms binds the moments for the MomentsShaderSource part of s to
+// unit.
+func (m *Moments) SetUniforms(s *shader.Shader, unit int) {
+	texture.BindUnit(unit, m.GetTexture(), texture.GetSampler(texture.LinearClamp))
+	s.ProgramUniform1i(momentsUniformLocation, unit)
+	s.ProgramUniform1i(momentsUniformLocation + 1, int(m.filter))
+	s.ProgramUniform2f(momentsUniformLocation + 2, m.near, m.far)
+	s.ProgramUniform1f(momentsUniformLocation + 3, m.exponent)
+	s.ProgramUniform1f(momentsUniformLocation + 4, m.lightBleedReduction)
+}
+
+// SetNoMomentsUniforms points the moments sampler of the MomentsShaderSource
+// part of s at unit for lights without moments; the default unit 0 may be
+// taken by a sampler of another type, which fails the draw.
+func SetNoMomentsUniforms(s *shader.Shader, unit int) {
+	s.ProgramUniform1i(momentsUniformLocation, unit)
+	s.ProgramUniform1i(momentsUniformLocation + 1, int(FilterPCF))
+}
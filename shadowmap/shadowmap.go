@@ -2,67 +2,149 @@ package shadowmap
 
 import (
 	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/rendertarget"
 	//vmath "github.com/rwesterteiger/vectormath"
 	"log"
 )
 
-type ShadowMap struct {
-	shadowTex gl.Uint 
-	fbo gl.Uint
+// Quality maps to a shadow map size and depth format.
+type Quality int
+
+const (
+	QualityLow Quality = iota // 512 x 512, 16 bit depth
+	QualityMedium // 1024 x 1024, 24 bit depth
+	QualityHigh // 2048 x 2048, 32 bit float depth
+)
+
+// Settings returns the shadow map size and depth format of q.
+func (q Quality) Settings() (size int, format gl.Enum) {
+	switch q {
+	case QualityLow:
+		return 512, gl.DEPTH_COMPONENT16
+	case QualityHigh:
+		return 2048, gl.DEPTH_COMPONENT32F
+	}
+
+	return 1024, gl.DEPTH_COMPONENT24
 }
 
-func Make() (s *ShadowMap) {
-	s = new(ShadowMap)
-	gl.GenTextures(1, &s.shadowTex)
+func (q Quality) String() string {
+	switch q {
+	case QualityLow:
+		return "low"
+	case QualityMedium:
+		return "medium"
+	case QualityHigh:
+		return "high"
+	}
+
+	return "unknown"
+}
 
-	gl.BindTexture(gl.TEXTURE_2D, s.shadowTex);
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.DEPTH_COMPONENT, 512, 512, 0, gl.DEPTH_COMPONENT, gl.FLOAT, nil)
+// Bias holds the parameters fighting shadow acne. Too little bias lets
+// surfaces shadow themselves, too much detaches shadows from their casters
+// (peter-panning).
+type Bias struct {
+	Constant float32 // subtracted from the receiver depth at lookup, in [0,1] depth units
+	SlopeScale float32 // glPolygonOffset factor applied during the depth pass
+	SlopeUnits float32 // glPolygonOffset units applied during the depth pass
+	NormalOffset float32 // receivers are moved along their normal by this many shadow map texels
+}
 
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+var DefaultBias = Bias{ Constant : 0.001, SlopeScale : 1.5, SlopeUnits : 2, NormalOffset : 1 }
 
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_BORDER)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_BORDER)
-	borderColor := []gl.Float{ 0, 0, 0, 0 }
-	gl.TexParameterfv(gl.TEXTURE_2D, gl.TEXTURE_BORDER_COLOR, &(borderColor[0]))
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_COMPARE_MODE, gl.COMPARE_REF_TO_TEXTURE);
-	// gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_COMPARE_FUNC, gl.LEQUAL);
+type ShadowMap struct {
+	size int
+	format gl.Enum
+	bias Bias
+	rt *rendertarget.RenderTarget
+}
 
-	gl.BindTexture(gl.TEXTURE_2D, 0)
+// Make creates a size x size shadow map with the given depth format, one of
+// gl.DEPTH_COMPONENT16, gl.DEPTH_COMPONENT24 and gl.DEPTH_COMPONENT32F.
+func Make(size int, format gl.Enum) (s *ShadowMap) {
+	checkSizeAndFormat(size, format)
 
-	gl.GenFramebuffers(1, &s.fbo)
-	gl.BindFramebuffer(gl.FRAMEBUFFER, s.fbo)
-	gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.DEPTH_ATTACHMENT, gl.TEXTURE_2D, s.shadowTex, 0)
-	gl.DrawBuffer(gl.NONE)
+	s = &ShadowMap{ size : size, format : format, bias : DefaultBias }
 
-	result := gl.CheckFramebufferStatus(gl.FRAMEBUFFER)
+	// filtering and depth compare state come from texture.ShadowCompare
+	var err error
+	s.rt, err = rendertarget.Make(size, size, rendertarget.Attachment{ Point : gl.DEPTH_ATTACHMENT, Format : format })
 
-	if result != gl.FRAMEBUFFER_COMPLETE {
-		log.Fatal("Error creating shadowmap FBO!")
+	if err != nil {
+		log.Fatal("Error creating shadowmap FBO: ", err)
 	}
 
-	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
 	return
 }
 
+func checkSizeAndFormat(size int, format gl.Enum) {
+	switch format {
+	case gl.DEPTH_COMPONENT16, gl.DEPTH_COMPONENT24, gl.DEPTH_COMPONENT32F:
+	default:
+		log.Fatalf("Unsupported shadowmap format 0x%x", int(format))
+	}
+
+	if size <= 0 {
+		log.Fatalf("Invalid shadowmap size %d", size)
+	}
+}
+
+func MakeWithQuality(q Quality) (s *ShadowMap) {
+	return Make(q.Settings())
+}
+
 func (s *ShadowMap) Delete() {
-	gl.DeleteTextures(1, &s.shadowTex)
-	gl.DeleteFramebuffers(1, &s.fbo)
+	s.rt.Delete()
 }
 
 func (s *ShadowMap) GetDepthTex() gl.Uint {
-	return s.shadowTex
+	return s.rt.GetTexture(gl.DEPTH_ATTACHMENT)
+}
+
+func (s *ShadowMap) GetSize() int {
+	return s.size
+}
+
+func (s *ShadowMap) GetFormat() gl.Enum {
+	return s.format
+}
+
+// GetTexelSize returns the size of one texel in texture coordinates, for
+// filter kernels.
+func (s *ShadowMap) GetTexelSize() float32 {
+	return 1.0 / float32(s.size)
+}
+
+func (s *ShadowMap) GetBias() Bias {
+	return s.bias
+}
+
+// SetBias sets the bias; the slope-scaled part takes effect with the next
+// depth pass, the others are up to the light reading the map.
+func (s *ShadowMap) SetBias(b Bias) {
+	s.bias = b
 }
 
+// BeginDepthPass binds and clears the shadow map and enables the
+// slope-scaled bias; the viewport follows its size.
 func (s *ShadowMap) BeginDepthPass() {
-	gl.BindFramebuffer(gl.FRAMEBUFFER, s.fbo);
-	gl.Viewport(0, 0, 512, 512)
+	s.rt.Bind()
 	//gl.ClearDepth(0.0)
 	gl.Clear(gl.DEPTH_BUFFER_BIT)
 	//gl.ClearDepth(1.0)
+
+	s.bias.enableSlopeScale()
 }
 
 func (s *ShadowMap) EndDepthPass() {
-	gl.BindFramebuffer(gl.FRAMEBUFFER, 0);
+	gl.Disable(gl.POLYGON_OFFSET_FILL)
+	rendertarget.Unbind()
 }
 
+func (b *Bias) enableSlopeScale() {
+	if b.SlopeScale != 0 || b.SlopeUnits != 0 {
+		gl.Enable(gl.POLYGON_OFFSET_FILL)
+		gl.PolygonOffset(gl.Float(b.SlopeScale), gl.Float(b.SlopeUnits))
+	}
+}
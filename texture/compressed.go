@@ -0,0 +1,162 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"fmt"
+)
+
+// S3TC (BC1-BC3) formats come from EXT_texture_compression_s3tc and
+// EXT_texture_sRGB, which are not part of core GL.
+const (
+	CompressedRGBDXT1 = 0x83F0
+	CompressedRGBADXT1 = 0x83F1
+	CompressedRGBADXT3 = 0x83F2
+	CompressedRGBADXT5 = 0x83F3
+	CompressedSRGBDXT1 = 0x8C4C
+	CompressedSRGBAlphaDXT1 = 0x8C4D
+	CompressedSRGBAlphaDXT3 = 0x8C4E
+	CompressedSRGBAlphaDXT5 = 0x8C4F
+)
+
+// compressedBlockSizes maps block compressed internal formats to the size of
+// one 4x4 block in bytes.
+var compressedBlockSizes = map[gl.Enum]int{
+	CompressedRGBDXT1 : 8,
+	CompressedRGBADXT1 : 8,
+	CompressedRGBADXT3 : 16,
+	CompressedRGBADXT5 : 16,
+	CompressedSRGBDXT1 : 8,
+	CompressedSRGBAlphaDXT1 : 8,
+	CompressedSRGBAlphaDXT3 : 16,
+	CompressedSRGBAlphaDXT5 : 16,
+
+	gl.COMPRESSED_RED_RGTC1 : 8,
+	gl.COMPRESSED_SIGNED_RED_RGTC1 : 8,
+	gl.COMPRESSED_RG_RGTC2 : 16,
+	gl.COMPRESSED_SIGNED_RG_RGTC2 : 16,
+
+	gl.COMPRESSED_RGBA_BPTC_UNORM : 16,
+	gl.COMPRESSED_SRGB_ALPHA_BPTC_UNORM : 16,
+	gl.COMPRESSED_RGB_BPTC_SIGNED_FLOAT : 16,
+	gl.COMPRESSED_RGB_BPTC_UNSIGNED_FLOAT : 16,
+}
+
+// IsCompressedFormat reports whether internalFormat is a supported block
+// compressed format.
+func IsCompressedFormat(internalFormat gl.Enum) bool {
+	_, ok := compressedBlockSizes[internalFormat]
+	return ok
+}
+
+// CompressedLevelSize returns the byte size of a w x h image in a block
+// compressed format.
+func CompressedLevelSize(internalFormat gl.Enum, w, h int) int {
+	return ((w + 3) / 4) * ((h + 3) / 4) * compressedBlockSizes[internalFormat]
+}
+
+// ImageData is a decoded texture file: the payload of each mip level, ready
+// for upload. For uncompressed data Format/Type describe the pixel transfer
+// format; for compressed data they are unused.
+type ImageData struct {
+	W, H int
+	InternalFormat gl.Enum
+	Compressed bool
+	Format gl.Enum
+	Type gl.Enum
+	Levels [][]byte
+}
+
+// Limits of the images the decoders accept, so that a corrupt header fails
+// instead of overflowing level sizes. The float decoders in addition keep to
+// maxFloatImageBytes, see checkFloatImageSize.
+const (
+	maxImageSize = 1 << 15 // width or height
+	maxImagePixels = 1 << 28
+)
+
+func checkImageSize(w, h int) error {
+	if w <= 0 || h <= 0 || w > maxImageSize || h > maxImageSize || w * h > maxImagePixels {
+		return fmt.Errorf("invalid image size %dx%d", w, h)
+	}
+	return nil
+}
+
+func (d *ImageData) levelSize(level int) (w, h int) {
+	w, h = d.W >> uint(level), d.H >> uint(level)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return
+}
+
+func (d *ImageData) validate() error {
+	if d.W <= 0 || d.H <= 0 || len(d.Levels) == 0 {
+		return fmt.Errorf("empty image (%dx%d, %d levels)", d.W, d.H, len(d.Levels))
+	}
+
+	for i, data := range d.Levels {
+		w, h := d.levelSize(i)
+
+		var size int
+		if d.Compressed {
+			size = CompressedLevelSize(d.InternalFormat, w, h)
+		} else {
+			info, ok := GetFormatInfo(d.InternalFormat)
+			if !ok {
+				return fmt.Errorf("unsupported internal format 0x%x", d.InternalFormat)
+			}
+			size = w * h * info.BytesPerPixel
+		}
+
+		if len(data) < size {
+			return fmt.Errorf("mip level %d: %d bytes, expected %d", i, len(data), size)
+		}
+	}
+
+	return nil
+}
+
+// MakeFromImageData uploads all mip levels of d. If d contains only the base
+// level and mipmaps is set, the rest of the chain is generated (uncompressed
+// formats only).
+func MakeFromImageData(d *ImageData, mipmaps bool) (t *Texture2D, err error) {
+	if err = d.validate(); err != nil {
+		return nil, err
+	}
+
+	levels := len(d.Levels)
+	generate := levels == 1 && mipmaps && !d.Compressed
+	if generate {
+		levels = 0
+	}
+
+	t = Make2D(d.W, d.H, d.InternalFormat, levels)
+
+	for i, data := range d.Levels {
+		if d.Compressed {
+			t.UploadCompressed(i, data)
+		} else {
+			t.Upload(i, d.Format, d.Type, gl.Pointer(&data[0]))
+		}
+	}
+
+	if generate {
+		t.GenerateMipmaps()
+	}
+
+	return t, nil
+}
+
+// UploadCompressed replaces the contents of one mip level of a texture with
+// a block compressed internal format.
+func (t *Texture2D) UploadCompressed(level int, data []byte) {
+	w, h := t.GetLevelSize(level)
+	size := CompressedLevelSize(t.internalFormat, w, h)
+
+	gl.BindTexture(gl.TEXTURE_2D, t.handle)
+	gl.CompressedTexSubImage2D(gl.TEXTURE_2D, gl.Int(level), 0, 0, gl.Sizei(w), gl.Sizei(h), t.internalFormat, gl.Sizei(size), gl.Pointer(&data[0]))
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+}
@@ -0,0 +1,176 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	ddsMagic = 0x20534444 // "DDS "
+	ddsHeaderSize = 128
+	ddsDX10HeaderSize = 20
+
+	ddpfFourCC = 0x4
+	ddpfRGB = 0x40
+)
+
+func fourCC(s string) uint32 {
+	return uint32(s[0]) | uint32(s[1]) << 8 | uint32(s[2]) << 16 | uint32(s[3]) << 24
+}
+
+// ddsFormat is what a DDS pixel format (FourCC or DXGI format) maps to.
+type ddsFormat struct {
+	internalFormat gl.Enum
+	srgbFormat gl.Enum
+	compressed bool
+}
+
+var ddsFourCCFormats = map[uint32]ddsFormat{
+	fourCC("DXT1") : { CompressedRGBADXT1, CompressedSRGBAlphaDXT1, true },
+	fourCC("DXT3") : { CompressedRGBADXT3, CompressedSRGBAlphaDXT3, true },
+	fourCC("DXT5") : { CompressedRGBADXT5, CompressedSRGBAlphaDXT5, true },
+	fourCC("ATI1") : { gl.COMPRESSED_RED_RGTC1, gl.COMPRESSED_RED_RGTC1, true },
+	fourCC("BC4U") : { gl.COMPRESSED_RED_RGTC1, gl.COMPRESSED_RED_RGTC1, true },
+	fourCC("BC4S") : { gl.COMPRESSED_SIGNED_RED_RGTC1, gl.COMPRESSED_SIGNED_RED_RGTC1, true },
+	fourCC("ATI2") : { gl.COMPRESSED_RG_RGTC2, gl.COMPRESSED_RG_RGTC2, true },
+	fourCC("BC5U") : { gl.COMPRESSED_RG_RGTC2, gl.COMPRESSED_RG_RGTC2, true },
+	fourCC("BC5S") : { gl.COMPRESSED_SIGNED_RG_RGTC2, gl.COMPRESSED_SIGNED_RG_RGTC2, true },
+	113 : { gl.RGBA16F, gl.RGBA16F, false }, // D3DFMT_A16B16G16R16F
+	116 : { gl.RGBA32F, gl.RGBA32F, false }, // D3DFMT_A32B32G32R32F
+}
+
+var ddsDXGIFormats = map[uint32]ddsFormat{
+	2 : { gl.RGBA32F, gl.RGBA32F, false },
+	10 : { gl.RGBA16F, gl.RGBA16F, false },
+	28 : { gl.RGBA8, gl.SRGB8_ALPHA8, false },
+	29 : { gl.SRGB8_ALPHA8, gl.SRGB8_ALPHA8, false },
+	71 : { CompressedRGBADXT1, CompressedSRGBAlphaDXT1, true },
+	72 : { CompressedSRGBAlphaDXT1, CompressedSRGBAlphaDXT1, true },
+	74 : { CompressedRGBADXT3, CompressedSRGBAlphaDXT3, true },
+	75 : { CompressedSRGBAlphaDXT3, CompressedSRGBAlphaDXT3, true },
+	77 : { CompressedRGBADXT5, CompressedSRGBAlphaDXT5, true },
+	78 : { CompressedSRGBAlphaDXT5, CompressedSRGBAlphaDXT5, true },
+	80 : { gl.COMPRESSED_RED_RGTC1, gl.COMPRESSED_RED_RGTC1, true },
+	81 : { gl.COMPRESSED_SIGNED_RED_RGTC1, gl.COMPRESSED_SIGNED_RED_RGTC1, true },
+	83 : { gl.COMPRESSED_RG_RGTC2, gl.COMPRESSED_RG_RGTC2, true },
+	84 : { gl.COMPRESSED_SIGNED_RG_RGTC2, gl.COMPRESSED_SIGNED_RG_RGTC2, true },
+	95 : { gl.COMPRESSED_RGB_BPTC_UNSIGNED_FLOAT, gl.COMPRESSED_RGB_BPTC_UNSIGNED_FLOAT, true },
+	96 : { gl.COMPRESSED_RGB_BPTC_SIGNED_FLOAT, gl.COMPRESSED_RGB_BPTC_SIGNED_FLOAT, true },
+	98 : { gl.COMPRESSED_RGBA_BPTC_UNORM, gl.COMPRESSED_SRGB_ALPHA_BPTC_UNORM, true },
+	99 : { gl.COMPRESSED_SRGB_ALPHA_BPTC_UNORM, gl.COMPRESSED_SRGB_ALPHA_BPTC_UNORM, true },
+}
+
+// LoadDDS loads a 2D DDS texture including its prebuilt mip chain. DDS
+// stores the top row first and compressed blocks cannot be flipped cheaply,
+// so the image is uploaded as is: sample with t flipped (1 - t).
+func LoadDDS(path string, colorSpace ColorSpace) (*Texture2D, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := DecodeDDS(buf, colorSpace)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return MakeFromImageData(d, true)
+}
+
+// DecodeDDS parses a DDS file held in buf.
+func DecodeDDS(buf []byte, colorSpace ColorSpace) (*ImageData, error) {
+	le := binary.LittleEndian
+
+	if len(buf) < ddsHeaderSize || le.Uint32(buf[0:]) != ddsMagic {
+		return nil, errors.New("not a DDS file")
+	}
+
+	h := int(le.Uint32(buf[12:]))
+	w := int(le.Uint32(buf[16:]))
+	if err := checkImageSize(w, h); err != nil {
+		return nil, err
+	}
+
+	mipCount := int(le.Uint32(buf[28:]))
+	if mipCount == 0 {
+		mipCount = 1
+	}
+
+	pfFlags := le.Uint32(buf[80:])
+	pfFourCC := le.Uint32(buf[84:])
+
+	offset := ddsHeaderSize
+
+	var f ddsFormat
+	var ok bool
+
+	switch {
+	case pfFlags & ddpfFourCC != 0 && pfFourCC == fourCC("DX10"):
+		if len(buf) < ddsHeaderSize + ddsDX10HeaderSize {
+			return nil, errors.New("truncated DX10 header")
+		}
+
+		dxgiFormat := le.Uint32(buf[ddsHeaderSize:])
+		if dim := le.Uint32(buf[ddsHeaderSize + 4:]); dim != 3 { // D3D10_RESOURCE_DIMENSION_TEXTURE2D
+			return nil, fmt.Errorf("unsupported resource dimension %d", dim)
+		}
+		if arraySize := le.Uint32(buf[ddsHeaderSize + 12:]); arraySize > 1 {
+			return nil, errors.New("texture arrays are not supported")
+		}
+
+		offset += ddsDX10HeaderSize
+		if f, ok = ddsDXGIFormats[dxgiFormat]; !ok {
+			return nil, fmt.Errorf("unsupported DXGI format %d", dxgiFormat)
+		}
+
+	case pfFlags & ddpfFourCC != 0:
+		if f, ok = ddsFourCCFormats[pfFourCC]; !ok {
+			return nil, fmt.Errorf("unsupported FourCC 0x%08x", pfFourCC)
+		}
+
+	case pfFlags & ddpfRGB != 0:
+		bitCount := le.Uint32(buf[88:])
+		rMask, gMask, bMask, aMask := le.Uint32(buf[92:]), le.Uint32(buf[96:]), le.Uint32(buf[100:]), le.Uint32(buf[104:])
+		if bitCount != 32 || rMask != 0xff || gMask != 0xff00 || bMask != 0xff0000 || aMask != 0xff000000 {
+			return nil, errors.New("only RGBA8 uncompressed DDS files are supported")
+		}
+		f = ddsFormat{ gl.RGBA8, gl.SRGB8_ALPHA8, false }
+
+	default:
+		return nil, fmt.Errorf("unsupported pixel format flags 0x%x", pfFlags)
+	}
+
+	d := &ImageData{ W : w, H : h, InternalFormat : f.internalFormat, Compressed : f.compressed }
+	if colorSpace == SRGB {
+		d.InternalFormat = f.srgbFormat
+	}
+
+	if !d.Compressed {
+		info, _ := GetFormatInfo(d.InternalFormat)
+		d.Format, d.Type = info.Format, info.Type
+	}
+
+	for i := 0; i < mipCount; i++ {
+		lw, lh := d.levelSize(i)
+
+		var size int
+		if d.Compressed {
+			size = CompressedLevelSize(d.InternalFormat, lw, lh)
+		} else {
+			info, _ := GetFormatInfo(d.InternalFormat)
+			size = lw * lh * info.BytesPerPixel
+		}
+
+		if offset + size > len(buf) {
+			return nil, fmt.Errorf("truncated mip level %d", i)
+		}
+
+		d.Levels = append(d.Levels, buf[offset : offset+size])
+		offset += size
+	}
+
+	return d, nil
+}
@@ -0,0 +1,121 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"encoding/binary"
+	"testing"
+)
+
+// makeDDS builds a DDS file with the given pixel format fields and payload.
+func makeDDS(w, h, mipCount int, pfFlags, pfFourCC uint32, payload []byte) []byte {
+	le := binary.LittleEndian
+
+	buf := make([]byte, ddsHeaderSize)
+	le.PutUint32(buf[0:], ddsMagic)
+	le.PutUint32(buf[4:], 124)
+	le.PutUint32(buf[12:], uint32(h))
+	le.PutUint32(buf[16:], uint32(w))
+	le.PutUint32(buf[28:], uint32(mipCount))
+	le.PutUint32(buf[76:], 32)
+	le.PutUint32(buf[80:], pfFlags)
+	le.PutUint32(buf[84:], pfFourCC)
+
+	if pfFlags & ddpfRGB != 0 {
+		le.PutUint32(buf[88:], 32)
+		le.PutUint32(buf[92:], 0xff)
+		le.PutUint32(buf[96:], 0xff00)
+		le.PutUint32(buf[100:], 0xff0000)
+		le.PutUint32(buf[104:], 0xff000000)
+	}
+
+	return append(buf, payload...)
+}
+
+func makeRGBA8DDS() []byte {
+	return makeDDS(2, 2, 1, ddpfRGB, 0, make([]byte, 2 * 2 * 4))
+}
+
+func TestDecodeDDSRGBA8(t *testing.T) {
+	d, err := DecodeDDS(makeRGBA8DDS(), Linear)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.W != 2 || d.H != 2 || d.Compressed || d.InternalFormat != gl.RGBA8 || len(d.Levels) != 1 || len(d.Levels[0]) != 16 {
+		t.Errorf("unexpected image %dx%d format 0x%x compressed %v, %d levels", d.W, d.H, int(d.InternalFormat), d.Compressed, len(d.Levels))
+	}
+
+	if d, err = DecodeDDS(makeRGBA8DDS(), SRGB); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.InternalFormat != gl.SRGB8_ALPHA8 {
+		t.Errorf("SRGB: format 0x%x", int(d.InternalFormat))
+	}
+}
+
+func TestDecodeDDSDXT1Mips(t *testing.T) {
+	// 8x8, 4x4, 2x2 and 1x1 need 4, 1, 1 and 1 blocks of 8 bytes
+	buf := makeDDS(8, 8, 4, ddpfFourCC, fourCC("DXT1"), make([]byte, 7 * 8))
+
+	d, err := DecodeDDS(buf, Linear)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !d.Compressed || d.InternalFormat != CompressedRGBADXT1 || len(d.Levels) != 4 {
+		t.Fatalf("unexpected image format 0x%x compressed %v, %d levels", int(d.InternalFormat), d.Compressed, len(d.Levels))
+	}
+
+	for i, want := range []int{ 32, 8, 8, 8 } {
+		if len(d.Levels[i]) != want {
+			t.Errorf("level %d: %d bytes, want %d", i, len(d.Levels[i]), want)
+		}
+	}
+}
+
+func TestDecodeDDSDX10(t *testing.T) {
+	dx10 := make([]byte, ddsDX10HeaderSize)
+	binary.LittleEndian.PutUint32(dx10[0:], 98) // BC7_UNORM
+	binary.LittleEndian.PutUint32(dx10[4:], 3)
+	binary.LittleEndian.PutUint32(dx10[12:], 1)
+
+	buf := makeDDS(4, 4, 1, ddpfFourCC, fourCC("DX10"), append(dx10, make([]byte, 16)...))
+
+	d, err := DecodeDDS(buf, SRGB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.InternalFormat != gl.COMPRESSED_SRGB_ALPHA_BPTC_UNORM || len(d.Levels[0]) != 16 {
+		t.Errorf("unexpected format 0x%x, %d bytes", int(d.InternalFormat), len(d.Levels[0]))
+	}
+}
+
+func TestDecodeDDSTruncated(t *testing.T) {
+	buf := makeRGBA8DDS()
+
+	for n := 0; n < len(buf); n++ {
+		if _, err := DecodeDDS(buf[:n], Linear); err == nil {
+			t.Errorf("no error for %d of %d bytes", n, len(buf))
+		}
+	}
+}
+
+func TestDecodeDDSOversized(t *testing.T) {
+	for _, buf := range [][]byte{
+		makeDDS(0xffffffff, 0xffffffff, 1, ddpfRGB, 0, make([]byte, 16)),
+		makeDDS(0x7fffffff, 2, 1, ddpfFourCC, fourCC("DXT5"), make([]byte, 16)),
+		makeDDS(0, 2, 1, ddpfRGB, 0, make([]byte, 16)),
+	} {
+		if _, err := DecodeDDS(buf, Linear); err == nil {
+			t.Errorf("no error for %dx%d", binary.LittleEndian.Uint32(buf[16:]), binary.LittleEndian.Uint32(buf[12:]))
+		}
+	}
+}
+
+func TestDecodeDDSUnsupported(t *testing.T) {
+	if _, err := DecodeDDS(makeDDS(4, 4, 1, ddpfFourCC, fourCC("XXXX"), make([]byte, 16)), Linear); err == nil {
+		t.Error("no error for unknown FourCC")
+	}
+}
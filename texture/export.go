@@ -0,0 +1,233 @@
+package texture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"math"
+	"os"
+	"sort"
+)
+
+// PNGMode selects how float values are mapped to 8 bits when writing PNGs.
+type PNGMode int
+
+const (
+	PNGClamp PNGMode = iota // clamp to [0,1], for data already in range
+	PNGTonemap // Reinhard tonemapping and sRGB encoding, for HDR color
+	PNGNormalize // map [min,max] of the image to [0,1], for depth, velocity etc.
+)
+
+// WritePNG writes img as an 8-bit PNG. One channel images become grayscale,
+// two channel images are written as red/green. Alpha is always clamped.
+func WritePNG(path string, img *FloatImage, mode PNGMode) error {
+	colorChannels := img.Channels
+	if colorChannels == 4 {
+		colorChannels = 3
+	}
+
+	lo, scale := float32(0), float32(1)
+	if mode == PNGNormalize {
+		lo, scale = img.colorRange(colorChannels)
+	}
+
+	out := image.NewNRGBA(image.Rect(0, 0, img.W, img.H))
+
+	for y := 0; y < img.H; y++ {
+		row := out.Pix[(img.H-1-y) * out.Stride:] // PNG rows are top to bottom
+
+		for x := 0; x < img.W; x++ {
+			px := img.At(x, y)
+			var rgba [4]float32
+			rgba[3] = 1
+
+			for c := 0; c < colorChannels; c++ {
+				v := px[c]
+
+				switch mode {
+				case PNGTonemap:
+					v = linearToSRGB(v / (1 + v))
+				case PNGNormalize:
+					v = (v - lo) * scale
+				}
+
+				rgba[c] = v
+			}
+
+			if img.Channels == 1 {
+				rgba[1], rgba[2] = rgba[0], rgba[0]
+			} else if img.Channels == 4 {
+				rgba[3] = px[3]
+			}
+
+			for c := 0; c < 4; c++ {
+				row[4*x + c] = unormByte(rgba[c])
+			}
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := png.Encode(f, out); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// colorRange returns the offset and scale mapping the finite values of the
+// first n channels to [0,1].
+func (img *FloatImage) colorRange(n int) (lo, scale float32) {
+	lo, hi := float32(math.Inf(1)), float32(math.Inf(-1))
+
+	for i := 0; i < len(img.Pix); i += img.Channels {
+		for _, v := range img.Pix[i : i+n] {
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				continue
+			}
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+	}
+
+	if hi <= lo {
+		if hi < lo { // no finite values at all
+			lo = 0
+		}
+		return lo, 1
+	}
+
+	return lo, 1 / (hi - lo)
+}
+
+func linearToSRGB(v float32) float32 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return float32(1.055 * math.Pow(float64(v), 1 / 2.4) - 0.055)
+}
+
+func unormByte(v float32) byte {
+	if !(v > 0) { // also catches NaN
+		return 0
+	}
+	if v >= 1 {
+		return 255
+	}
+	return byte(v * 255 + 0.5)
+}
+
+// WriteEXR writes img as an uncompressed scanline OpenEXR file with 32 bit
+// float channels: Y for one channel images, R, G, B and A otherwise.
+func WriteEXR(path string, img *FloatImage) error {
+	names := []string{ "R", "G", "B", "A" }[:img.Channels]
+	if img.Channels == 1 {
+		names = []string{ "Y" }
+	}
+
+	// channels are stored in alphabetical order of their names
+	order := make([]int, len(names))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return names[order[a]] < names[order[b]] })
+
+	var hdr exrHeaderWriter
+	le := binary.LittleEndian
+
+	hdr.u32(exrMagic)
+	hdr.u32(2) // version 2, single-part scanline
+
+	var chlist []byte
+	for _, c := range order {
+		chlist = append(chlist, names[c]...)
+		chlist = append(chlist, 0)
+		chlist = le.AppendUint32(chlist, exrPixelFloat)
+		chlist = append(chlist, 0, 0, 0, 0) // pLinear, reserved
+		chlist = le.AppendUint32(chlist, 1) // xSampling
+		chlist = le.AppendUint32(chlist, 1) // ySampling
+	}
+	chlist = append(chlist, 0)
+
+	var window []byte
+	for _, v := range []int32{ 0, 0, int32(img.W - 1), int32(img.H - 1) } {
+		window = le.AppendUint32(window, uint32(v))
+	}
+
+	hdr.attr("channels", "chlist", chlist)
+	hdr.attr("compression", "compression", []byte{ exrCompressionNone })
+	hdr.attr("dataWindow", "box2i", window)
+	hdr.attr("displayWindow", "box2i", window)
+	hdr.attr("lineOrder", "lineOrder", []byte{ 0 }) // increasing y
+	hdr.attr("pixelAspectRatio", "float", le.AppendUint32(nil, math.Float32bits(1)))
+	hdr.attr("screenWindowCenter", "v2f", make([]byte, 8))
+	hdr.attr("screenWindowWidth", "float", le.AppendUint32(nil, math.Float32bits(1)))
+	hdr.buf = append(hdr.buf, 0)
+
+	// one chunk per scanline: y, data size, then each channel's row
+	rowSize := 4 * img.W * img.Channels
+	chunkSize := 8 + rowSize
+	dataStart := len(hdr.buf) + 8 * img.H
+
+	for y := 0; y < img.H; y++ {
+		hdr.buf = le.AppendUint64(hdr.buf, uint64(dataStart + y * chunkSize))
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	w.Write(hdr.buf)
+
+	chunk := make([]byte, chunkSize)
+	for y := 0; y < img.H; y++ {
+		le.PutUint32(chunk[0:], uint32(y))
+		le.PutUint32(chunk[4:], uint32(rowSize))
+
+		src := img.H - 1 - y // EXR y grows downwards
+		i := 8
+		for _, c := range order {
+			for x := 0; x < img.W; x++ {
+				le.PutUint32(chunk[i:], math.Float32bits(img.At(x, src)[c]))
+				i += 4
+			}
+		}
+
+		w.Write(chunk)
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+type exrHeaderWriter struct {
+	buf []byte
+}
+
+func (h *exrHeaderWriter) u32(v uint32) {
+	h.buf = binary.LittleEndian.AppendUint32(h.buf, v)
+}
+
+func (h *exrHeaderWriter) attr(name, typeName string, value []byte) {
+	h.buf = append(h.buf, name...)
+	h.buf = append(h.buf, 0)
+	h.buf = append(h.buf, typeName...)
+	h.buf = append(h.buf, 0)
+	h.u32(uint32(len(value)))
+	h.buf = append(h.buf, value...)
+}
@@ -0,0 +1,65 @@
+package texture
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteEXRRoundTrip(t *testing.T) {
+	const w, h = 5, 3
+
+	for channels := 1; channels <= 4; channels++ {
+		img := MakeFloatImage(w, h, channels)
+		for i := range img.Pix {
+			img.Pix[i] = float32(i) * 0.37 - 2
+		}
+		img.Pix[0] = float32(math.Inf(1))
+		img.Pix[1 % len(img.Pix)] = 1e-40 // denormal
+
+		path := filepath.Join(t.TempDir(), "img.exr")
+		if err := WriteEXR(path, img); err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := DecodeEXR(buf)
+		if err != nil {
+			t.Fatalf("%d channels: %v", channels, err)
+		}
+
+		if got.W != w || got.H != h {
+			t.Fatalf("%d channels: %dx%d, want %dx%d", channels, got.W, got.H, w, h)
+		}
+
+		// DecodeEXR always returns RGBA: Y is spread to RGB, missing color
+		// channels are 0 and missing alpha 1
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				src, px := img.At(x, y), got.At(x, y)
+
+				want := [4]float32{ 0, 0, 0, 1 }
+				if channels == 1 {
+					want[0], want[1], want[2] = src[0], src[0], src[0]
+				} else {
+					copy(want[:], src)
+				}
+
+				if [4]float32{ px[0], px[1], px[2], px[3] } != want {
+					t.Fatalf("%d channels: pixel (%d,%d) is %v, want %v", channels, x, y, px, want)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteEXRBadPath(t *testing.T) {
+	if err := WriteEXR(filepath.Join(t.TempDir(), "missing", "img.exr"), MakeFloatImage(1, 1, 3)); err == nil {
+		t.Error("no error for a path in a missing directory")
+	}
+}
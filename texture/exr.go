@@ -0,0 +1,369 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/buffers"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+const (
+	exrMagic = 20000630
+
+	exrFlagTiled = 0x200
+	exrFlagDeep = 0x800
+	exrFlagMultipart = 0x1000
+
+	exrCompressionNone = 0
+	exrCompressionRLE = 1
+	exrCompressionZIPS = 2
+	exrCompressionZIP = 3
+
+	exrPixelUint = 0
+	exrPixelHalf = 1
+	exrPixelFloat = 2
+)
+
+type exrChannel struct {
+	name string
+	pixelType int
+	xSampling, ySampling int
+}
+
+// LoadEXR loads a scanline OpenEXR file into a float texture with the given
+// internal format, e.g. gl.RGBA16F. Only uncompressed, RLE and ZIP
+// compressed single-part files are supported.
+func LoadEXR(path string, internalFormat gl.Enum, mipmaps bool) (*Texture2D, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := DecodeEXR(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return MakeFromFloatImage(img, internalFormat, mipmaps), nil
+}
+
+// DecodeEXR decodes the R, G, B and A channels (or Y for luminance images)
+// of an OpenEXR file into a 4-channel FloatImage. Missing color channels are
+// 0, missing alpha is 1.
+func DecodeEXR(buf []byte) (*FloatImage, error) {
+	le := binary.LittleEndian
+
+	if len(buf) < 8 || le.Uint32(buf) != exrMagic {
+		return nil, errors.New("not an OpenEXR file")
+	}
+
+	flags := le.Uint32(buf[4:])
+	if flags & exrFlagTiled != 0 {
+		return nil, errors.New("tiled OpenEXR files are not supported")
+	}
+	if flags & (exrFlagDeep | exrFlagMultipart) != 0 {
+		return nil, errors.New("deep and multi-part OpenEXR files are not supported")
+	}
+
+	var channels []exrChannel
+	compression := -1
+	var xMin, yMin, xMax, yMax int
+	haveDataWindow := false
+
+	// header: name\0 type\0 size value ... terminated by an empty name
+	p := 8
+	for {
+		name, n := exrCString(buf[p:])
+		if n < 0 {
+			return nil, errors.New("truncated OpenEXR header")
+		}
+		p += n
+		if name == "" {
+			break
+		}
+
+		typ, n := exrCString(buf[p:])
+		if n < 0 || p + n + 4 > len(buf) {
+			return nil, errors.New("truncated OpenEXR header")
+		}
+		p += n
+
+		size := int(le.Uint32(buf[p:]))
+		p += 4
+		if p + size > len(buf) {
+			return nil, errors.New("truncated OpenEXR header")
+		}
+		val := buf[p : p+size]
+		p += size
+
+		switch {
+		case name == "channels" && typ == "chlist":
+			var err error
+			if channels, err = exrParseChannels(val); err != nil {
+				return nil, err
+			}
+		case name == "compression" && typ == "compression" && size == 1:
+			compression = int(val[0])
+		case name == "dataWindow" && typ == "box2i" && size == 16:
+			xMin, yMin = int(int32(le.Uint32(val[0:]))), int(int32(le.Uint32(val[4:])))
+			xMax, yMax = int(int32(le.Uint32(val[8:]))), int(int32(le.Uint32(val[12:])))
+			haveDataWindow = true
+		}
+	}
+
+	if len(channels) == 0 || compression < 0 || !haveDataWindow {
+		return nil, errors.New("OpenEXR header lacks channels, compression or dataWindow")
+	}
+
+	// maxRatio is the best compression possible: RLE turns 2 bytes into 128,
+	// deflate at most 258 bytes into 2 bits
+	var linesPerBlock, maxRatio int
+	switch compression {
+	case exrCompressionNone:
+		linesPerBlock, maxRatio = 1, 1
+	case exrCompressionRLE:
+		linesPerBlock, maxRatio = 1, 64
+	case exrCompressionZIPS:
+		linesPerBlock, maxRatio = 1, 1032
+	case exrCompressionZIP:
+		linesPerBlock, maxRatio = 16, 1032
+	default:
+		return nil, fmt.Errorf("unsupported OpenEXR compression %d", compression)
+	}
+
+	w, h := xMax - xMin + 1, yMax - yMin + 1
+	if err := checkFloatImageSize(w, h, 4); err != nil {
+		return nil, fmt.Errorf("OpenEXR data window: %v", err)
+	}
+
+	for _, c := range channels {
+		if c.xSampling != 1 || c.ySampling != 1 {
+			return nil, errors.New("subsampled OpenEXR channels are not supported")
+		}
+	}
+
+	// channels are stored sorted by name, each one as a full row per scanline
+	rowBytes := 0
+	for _, c := range channels {
+		rowBytes += w * exrPixelSize(c.pixelType)
+	}
+
+	nBlocks := (h + linesPerBlock - 1) / linesPerBlock
+	if p + 8 * nBlocks > len(buf) {
+		return nil, errors.New("truncated OpenEXR offset table")
+	}
+	offsets := buf[p : p + 8*nBlocks]
+
+	// each block has an 8 byte header, all of them together at least the
+	// pixel data at maxRatio; don't allocate the image for files which
+	// cannot hold it
+	if p + 16 * nBlocks + h * rowBytes / maxRatio > len(buf) {
+		return nil, errors.New("OpenEXR file too short for its data window")
+	}
+
+	img := MakeFloatImage(w, h, 4)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 1
+	}
+
+	for b := 0; b < nBlocks; b++ {
+		off := int(le.Uint64(offsets[8*b:]))
+		// off + 8 may overflow
+		if off < 0 || off > len(buf) - 8 {
+			return nil, fmt.Errorf("invalid offset for OpenEXR block %d", b)
+		}
+
+		y0 := int(int32(le.Uint32(buf[off:])))
+		size := int(le.Uint32(buf[off + 4:]))
+		if off + 8 + size > len(buf) {
+			return nil, fmt.Errorf("truncated OpenEXR block %d", b)
+		}
+
+		lines := linesPerBlock
+		if y0 + lines - 1 > yMax {
+			lines = yMax - y0 + 1
+		}
+		if y0 < yMin || lines <= 0 {
+			return nil, fmt.Errorf("invalid scanline %d in OpenEXR block %d", y0, b)
+		}
+
+		data, err := exrDecompress(buf[off + 8 : off+8+size], compression, lines * rowBytes)
+		if err != nil {
+			return nil, fmt.Errorf("OpenEXR block %d: %v", b, err)
+		}
+
+		for l := 0; l < lines; l++ {
+			// EXR stores the top scanline first
+			y := h - 1 - (y0 - yMin + l)
+			row := data[l * rowBytes:]
+
+			for _, c := range channels {
+				dst := exrChannelIndex(c.name)
+				pixSize := exrPixelSize(c.pixelType)
+
+				if dst >= 0 {
+					for x := 0; x < w; x++ {
+						v := exrReadPixel(row[x * pixSize:], c.pixelType)
+						if dst == 4 { // luminance
+							px := img.At(x, y)
+							px[0], px[1], px[2] = v, v, v
+						} else {
+							img.At(x, y)[dst] = v
+						}
+					}
+				}
+
+				row = row[w * pixSize:]
+			}
+		}
+	}
+
+	return img, nil
+}
+
+func exrCString(b []byte) (s string, n int) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", -1
+	}
+	return string(b[:i]), i + 1
+}
+
+func exrParseChannels(b []byte) (channels []exrChannel, err error) {
+	le := binary.LittleEndian
+
+	for {
+		name, n := exrCString(b)
+		if n < 0 {
+			return nil, errors.New("malformed OpenEXR channel list")
+		}
+		b = b[n:]
+		if name == "" {
+			return
+		}
+
+		if len(b) < 16 {
+			return nil, errors.New("malformed OpenEXR channel list")
+		}
+
+		c := exrChannel{ name : name, pixelType : int(le.Uint32(b[0:])), xSampling : int(le.Uint32(b[8:])), ySampling : int(le.Uint32(b[12:])) }
+		if c.pixelType > exrPixelFloat {
+			return nil, fmt.Errorf("unknown OpenEXR pixel type %d", c.pixelType)
+		}
+
+		channels = append(channels, c)
+		b = b[16:]
+	}
+}
+
+func exrPixelSize(pixelType int) int {
+	if pixelType == exrPixelHalf {
+		return 2
+	}
+	return 4
+}
+
+// exrChannelIndex maps a channel name to its FloatImage component; 4 marks
+// luminance, -1 channels we ignore.
+func exrChannelIndex(name string) int {
+	switch name {
+	case "R":
+		return 0
+	case "G":
+		return 1
+	case "B":
+		return 2
+	case "A":
+		return 3
+	case "Y":
+		return 4
+	}
+	return -1
+}
+
+func exrReadPixel(b []byte, pixelType int) float32 {
+	le := binary.LittleEndian
+
+	switch pixelType {
+	case exrPixelUint:
+		return float32(le.Uint32(b))
+	case exrPixelHalf:
+		return buffers.HalfToFloat32(le.Uint16(b))
+	}
+
+	return math.Float32frombits(le.Uint32(b))
+}
+
+func exrDecompress(src []byte, compression int, size int) ([]byte, error) {
+	// blocks which did not compress are stored raw
+	if compression == exrCompressionNone || len(src) == size {
+		if len(src) < size {
+			return nil, errors.New("short uncompressed block")
+		}
+		return src, nil
+	}
+
+	var tmp []byte
+
+	switch compression {
+	case exrCompressionRLE:
+		tmp = make([]byte, 0, size)
+		for len(src) > 0 {
+			n := int(int8(src[0]))
+			src = src[1:]
+
+			if n < 0 {
+				if len(src) < -n {
+					return nil, errors.New("corrupt RLE data")
+				}
+				tmp = append(tmp, src[:-n]...)
+				src = src[-n:]
+			} else {
+				if len(src) < 1 {
+					return nil, errors.New("corrupt RLE data")
+				}
+				for i := 0; i <= n; i++ {
+					tmp = append(tmp, src[0])
+				}
+				src = src[1:]
+			}
+		}
+
+	case exrCompressionZIPS, exrCompressionZIP:
+		r, err := zlib.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		// one byte more than expected is enough to tell the size is wrong
+		if tmp, err = ioutil.ReadAll(io.LimitReader(r, int64(size) + 1)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(tmp) != size {
+		return nil, fmt.Errorf("decompressed %d bytes, expected %d", len(tmp), size)
+	}
+
+	// undo the delta predictor, then re-interleave the two byte halves
+	for i := 1; i < len(tmp); i++ {
+		tmp[i] = byte(int(tmp[i - 1]) + int(tmp[i]) - 128)
+	}
+
+	out := make([]byte, size)
+	half := (size + 1) / 2
+	for i := 0; i < size; i++ {
+		if i % 2 == 0 {
+			out[i] = tmp[i / 2]
+		} else {
+			out[i] = tmp[half + i / 2]
+		}
+	}
+
+	return out, nil
+}
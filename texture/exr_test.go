@@ -0,0 +1,280 @@
+package texture
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// exrAttr appends a header attribute.
+func exrAttr(buf []byte, name, typ string, val []byte) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, 0)
+	buf = append(buf, typ...)
+	buf = append(buf, 0)
+
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(val)))
+	buf = append(buf, size...)
+	return append(buf, val...)
+}
+
+// exrPredict applies the byte split and delta predictor of RLE and ZIP
+// compression, the inverse of what exrDecompress undoes.
+func exrPredict(raw []byte) []byte {
+	tmp := make([]byte, len(raw))
+	half := (len(raw) + 1) / 2
+	for i := range raw {
+		if i % 2 == 0 {
+			tmp[i / 2] = raw[i]
+		} else {
+			tmp[half + i / 2] = raw[i]
+		}
+	}
+
+	for i := len(tmp) - 1; i > 0; i-- {
+		tmp[i] = byte(int(tmp[i]) - int(tmp[i - 1]) + 128)
+	}
+
+	return tmp
+}
+
+// exrCompress compresses one block of raw scanline data.
+func exrCompress(raw []byte, compression int) []byte {
+	switch compression {
+	case exrCompressionRLE:
+		// literal runs only
+		var out []byte
+		for src := exrPredict(raw); len(src) > 0; {
+			n := len(src)
+			if n > 127 {
+				n = 127
+			}
+			out = append(out, byte(-n))
+			out = append(out, src[:n]...)
+			src = src[n:]
+		}
+		return out
+
+	case exrCompressionZIPS, exrCompressionZIP:
+		var b bytes.Buffer
+		w := zlib.NewWriter(&b)
+		w.Write(exrPredict(raw))
+		w.Close()
+		return b.Bytes()
+	}
+
+	return raw
+}
+
+// exrTestPixel is the value the test images hold in channel c at (x, y), y
+// counted from the top row as in the file. Below 512 multiples of 0.25 are
+// exact halves.
+func exrTestPixel(x, y, c int) float32 {
+	return float32(16 * y + 4 * x + c) + 0.25
+}
+
+// makeEXR builds a scanline file with float R, G and B channels and a half A
+// channel, data window starting at (-1, 3).
+func makeEXR(w, h, compression int) []byte {
+	le := binary.LittleEndian
+
+	buf := make([]byte, 8)
+	le.PutUint32(buf[0:], exrMagic)
+	le.PutUint32(buf[4:], 2)
+
+	var chlist []byte
+	for _, c := range []struct { name string; pixelType uint32 }{ { "A", exrPixelHalf }, { "B", exrPixelFloat }, { "G", exrPixelFloat }, { "R", exrPixelFloat } } {
+		chlist = append(chlist, c.name...)
+		chlist = append(chlist, 0)
+
+		desc := make([]byte, 16)
+		le.PutUint32(desc[0:], c.pixelType)
+		le.PutUint32(desc[8:], 1)
+		le.PutUint32(desc[12:], 1)
+		chlist = append(chlist, desc...)
+	}
+	chlist = append(chlist, 0)
+
+	window := make([]byte, 16)
+	le.PutUint32(window[0:], uint32(0xffffffff)) // -1
+	le.PutUint32(window[4:], 3)
+	le.PutUint32(window[8:], uint32(w - 2))
+	le.PutUint32(window[12:], uint32(h + 2))
+
+	buf = exrAttr(buf, "channels", "chlist", chlist)
+	buf = exrAttr(buf, "compression", "compression", []byte{ byte(compression) })
+	buf = exrAttr(buf, "dataWindow", "box2i", window)
+	buf = exrAttr(buf, "lineOrder", "lineOrder", []byte{ 0 })
+	buf = append(buf, 0)
+
+	linesPerBlock := 1
+	if compression == exrCompressionZIP {
+		linesPerBlock = 16
+	}
+	nBlocks := (h + linesPerBlock - 1) / linesPerBlock
+
+	table := len(buf)
+	buf = append(buf, make([]byte, 8 * nBlocks)...)
+
+	for b := 0; b < nBlocks; b++ {
+		var raw []byte
+		for y := b * linesPerBlock; y < h && y < (b + 1) * linesPerBlock; y++ {
+			for _, c := range []int{ 3, 2, 1, 0 } {
+				for x := 0; x < w; x++ {
+					v := exrTestPixel(x, y, c)
+					if c == 3 {
+						half := make([]byte, 2)
+						le.PutUint16(half, float32ToHalfBits(v))
+						raw = append(raw, half...)
+					} else {
+						f := make([]byte, 4)
+						le.PutUint32(f, math.Float32bits(v))
+						raw = append(raw, f...)
+					}
+				}
+			}
+		}
+
+		data := exrCompress(raw, compression)
+
+		le.PutUint64(buf[table + 8*b:], uint64(len(buf)))
+		block := make([]byte, 8)
+		le.PutUint32(block[0:], uint32(3 + b * linesPerBlock))
+		le.PutUint32(block[4:], uint32(len(data)))
+		buf = append(buf, block...)
+		buf = append(buf, data...)
+	}
+
+	return buf
+}
+
+// float32ToHalfBits converts normal floats which are exact halves.
+func float32ToHalfBits(f float32) uint16 {
+	bits := math.Float32bits(f)
+	exp := int(bits >> 23 & 0xff) - 127 + 15
+	return uint16(bits >> 16 & 0x8000) | uint16(exp) << 10 | uint16(bits >> 13 & 0x3ff)
+}
+
+func TestDecodeEXR(t *testing.T) {
+	const w, h = 3, 20
+
+	for _, compression := range []int{ exrCompressionNone, exrCompressionRLE, exrCompressionZIPS, exrCompressionZIP } {
+		img, err := DecodeEXR(makeEXR(w, h, compression))
+		if err != nil {
+			t.Fatalf("compression %d: %v", compression, err)
+		}
+
+		if img.W != w || img.H != h || img.Channels != 4 {
+			t.Fatalf("compression %d: %dx%d with %d channels", compression, img.W, img.H, img.Channels)
+		}
+
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				px := img.At(x, h - 1 - y)
+				for c := 0; c < 4; c++ {
+					if want := exrTestPixel(x, y, c); px[c] != want {
+						t.Fatalf("compression %d: pixel (%d,%d) channel %d is %v, want %v", compression, x, y, c, px[c], want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeEXRTruncated(t *testing.T) {
+	for _, compression := range []int{ exrCompressionNone, exrCompressionRLE, exrCompressionZIP } {
+		buf := makeEXR(2, 2, compression)
+
+		for n := 0; n < len(buf); n++ {
+			if _, err := DecodeEXR(buf[:n]); err == nil {
+				t.Errorf("compression %d: no error for %d of %d bytes", compression, n, len(buf))
+			}
+		}
+	}
+}
+
+func TestDecodeEXROversized(t *testing.T) {
+	le := binary.LittleEndian
+
+	// dataWindow is the last 16 bytes of its attribute
+	window := func(buf []byte) []byte {
+		i := bytes.Index(buf, []byte("box2i\x00")) + len("box2i\x00") + 4
+		return buf[i : i+16]
+	}
+
+	var bufs [][]byte
+
+	buf := makeEXR(2, 2, exrCompressionNone)
+	le.PutUint32(window(buf)[8:], 0x7fffffff)
+	bufs = append(bufs, buf)
+
+	buf = makeEXR(2, 2, exrCompressionNone)
+	le.PutUint32(window(buf)[0:], 0x80000000)
+	le.PutUint32(window(buf)[8:], 0x7fffffff)
+	bufs = append(bufs, buf)
+
+	buf = makeEXR(2, 2, exrCompressionNone)
+	le.PutUint32(window(buf)[12:], 0x7fffffff)
+	bufs = append(bufs, buf)
+
+	// block offsets and sizes pointing far past the end; the offset table
+	// follows the lineOrder attribute and the header terminator
+	buf = makeEXR(2, 2, exrCompressionNone)
+	table := bytes.Index(buf, []byte("lineOrder\x00lineOrder\x00")) + len("lineOrder\x00lineOrder\x00") + 4 + 1 + 1
+	le.PutUint64(buf[table:], 0x7fffffffffffffff)
+	bufs = append(bufs, buf)
+
+	buf = makeEXR(2, 2, exrCompressionNone)
+	block := int(le.Uint64(buf[table:]))
+	le.PutUint32(buf[block + 4:], 0xffffffff)
+	bufs = append(bufs, buf)
+
+	// ZIP blocks of 16 lines make the offset table of 32768 lines 16 KB
+	buf = makeEXR(2, 2, exrCompressionZIP)
+	le.PutUint32(window(buf)[8:], 32768 - 2)
+	le.PutUint32(window(buf)[12:], 32768 + 2)
+	bufs = append(bufs, append(buf, make([]byte, 16 << 10)...))
+
+	// within the limits, with a complete offset table but no pixel data
+	buf = makeEXR(2, 2, exrCompressionZIP)
+	le.PutUint32(window(buf)[8:], 4096 - 2)
+	le.PutUint32(window(buf)[12:], 4096 + 2)
+	bufs = append(bufs, append(buf, make([]byte, 2 << 10)...))
+
+	for i, buf := range bufs {
+		var err error
+		n := allocatedBy(func() {
+			_, err = DecodeEXR(buf)
+		})
+
+		if err == nil {
+			t.Errorf("no error for file %d", i)
+		}
+		if n > maxTestAlloc {
+			t.Errorf("%d bytes allocated for file %d", n, i)
+		}
+	}
+}
+
+func TestDecodeEXRCorruptBlocks(t *testing.T) {
+	if _, err := exrDecompress([]byte{ 0x80 }, exrCompressionRLE, 16); err == nil {
+		t.Error("no error for RLE run past the end of the input")
+	}
+
+	if _, err := exrDecompress([]byte{ 100, 7 }, exrCompressionRLE, 16); err == nil {
+		t.Error("no error for RLE output longer than the block")
+	}
+
+	if _, err := exrDecompress([]byte{ 1, 2, 3 }, exrCompressionZIP, 16); err == nil {
+		t.Error("no error for invalid zlib data")
+	}
+
+	// zlib data inflating to far more than the block size
+	raw := make([]byte, 1 << 20)
+	if _, err := exrDecompress(exrCompress(raw, exrCompressionZIP), exrCompressionZIP, 16); err == nil {
+		t.Error("no error for oversized zlib data")
+	}
+}
@@ -0,0 +1,72 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"fmt"
+	"log"
+)
+
+// maxFloatImageBytes bounds the FloatImages the decoders allocate.
+const maxFloatImageBytes = 1 << 30
+
+// checkFloatImageSize is checkImageSize for a FloatImage of w x h pixels
+// with channels float channels.
+func checkFloatImageSize(w, h, channels int) error {
+	if err := checkImageSize(w, h); err != nil {
+		return err
+	}
+
+	if w * h * channels * 4 > maxFloatImageBytes {
+		return fmt.Errorf("image of %dx%d with %d channels exceeds %d bytes", w, h, channels, maxFloatImageBytes)
+	}
+	return nil
+}
+
+// FloatImage is a CPU-side image with float channels. Rows are stored bottom
+// to top, like GL expects them for uploads and returns them from readbacks.
+type FloatImage struct {
+	W, H int
+	Channels int
+	Pix []float32
+}
+
+func MakeFloatImage(w, h, channels int) *FloatImage {
+	return &FloatImage{ W : w, H : h, Channels : channels, Pix : make([]float32, w * h * channels) }
+}
+
+// At returns the channels of pixel (x, y), y counted from the bottom row.
+func (img *FloatImage) At(x, y int) []float32 {
+	i := (y * img.W + x) * img.Channels
+	return img.Pix[i : i+img.Channels]
+}
+
+func floatTransferFormat(channels int) gl.Enum {
+	switch channels {
+	case 1:
+		return gl.RED
+	case 2:
+		return gl.RG
+	case 3:
+		return gl.RGB
+	case 4:
+		return gl.RGBA
+	}
+
+	log.Fatalf("Unsupported channel count %d", channels)
+	return 0
+}
+
+// MakeFromFloatImage uploads img into a float texture, e.g. gl.RGB16F,
+// gl.RGB32F or gl.R11F_G11F_B10F for HDR color data.
+func MakeFromFloatImage(img *FloatImage, internalFormat gl.Enum, mipmaps bool) (t *Texture2D) {
+	levels := 1
+	if mipmaps {
+		levels = 0
+	}
+
+	t = Make2D(img.W, img.H, internalFormat, levels)
+	t.Upload(0, floatTransferFormat(img.Channels), gl.FLOAT, gl.Pointer(&img.Pix[0]))
+	t.GenerateMipmaps()
+
+	return
+}
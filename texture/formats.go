@@ -0,0 +1,65 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+)
+
+// FormatInfo describes an internal format: the pixel transfer format/type
+// matching it and the number of bytes one texel occupies in video memory.
+type FormatInfo struct {
+	Format gl.Enum
+	Type gl.Enum
+	BytesPerPixel int
+	Channels int
+	Depth bool
+	Stencil bool
+	SRGB bool
+}
+
+var formatInfos = map[gl.Enum]FormatInfo{
+	gl.R8 : { gl.RED, gl.UNSIGNED_BYTE, 1, 1, false, false, false },
+	gl.RG8 : { gl.RG, gl.UNSIGNED_BYTE, 2, 2, false, false, false },
+	gl.RGB8 : { gl.RGB, gl.UNSIGNED_BYTE, 3, 3, false, false, false },
+	gl.RGBA8 : { gl.RGBA, gl.UNSIGNED_BYTE, 4, 4, false, false, false },
+	gl.SRGB8 : { gl.RGB, gl.UNSIGNED_BYTE, 3, 3, false, false, true },
+	gl.SRGB8_ALPHA8 : { gl.RGBA, gl.UNSIGNED_BYTE, 4, 4, false, false, true },
+	gl.RGB10_A2 : { gl.RGBA, gl.UNSIGNED_INT_2_10_10_10_REV, 4, 4, false, false, false },
+
+	gl.R16F : { gl.RED, gl.HALF_FLOAT, 2, 1, false, false, false },
+	gl.RG16F : { gl.RG, gl.HALF_FLOAT, 4, 2, false, false, false },
+	gl.RGB16F : { gl.RGB, gl.HALF_FLOAT, 6, 3, false, false, false },
+	gl.RGBA16F : { gl.RGBA, gl.HALF_FLOAT, 8, 4, false, false, false },
+	gl.R32F : { gl.RED, gl.FLOAT, 4, 1, false, false, false },
+	gl.RG32F : { gl.RG, gl.FLOAT, 8, 2, false, false, false },
+	gl.RGB32F : { gl.RGB, gl.FLOAT, 12, 3, false, false, false },
+	gl.RGBA32F : { gl.RGBA, gl.FLOAT, 16, 4, false, false, false },
+	gl.R11F_G11F_B10F : { gl.RGB, gl.FLOAT, 4, 3, false, false, false },
+
+	gl.R8UI : { gl.RED_INTEGER, gl.UNSIGNED_BYTE, 1, 1, false, false, false },
+	gl.R16UI : { gl.RED_INTEGER, gl.UNSIGNED_SHORT, 2, 1, false, false, false },
+	gl.R32UI : { gl.RED_INTEGER, gl.UNSIGNED_INT, 4, 1, false, false, false },
+
+	gl.DEPTH_COMPONENT16 : { gl.DEPTH_COMPONENT, gl.UNSIGNED_SHORT, 2, 1, true, false, false },
+	gl.DEPTH_COMPONENT24 : { gl.DEPTH_COMPONENT, gl.UNSIGNED_INT, 4, 1, true, false, false },
+	gl.DEPTH_COMPONENT32F : { gl.DEPTH_COMPONENT, gl.FLOAT, 4, 1, true, false, false },
+	gl.DEPTH24_STENCIL8 : { gl.DEPTH_STENCIL, gl.UNSIGNED_INT_24_8, 4, 2, true, true, false },
+	gl.DEPTH32F_STENCIL8 : { gl.DEPTH_STENCIL, gl.FLOAT_32_UNSIGNED_INT_24_8_REV, 8, 2, true, true, false },
+}
+
+// GetFormatInfo looks up an uncompressed internal format.
+func GetFormatInfo(internalFormat gl.Enum) (info FormatInfo, ok bool) {
+	info, ok = formatInfos[internalFormat]
+	return
+}
+
+// FullMipChainLevels returns the number of mip levels down to 1x1.
+func FullMipChainLevels(w, h int) int {
+	levels := 1
+	for w > 1 || h > 1 {
+		w /= 2
+		h /= 2
+		levels++
+	}
+
+	return levels
+}
@@ -0,0 +1,174 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LoadHDR loads a Radiance RGBE (.hdr) file into an RGB float texture with
+// the given internal format (gl.RGB16F, gl.RGB32F or gl.R11F_G11F_B10F).
+func LoadHDR(path string, internalFormat gl.Enum, mipmaps bool) (*Texture2D, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, err := DecodeHDR(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return MakeFromFloatImage(img, internalFormat, mipmaps), nil
+}
+
+// DecodeHDR decodes a Radiance RGBE image into a 3-channel FloatImage.
+func DecodeHDR(r io.Reader) (*FloatImage, error) {
+	br := bufio.NewReader(r)
+
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "#?") {
+		return nil, errors.New("not a Radiance HDR file")
+	}
+
+	// header lines up to the first empty line
+	for {
+		line, err = br.ReadString('\n')
+		if err != nil {
+			return nil, errors.New("truncated Radiance header")
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return nil, fmt.Errorf("unsupported Radiance format %q", line[7:])
+		}
+	}
+
+	// resolution string, e.g. "-Y 512 +X 768" for top-to-bottom scanlines
+	line, err = br.ReadString('\n')
+	if err != nil {
+		return nil, errors.New("missing Radiance resolution string")
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 4 || (fields[0] != "-Y" && fields[0] != "+Y") || fields[2] != "+X" {
+		return nil, fmt.Errorf("unsupported Radiance orientation %q", strings.TrimSpace(line))
+	}
+
+	h, err1 := strconv.Atoi(fields[1])
+	w, err2 := strconv.Atoi(fields[3])
+	if err1 != nil || err2 != nil || checkFloatImageSize(w, h, 3) != nil {
+		return nil, fmt.Errorf("invalid Radiance resolution %q", strings.TrimSpace(line))
+	}
+
+	// the image grows with the scanlines read, RLE compresses well enough
+	// that a short file can claim a huge image
+	img := &FloatImage{ W : w, H : h, Channels : 3 }
+	scanline := make([]byte, 4 * w)
+	row := make([]float32, 3 * w)
+
+	for i := 0; i < h; i++ {
+		if err := readRGBEScanline(br, scanline, w); err != nil {
+			return nil, err
+		}
+
+		for x := 0; x < w; x++ {
+			rgbeToFloat(scanline[4*x:4*x+4], row[3*x:3*x+3])
+		}
+		img.Pix = append(img.Pix, row...)
+	}
+
+	// +Y: bottom to top, same as FloatImage
+	if fields[0] == "-Y" {
+		for y := 0; y < h / 2; y++ {
+			a, b := img.Pix[3*w*y:3*w*(y+1)], img.Pix[3*w*(h-1-y):3*w*(h-y)]
+			for i := range a {
+				a[i], b[i] = b[i], a[i]
+			}
+		}
+	}
+
+	return img, nil
+}
+
+func rgbeToFloat(rgbe []byte, rgb []float32) {
+	if rgbe[3] == 0 {
+		rgb[0], rgb[1], rgb[2] = 0, 0, 0
+		return
+	}
+
+	f := math.Ldexp(1, int(rgbe[3]) - (128 + 8))
+	rgb[0] = float32((float64(rgbe[0]) + 0.5) * f)
+	rgb[1] = float32((float64(rgbe[1]) + 0.5) * f)
+	rgb[2] = float32((float64(rgbe[2]) + 0.5) * f)
+}
+
+// readRGBEScanline reads one scanline of w pixels into dst (4 bytes per
+// pixel), handling both flat and new-style run-length encoded scanlines.
+func readRGBEScanline(r *bufio.Reader, dst []byte, w int) error {
+	if _, err := io.ReadFull(r, dst[:4]); err != nil {
+		return errors.New("truncated Radiance pixel data")
+	}
+
+	if w < 8 || w > 0x7fff || dst[0] != 2 || dst[1] != 2 || dst[2] & 0x80 != 0 {
+		// flat scanline, the first pixel has been read already
+		if _, err := io.ReadFull(r, dst[4:]); err != nil {
+			return errors.New("truncated Radiance pixel data")
+		}
+		return nil
+	}
+
+	if int(dst[2]) << 8 | int(dst[3]) != w {
+		return errors.New("Radiance scanline width mismatch")
+	}
+
+	// RLE: the four components are stored one after another
+	for c := 0; c < 4; c++ {
+		for x := 0; x < w; {
+			count, err := r.ReadByte()
+			if err != nil {
+				return errors.New("truncated Radiance pixel data")
+			}
+
+			if count > 128 {
+				n := int(count) - 128
+				val, err := r.ReadByte()
+				if err != nil || x + n > w {
+					return errors.New("corrupt Radiance run")
+				}
+
+				for ; n > 0; n-- {
+					dst[4*x + c] = val
+					x++
+				}
+			} else {
+				n := int(count)
+				if n == 0 || x + n > w {
+					return errors.New("corrupt Radiance run")
+				}
+
+				for ; n > 0; n-- {
+					val, err := r.ReadByte()
+					if err != nil {
+						return errors.New("truncated Radiance pixel data")
+					}
+					dst[4*x + c] = val
+					x++
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package texture
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const hdrTestHeader = "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n"
+
+func TestDecodeHDRFlat(t *testing.T) {
+	// top row red, bottom row blue, at 1 (mantissa 128, exponent 129)
+	pix := []byte{
+		128, 0, 0, 129, 128, 0, 0, 129,
+		0, 0, 128, 129, 0, 0, 0, 0,
+	}
+
+	img, err := DecodeHDR(strings.NewReader(hdrTestHeader + "-Y 2 +X 2\n" + string(pix)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.W != 2 || img.H != 2 || img.Channels != 3 {
+		t.Fatalf("%dx%d with %d channels", img.W, img.H, img.Channels)
+	}
+
+	// FloatImage rows are bottom to top
+	want := map[[2]int][3]float32{
+		{ 0, 1 } : { 1, 0, 0 },
+		{ 1, 1 } : { 1, 0, 0 },
+		{ 0, 0 } : { 0, 0, 1 },
+		{ 1, 0 } : { 0, 0, 0 },
+	}
+
+	for p, rgb := range want {
+		px := img.At(p[0], p[1])
+		for c := 0; c < 3; c++ {
+			// + 0.5 of the mantissa
+			if d := px[c] - rgb[c]; d < 0 || d > 0.01 {
+				t.Errorf("pixel %v is %v, want %v", p, px, rgb)
+				break
+			}
+		}
+	}
+}
+
+// makeRLEHDR builds a w x 1 image with new-style RLE scanlines: a run for R
+// and G, literals for B and E.
+func makeRLEHDR(w int) []byte {
+	var b bytes.Buffer
+	b.WriteString(hdrTestHeader)
+	b.WriteString("+Y 1 +X " + strconv.Itoa(w) + "\n")
+
+	b.Write([]byte{ 2, 2, byte(w >> 8), byte(w) })
+
+	for c := 0; c < 2; c++ {
+		b.Write([]byte{ byte(128 + w), 64 })
+	}
+
+	b.WriteByte(byte(w))
+	for x := 0; x < w; x++ {
+		b.WriteByte(byte(x))
+	}
+
+	b.WriteByte(byte(w))
+	for x := 0; x < w; x++ {
+		b.WriteByte(129)
+	}
+
+	return b.Bytes()
+}
+
+func TestDecodeHDRRLE(t *testing.T) {
+	const w = 10
+
+	img, err := DecodeHDR(bytes.NewReader(makeRLEHDR(w)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for x := 0; x < w; x++ {
+		px := img.At(x, 0)
+		if px[0] != px[1] || px[0] < 0.5 || px[0] > 0.51 || px[2] != (float32(x) + 0.5) / 128 {
+			t.Errorf("pixel %d is %v", x, px)
+		}
+	}
+}
+
+func TestDecodeHDRTruncated(t *testing.T) {
+	for _, buf := range [][]byte{ makeRLEHDR(10), []byte(hdrTestHeader + "-Y 2 +X 2\n" + strings.Repeat("\x80", 16)) } {
+		for n := 0; n < len(buf); n++ {
+			if _, err := DecodeHDR(bytes.NewReader(buf[:n])); err == nil {
+				t.Errorf("no error for %d of %d bytes", n, len(buf))
+			}
+		}
+	}
+}
+
+func TestDecodeHDRInvalid(t *testing.T) {
+	for _, s := range []string{
+		hdrTestHeader + "-Y 0 +X 2\n",
+		hdrTestHeader + "+X 2 -Y 2\n",
+		"#?RADIANCE\nFORMAT=32-bit_rle_xyze\n\n-Y 1 +X 1\n\x00\x00\x00\x00",
+		"P6\n1 1\n255\n\x00\x00\x00",
+	} {
+		if _, err := DecodeHDR(strings.NewReader(s)); err == nil {
+			t.Errorf("no error for %q", s)
+		}
+	}
+
+	// runs longer than the scanline
+	buf := makeRLEHDR(10)
+	i := bytes.LastIndex(buf, []byte{ 2, 2, 0, 10 }) + 4
+	buf[i] = 128 + 100
+	if _, err := DecodeHDR(bytes.NewReader(buf)); err == nil {
+		t.Error("no error for overlong run")
+	}
+}
+
+// allocatedBy returns how many bytes f allocates.
+func allocatedBy(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// maxTestAlloc is how much decoding a short file with an oversized header
+// may allocate.
+const maxTestAlloc = 16 << 20
+
+func TestDecodeHDROversized(t *testing.T) {
+	for _, s := range []string{
+		hdrTestHeader + "-Y 100000000 +X 100000000\n",
+		hdrTestHeader + "-Y 1 +X 9223372036854775807\n",
+		// 57 bytes claiming 12 GiB
+		hdrTestHeader + "-Y 32768 +X 32768\n\x02\x02\x80\x00",
+		// within the limits, but the file ends after the first pixel
+		hdrTestHeader + "-Y 8192 +X 8192\n\x02\x02\x20\x00",
+	} {
+		var err error
+		n := allocatedBy(func() {
+			_, err = DecodeHDR(strings.NewReader(s))
+		})
+
+		if err == nil {
+			t.Errorf("no error for %q", s)
+		}
+		if n > maxTestAlloc {
+			t.Errorf("%d bytes allocated for %q", n, s)
+		}
+	}
+}
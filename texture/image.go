@@ -0,0 +1,72 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+)
+
+// ColorSpace tells how 8-bit image data is to be interpreted. Color textures
+// (albedo, emissive) are authored in sRGB and must be decoded to linear when
+// sampled; data textures (normal maps, roughness, masks) are linear already.
+type ColorSpace int
+
+const (
+	Linear ColorSpace = iota
+	SRGB
+)
+
+// LoadImage loads a PNG or JPEG file into an RGBA8 (Linear) or SRGB8_ALPHA8
+// (SRGB) texture, optionally with a generated mip chain.
+func LoadImage(path string, colorSpace ColorSpace, mipmaps bool) (*Texture2D, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return MakeFromImage(img, colorSpace, mipmaps), nil
+}
+
+// MakeFromImage uploads img, converting it to non-premultiplied RGBA and
+// flipping it so that the first row of img ends up at t = 1.
+func MakeFromImage(img image.Image, colorSpace ColorSpace, mipmaps bool) (t *Texture2D) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	rgba, ok := img.(*image.NRGBA)
+	if !ok || rgba.Stride != 4 * w {
+		rgba = image.NewNRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	}
+
+	flipped := make([]byte, 4 * w * h)
+	for y := 0; y < h; y++ {
+		copy(flipped[4*w*(h-1-y):4*w*(h-y)], rgba.Pix[y*rgba.Stride:y*rgba.Stride + 4*w])
+	}
+
+	internalFormat := gl.Enum(gl.RGBA8)
+	if colorSpace == SRGB {
+		internalFormat = gl.SRGB8_ALPHA8
+	}
+
+	levels := 1
+	if mipmaps {
+		levels = 0
+	}
+
+	t = Make2D(w, h, internalFormat, levels)
+	t.Upload(0, gl.RGBA, gl.UNSIGNED_BYTE, gl.Pointer(&flipped[0]))
+	t.GenerateMipmaps()
+
+	return
+}
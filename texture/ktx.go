@@ -0,0 +1,189 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var (
+	ktx1Identifier = []byte{ 0xAB, 'K', 'T', 'X', ' ', '1', '1', 0xBB, '\r', '\n', 0x1A, '\n' }
+	ktx2Identifier = []byte{ 0xAB, 'K', 'T', 'X', ' ', '2', '0', 0xBB, '\r', '\n', 0x1A, '\n' }
+)
+
+// ktx2Formats maps the VkFormat values we can upload to GL internal formats.
+var ktx2Formats = map[uint32]ddsFormat{
+	37 : { gl.RGBA8, gl.RGBA8, false }, // R8G8B8A8_UNORM
+	43 : { gl.SRGB8_ALPHA8, gl.SRGB8_ALPHA8, false }, // R8G8B8A8_SRGB
+	90 : { gl.RGB16F, gl.RGB16F, false }, // R16G16B16_SFLOAT
+	97 : { gl.RGBA16F, gl.RGBA16F, false }, // R16G16B16A16_SFLOAT
+	106 : { gl.RGB32F, gl.RGB32F, false }, // R32G32B32_SFLOAT
+	109 : { gl.RGBA32F, gl.RGBA32F, false }, // R32G32B32A32_SFLOAT
+	131 : { CompressedRGBDXT1, CompressedRGBDXT1, true }, // BC1_RGB_UNORM
+	132 : { CompressedSRGBDXT1, CompressedSRGBDXT1, true }, // BC1_RGB_SRGB
+	133 : { CompressedRGBADXT1, CompressedRGBADXT1, true }, // BC1_RGBA_UNORM
+	134 : { CompressedSRGBAlphaDXT1, CompressedSRGBAlphaDXT1, true }, // BC1_RGBA_SRGB
+	135 : { CompressedRGBADXT3, CompressedRGBADXT3, true }, // BC2_UNORM
+	136 : { CompressedSRGBAlphaDXT3, CompressedSRGBAlphaDXT3, true }, // BC2_SRGB
+	137 : { CompressedRGBADXT5, CompressedRGBADXT5, true }, // BC3_UNORM
+	138 : { CompressedSRGBAlphaDXT5, CompressedSRGBAlphaDXT5, true }, // BC3_SRGB
+	139 : { gl.COMPRESSED_RED_RGTC1, gl.COMPRESSED_RED_RGTC1, true }, // BC4_UNORM
+	140 : { gl.COMPRESSED_SIGNED_RED_RGTC1, gl.COMPRESSED_SIGNED_RED_RGTC1, true }, // BC4_SNORM
+	141 : { gl.COMPRESSED_RG_RGTC2, gl.COMPRESSED_RG_RGTC2, true }, // BC5_UNORM
+	142 : { gl.COMPRESSED_SIGNED_RG_RGTC2, gl.COMPRESSED_SIGNED_RG_RGTC2, true }, // BC5_SNORM
+	143 : { gl.COMPRESSED_RGB_BPTC_UNSIGNED_FLOAT, gl.COMPRESSED_RGB_BPTC_UNSIGNED_FLOAT, true }, // BC6H_UFLOAT
+	144 : { gl.COMPRESSED_RGB_BPTC_SIGNED_FLOAT, gl.COMPRESSED_RGB_BPTC_SIGNED_FLOAT, true }, // BC6H_SFLOAT
+	145 : { gl.COMPRESSED_RGBA_BPTC_UNORM, gl.COMPRESSED_RGBA_BPTC_UNORM, true }, // BC7_UNORM
+	146 : { gl.COMPRESSED_SRGB_ALPHA_BPTC_UNORM, gl.COMPRESSED_SRGB_ALPHA_BPTC_UNORM, true }, // BC7_SRGB
+}
+
+// LoadKTX loads a 2D KTX or KTX2 texture including its prebuilt mip chain.
+// The internal format is taken from the file, so the color space is encoded
+// there as well. Supercompressed KTX2 files (Basis, zstd) are not supported.
+func LoadKTX(path string) (*Texture2D, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := DecodeKTX(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return MakeFromImageData(d, true)
+}
+
+// DecodeKTX parses a KTX 1.1 or KTX 2.0 file held in buf.
+func DecodeKTX(buf []byte) (*ImageData, error) {
+	switch {
+	case bytes.HasPrefix(buf, ktx1Identifier):
+		return decodeKTX1(buf)
+	case bytes.HasPrefix(buf, ktx2Identifier):
+		return decodeKTX2(buf)
+	}
+
+	return nil, errors.New("not a KTX file")
+}
+
+func decodeKTX1(buf []byte) (*ImageData, error) {
+	if len(buf) < 64 {
+		return nil, errors.New("truncated KTX header")
+	}
+
+	var bo binary.ByteOrder = binary.LittleEndian
+	switch binary.LittleEndian.Uint32(buf[12:]) {
+	case 0x04030201:
+	case 0x01020304:
+		bo = binary.BigEndian
+	default:
+		return nil, errors.New("invalid KTX endianness field")
+	}
+
+	glType := gl.Enum(bo.Uint32(buf[16:]))
+	glFormat := gl.Enum(bo.Uint32(buf[24:]))
+	internalFormat := gl.Enum(bo.Uint32(buf[28:]))
+	w := int(bo.Uint32(buf[36:]))
+	h := int(bo.Uint32(buf[40:]))
+	depth := bo.Uint32(buf[44:])
+	arrayElements := bo.Uint32(buf[48:])
+	faces := bo.Uint32(buf[52:])
+	mipCount := int(bo.Uint32(buf[56:]))
+	kvBytes := int(bo.Uint32(buf[60:]))
+
+	if h == 0 || depth > 1 || arrayElements > 0 || faces != 1 {
+		return nil, errors.New("only 2D KTX textures are supported")
+	}
+	if err := checkImageSize(w, h); err != nil {
+		return nil, err
+	}
+	if mipCount == 0 {
+		mipCount = 1
+	}
+
+	d := &ImageData{ W : w, H : h, InternalFormat : internalFormat, Compressed : glType == 0, Format : glFormat, Type : glType }
+	if d.Compressed && !IsCompressedFormat(internalFormat) {
+		return nil, fmt.Errorf("unsupported compressed format 0x%x", internalFormat)
+	}
+
+	offset := 64 + kvBytes
+	for i := 0; i < mipCount; i++ {
+		if offset + 4 > len(buf) {
+			return nil, fmt.Errorf("truncated mip level %d", i)
+		}
+
+		size := int(bo.Uint32(buf[offset:]))
+		offset += 4
+		if offset + size > len(buf) {
+			return nil, fmt.Errorf("truncated mip level %d", i)
+		}
+
+		d.Levels = append(d.Levels, buf[offset : offset+size])
+		offset += (size + 3) &^ 3
+	}
+
+	return d, nil
+}
+
+func decodeKTX2(buf []byte) (*ImageData, error) {
+	le := binary.LittleEndian
+
+	if len(buf) < 80 {
+		return nil, errors.New("truncated KTX2 header")
+	}
+
+	vkFormat := le.Uint32(buf[12:])
+	w := int(le.Uint32(buf[20:]))
+	h := int(le.Uint32(buf[24:]))
+	depth := le.Uint32(buf[28:])
+	layers := le.Uint32(buf[32:])
+	faces := le.Uint32(buf[36:])
+	mipCount := int(le.Uint32(buf[40:]))
+	supercompression := le.Uint32(buf[44:])
+
+	if supercompression != 0 {
+		return nil, fmt.Errorf("unsupported supercompression scheme %d", supercompression)
+	}
+	if h == 0 || depth > 0 || layers > 0 || faces != 1 {
+		return nil, errors.New("only 2D KTX2 textures are supported")
+	}
+	if err := checkImageSize(w, h); err != nil {
+		return nil, err
+	}
+	if mipCount == 0 {
+		mipCount = 1
+	}
+
+	f, ok := ktx2Formats[vkFormat]
+	if !ok {
+		return nil, fmt.Errorf("unsupported VkFormat %d", vkFormat)
+	}
+
+	d := &ImageData{ W : w, H : h, InternalFormat : f.internalFormat, Compressed : f.compressed }
+	if !d.Compressed {
+		info, _ := GetFormatInfo(d.InternalFormat)
+		d.Format, d.Type = info.Format, info.Type
+	}
+
+	// level index: byteOffset, byteLength, uncompressedByteLength per level
+	if len(buf) < 80 + 24 * mipCount {
+		return nil, errors.New("truncated KTX2 level index")
+	}
+
+	for i := 0; i < mipCount; i++ {
+		offset := int(le.Uint64(buf[80 + 24*i:]))
+		size := int(le.Uint64(buf[80 + 24*i + 8:]))
+
+		// offset + size may overflow
+		if offset < 0 || size < 0 || size > len(buf) - offset {
+			return nil, fmt.Errorf("truncated mip level %d", i)
+		}
+
+		d.Levels = append(d.Levels, buf[offset : offset+size])
+	}
+
+	return d, nil
+}
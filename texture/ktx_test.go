@@ -0,0 +1,121 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"encoding/binary"
+	"testing"
+)
+
+// makeKTX1 builds an uncompressed RGBA8 KTX 1.1 file with one level.
+func makeKTX1(bo binary.ByteOrder, w, h int) []byte {
+	buf := make([]byte, 64)
+	copy(buf, ktx1Identifier)
+	bo.PutUint32(buf[12:], 0x04030201)
+	bo.PutUint32(buf[16:], uint32(gl.UNSIGNED_BYTE))
+	bo.PutUint32(buf[20:], 1)
+	bo.PutUint32(buf[24:], uint32(gl.RGBA))
+	bo.PutUint32(buf[28:], uint32(gl.RGBA8))
+	bo.PutUint32(buf[32:], uint32(gl.RGBA))
+	bo.PutUint32(buf[36:], uint32(w))
+	bo.PutUint32(buf[40:], uint32(h))
+	bo.PutUint32(buf[52:], 1)
+	bo.PutUint32(buf[56:], 1)
+
+	size := make([]byte, 4)
+	bo.PutUint32(size, 16)
+	buf = append(buf, size...)
+	return append(buf, make([]byte, 16)...)
+}
+
+// makeKTX2 builds a KTX 2.0 file of vkFormat with one level of payload.
+func makeKTX2(vkFormat uint32, w, h int, payload []byte) []byte {
+	le := binary.LittleEndian
+
+	buf := make([]byte, 80 + 24)
+	copy(buf, ktx2Identifier)
+	le.PutUint32(buf[12:], vkFormat)
+	le.PutUint32(buf[20:], uint32(w))
+	le.PutUint32(buf[24:], uint32(h))
+	le.PutUint32(buf[36:], 1)
+	le.PutUint32(buf[40:], 1)
+	le.PutUint64(buf[80:], uint64(len(buf)))
+	le.PutUint64(buf[88:], uint64(len(payload)))
+
+	return append(buf, payload...)
+}
+
+func TestDecodeKTX1(t *testing.T) {
+	for _, bo := range []binary.ByteOrder{ binary.LittleEndian, binary.BigEndian } {
+		d, err := DecodeKTX(makeKTX1(bo, 2, 2))
+		if err != nil {
+			t.Fatalf("%v: %v", bo, err)
+		}
+
+		if d.W != 2 || d.H != 2 || d.Compressed || d.InternalFormat != gl.RGBA8 || d.Format != gl.RGBA || d.Type != gl.UNSIGNED_BYTE || len(d.Levels) != 1 || len(d.Levels[0]) != 16 {
+			t.Errorf("%v: unexpected image %+v", bo, d)
+		}
+	}
+}
+
+func TestDecodeKTX2(t *testing.T) {
+	d, err := DecodeKTX(makeKTX2(37, 2, 2, make([]byte, 16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.W != 2 || d.H != 2 || d.Compressed || d.InternalFormat != gl.RGBA8 || len(d.Levels) != 1 || len(d.Levels[0]) != 16 {
+		t.Errorf("unexpected image %+v", d)
+	}
+
+	if d, err = DecodeKTX(makeKTX2(145, 4, 4, make([]byte, 16))); err != nil {
+		t.Fatal(err)
+	}
+
+	if !d.Compressed || d.InternalFormat != gl.COMPRESSED_RGBA_BPTC_UNORM {
+		t.Errorf("BC7: unexpected image %+v", d)
+	}
+}
+
+func TestDecodeKTXTruncated(t *testing.T) {
+	for _, buf := range [][]byte{ makeKTX1(binary.LittleEndian, 2, 2), makeKTX2(37, 2, 2, make([]byte, 16)) } {
+		for n := 0; n < len(buf); n++ {
+			if _, err := DecodeKTX(buf[:n]); err == nil {
+				t.Errorf("no error for %d of %d bytes", n, len(buf))
+			}
+		}
+	}
+}
+
+func TestDecodeKTXOversized(t *testing.T) {
+	bufs := [][]byte{
+		makeKTX1(binary.LittleEndian, 0xffffffff, 0xffffffff),
+		makeKTX2(37, 0xffffffff, 0xffffffff, make([]byte, 16)),
+	}
+
+	// level index pointing far past the end, offset + size overflowing
+	buf := makeKTX2(37, 2, 2, make([]byte, 16))
+	binary.LittleEndian.PutUint64(buf[80:], 1 << 62)
+	binary.LittleEndian.PutUint64(buf[88:], 1 << 62)
+	bufs = append(bufs, buf)
+
+	// more levels than the level index holds
+	buf = makeKTX2(37, 2, 2, make([]byte, 16))
+	binary.LittleEndian.PutUint32(buf[40:], 0xffffffff)
+	bufs = append(bufs, buf)
+
+	for i, buf := range bufs {
+		if _, err := DecodeKTX(buf); err == nil {
+			t.Errorf("no error for file %d", i)
+		}
+	}
+}
+
+func TestDecodeKTXUnsupported(t *testing.T) {
+	if _, err := DecodeKTX(makeKTX2(1, 2, 2, make([]byte, 16))); err == nil {
+		t.Error("no error for unknown VkFormat")
+	}
+
+	if _, err := DecodeKTX([]byte("not a texture at all")); err == nil {
+		t.Error("no error for garbage")
+	}
+}
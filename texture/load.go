@@ -0,0 +1,41 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// LoadFile picks a loader by file extension. colorSpace applies to 8-bit
+// images and DDS files; HDR and EXR images are linear and loaded as RGB16F
+// and RGBA16F, KTX files carry their own internal format.
+func LoadFile(path string, colorSpace ColorSpace) (*Texture2D, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg":
+		return LoadImage(path, colorSpace, true)
+	case ".hdr":
+		return LoadHDR(path, gl.RGB16F, true)
+	case ".exr":
+		return LoadEXR(path, gl.RGBA16F, true)
+	case ".dds":
+		return LoadDDS(path, colorSpace)
+	case ".ktx", ".ktx2":
+		return LoadKTX(path)
+	}
+
+	return nil, fmt.Errorf("%s: unknown texture file type", path)
+}
+
+// WriteFile picks a writer by file extension. mode applies to PNG only, EXR
+// files keep the raw float values.
+func WriteFile(path string, img *FloatImage, mode PNGMode) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		return WritePNG(path, img, mode)
+	case ".exr":
+		return WriteEXR(path, img)
+	}
+
+	return fmt.Errorf("%s: unknown image file type", path)
+}
@@ -0,0 +1,60 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"fmt"
+)
+
+// ReadTexture copies one mip level of a 2D texture to CPU memory. Color and
+// depth formats are converted to float by GL; integer formats (e.g. the
+// material ID channel) are read as unsigned integers and converted here.
+// This stalls the pipeline and is meant for debugging only.
+func ReadTexture(tex gl.Uint, level int) (*FloatImage, error) {
+	gl.BindTexture(gl.TEXTURE_2D, tex)
+	defer gl.BindTexture(gl.TEXTURE_2D, 0)
+
+	var w, h, internalFormat gl.Int
+	gl.GetTexLevelParameteriv(gl.TEXTURE_2D, gl.Int(level), gl.TEXTURE_WIDTH, &w)
+	gl.GetTexLevelParameteriv(gl.TEXTURE_2D, gl.Int(level), gl.TEXTURE_HEIGHT, &h)
+	gl.GetTexLevelParameteriv(gl.TEXTURE_2D, gl.Int(level), gl.TEXTURE_INTERNAL_FORMAT, &internalFormat)
+
+	if w == 0 || h == 0 {
+		return nil, fmt.Errorf("texture %d has no level %d", tex, level)
+	}
+
+	info, ok := GetFormatInfo(gl.Enum(internalFormat))
+	if !ok {
+		return nil, fmt.Errorf("readback of internal format 0x%x is not supported", internalFormat)
+	}
+
+	gl.PixelStorei(gl.PACK_ALIGNMENT, 1)
+	defer gl.PixelStorei(gl.PACK_ALIGNMENT, 4)
+
+	switch {
+	case info.Depth:
+		// the stencil part of packed formats is dropped
+		img := MakeFloatImage(int(w), int(h), 1)
+		gl.GetTexImage(gl.TEXTURE_2D, gl.Int(level), gl.DEPTH_COMPONENT, gl.FLOAT, gl.Pointer(&img.Pix[0]))
+		return img, nil
+
+	case info.Format == gl.RED_INTEGER:
+		raw := make([]uint32, int(w) * int(h))
+		gl.GetTexImage(gl.TEXTURE_2D, gl.Int(level), gl.RED_INTEGER, gl.UNSIGNED_INT, gl.Pointer(&raw[0]))
+
+		img := MakeFloatImage(int(w), int(h), 1)
+		for i, v := range raw {
+			img.Pix[i] = float32(v)
+		}
+		return img, nil
+	}
+
+	img := MakeFloatImage(int(w), int(h), info.Channels)
+	gl.GetTexImage(gl.TEXTURE_2D, gl.Int(level), floatTransferFormat(info.Channels), gl.FLOAT, gl.Pointer(&img.Pix[0]))
+
+	return img, nil
+}
+
+// Read copies mip level 0 of t to CPU memory, see ReadTexture.
+func (t *Texture2D) Read() (*FloatImage, error) {
+	return ReadTexture(t.GetHandle(), 0)
+}
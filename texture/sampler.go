@@ -0,0 +1,194 @@
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/gldebug"
+)
+
+// anisotropic filtering is core only since GL 4.6 (ARB/EXT_texture_filter_anisotropic before)
+const (
+	textureMaxAnisotropy = 0x84FE
+	maxTextureMaxAnisotropy = 0x84FF
+)
+
+// SamplerDesc fully describes a sampler object.
+type SamplerDesc struct {
+	State SamplerState
+	MaxAnisotropy float32 // <= 1 disables anisotropic filtering
+	Compare bool // depth comparison (sampler2DShadow)
+	BorderColor [4]float32 // used with gl.CLAMP_TO_BORDER
+}
+
+// Sampler is a GL sampler object. Bound to a texture unit it overrides the
+// filter, wrap and compare state of whatever texture is bound there.
+type Sampler struct {
+	handle gl.Uint
+	desc SamplerDesc
+}
+
+func MakeSampler(desc SamplerDesc) (s *Sampler) {
+	s = &Sampler{ desc : desc }
+
+	gl.GenSamplers(1, &s.handle)
+	gldebug.Track(gldebug.Sampler, s.handle)
+
+	gl.SamplerParameteri(s.handle, gl.TEXTURE_MIN_FILTER, gl.Int(desc.State.MinFilter))
+	gl.SamplerParameteri(s.handle, gl.TEXTURE_MAG_FILTER, gl.Int(desc.State.MagFilter))
+	gl.SamplerParameteri(s.handle, gl.TEXTURE_WRAP_S, gl.Int(desc.State.WrapS))
+	gl.SamplerParameteri(s.handle, gl.TEXTURE_WRAP_T, gl.Int(desc.State.WrapT))
+	gl.SamplerParameteri(s.handle, gl.TEXTURE_WRAP_R, gl.Int(desc.State.WrapT))
+
+	borderColor := []gl.Float{ gl.Float(desc.BorderColor[0]), gl.Float(desc.BorderColor[1]), gl.Float(desc.BorderColor[2]), gl.Float(desc.BorderColor[3]) }
+	gl.SamplerParameterfv(s.handle, gl.TEXTURE_BORDER_COLOR, &(borderColor[0]))
+
+	if desc.Compare {
+		gl.SamplerParameteri(s.handle, gl.TEXTURE_COMPARE_MODE, gl.COMPARE_REF_TO_TEXTURE)
+		gl.SamplerParameteri(s.handle, gl.TEXTURE_COMPARE_FUNC, gl.LEQUAL)
+	}
+
+	if a := clampAnisotropy(desc.MaxAnisotropy); a > 1 {
+		gl.SamplerParameterf(s.handle, textureMaxAnisotropy, gl.Float(a))
+	}
+
+	return
+}
+
+func (s *Sampler) Delete() {
+	if s.handle == 0 {
+		return
+	}
+
+	gldebug.Untrack(gldebug.Sampler, s.handle)
+	gl.DeleteSamplers(1, &s.handle)
+	s.handle = 0
+}
+
+func (s *Sampler) GetHandle() gl.Uint {
+	return s.handle
+}
+
+func (s *Sampler) GetDesc() SamplerDesc {
+	return s.desc
+}
+
+// Bind binds the sampler to texture unit unit (0 = gl.TEXTURE0).
+func (s *Sampler) Bind(unit int) {
+	gl.BindSampler(gl.Uint(unit), s.handle)
+}
+
+func (_ *Sampler) Unbind(unit int) {
+	gl.BindSampler(gl.Uint(unit), 0)
+}
+
+// BindUnit binds tex and sampler s to texture unit unit.
+func BindUnit(unit int, tex gl.Uint, s *Sampler) {
+	BindUnitTarget(unit, gl.TEXTURE_2D, tex, s)
+}
+
+// BindUnitTarget is BindUnit for textures other than gl.TEXTURE_2D, e.g.
+// gl.TEXTURE_2D_MULTISAMPLE, gl.TEXTURE_2D_ARRAY or gl.TEXTURE_CUBE_MAP.
+func BindUnitTarget(unit int, target gl.Enum, tex gl.Uint, s *Sampler) {
+	gl.ActiveTexture(gl.TEXTURE0 + gl.Enum(unit))
+	gl.BindTexture(target, tex)
+	s.Bind(unit)
+}
+
+// UnbindUnit clears both the texture and the sampler binding of unit and
+// leaves gl.TEXTURE0 active.
+func UnbindUnit(unit int) {
+	UnbindUnitTarget(unit, gl.TEXTURE_2D)
+}
+
+func UnbindUnitTarget(unit int, target gl.Enum) {
+	gl.ActiveTexture(gl.TEXTURE0 + gl.Enum(unit))
+	gl.BindTexture(target, 0)
+	gl.BindSampler(gl.Uint(unit), 0)
+	gl.ActiveTexture(gl.TEXTURE0)
+}
+
+// SamplerKind names one of the shared sampler configurations.
+type SamplerKind int
+
+const (
+	LinearClamp SamplerKind = iota
+	NearestClamp
+	TrilinearRepeat // with anisotropic filtering, see SetMaxAnisotropy
+	ShadowCompare // linear PCF depth compare, outside of the map (zero border) is shadowed
+	numSamplerKinds
+)
+
+var (
+	samplerCache [numSamplerKinds]*Sampler
+	maxAnisotropy float32 = 16
+	hwMaxAnisotropy float32 // queried on first use
+)
+
+func samplerDesc(kind SamplerKind) SamplerDesc {
+	switch kind {
+	case NearestClamp:
+		return SamplerDesc{ State : NearestClampState }
+	case TrilinearRepeat:
+		return SamplerDesc{ State : TrilinearRepeatState, MaxAnisotropy : maxAnisotropy }
+	case ShadowCompare:
+		return SamplerDesc{ State : SamplerState{ gl.LINEAR, gl.LINEAR, gl.CLAMP_TO_BORDER, gl.CLAMP_TO_BORDER }, Compare : true }
+	}
+
+	return SamplerDesc{ State : LinearClampState }
+}
+
+// GetSampler returns the shared sampler of the given kind, creating it on
+// first use. Shared samplers are freed by DeleteSamplers.
+func GetSampler(kind SamplerKind) *Sampler {
+	if samplerCache[kind] == nil {
+		samplerCache[kind] = MakeSampler(samplerDesc(kind))
+	}
+
+	return samplerCache[kind]
+}
+
+func DeleteSamplers() {
+	for i, s := range samplerCache {
+		if s != nil {
+			s.Delete()
+			samplerCache[i] = nil
+		}
+	}
+}
+
+// SetMaxAnisotropy sets the anisotropy level used by TrilinearRepeat,
+// clamped to what the hardware supports. 1 disables anisotropic filtering.
+func SetMaxAnisotropy(a float32) {
+	maxAnisotropy = a
+
+	if s := samplerCache[TrilinearRepeat]; s != nil {
+		s.Delete()
+		samplerCache[TrilinearRepeat] = nil
+	}
+}
+
+// GetMaxAnisotropy returns the effective anisotropy level of TrilinearRepeat.
+func GetMaxAnisotropy() float32 {
+	return clampAnisotropy(maxAnisotropy)
+}
+
+func clampAnisotropy(a float32) float32 {
+	if a <= 1 {
+		return 1
+	}
+
+	if hwMaxAnisotropy == 0 {
+		var v gl.Float
+		gl.GetFloatv(maxTextureMaxAnisotropy, &v)
+		hwMaxAnisotropy = float32(v)
+
+		if hwMaxAnisotropy < 1 { // extension missing, query failed
+			hwMaxAnisotropy = 1
+		}
+	}
+
+	if a > hwMaxAnisotropy {
+		return hwMaxAnisotropy
+	}
+
+	return a
+}
@@ -0,0 +1,145 @@
+// Package texture wraps GL texture objects and loads them from image files.
+package texture
+
+import (
+	gl "github.com/chsc/gogl/gl43"
+	"github.com/rwesterteiger/go-gltest/gldebug"
+)
+
+// SamplerState is the filtering and addressing state stored in a texture
+// object.
+type SamplerState struct {
+	MinFilter gl.Enum
+	MagFilter gl.Enum
+	WrapS gl.Enum
+	WrapT gl.Enum
+}
+
+var (
+	LinearClampState = SamplerState{ gl.LINEAR, gl.LINEAR, gl.CLAMP_TO_EDGE, gl.CLAMP_TO_EDGE }
+	NearestClampState = SamplerState{ gl.NEAREST, gl.NEAREST, gl.CLAMP_TO_EDGE, gl.CLAMP_TO_EDGE }
+	TrilinearRepeatState = SamplerState{ gl.LINEAR_MIPMAP_LINEAR, gl.LINEAR, gl.REPEAT, gl.REPEAT }
+)
+
+// Texture2D is an immutable-storage 2D texture.
+type Texture2D struct {
+	handle gl.Uint
+	w, h int
+	levels int
+	internalFormat gl.Enum
+	sampler SamplerState
+}
+
+// Make2D allocates storage for a w x h texture with the given sized internal
+// format. levels == 0 allocates the full mip chain.
+func Make2D(w, h int, internalFormat gl.Enum, levels int) (t *Texture2D) {
+	if levels == 0 {
+		levels = FullMipChainLevels(w, h)
+	}
+
+	t = &Texture2D{ w : w, h : h, levels : levels, internalFormat : internalFormat }
+
+	gl.GenTextures(1, &t.handle)
+	gldebug.Track(gldebug.Texture, t.handle)
+
+	gl.BindTexture(gl.TEXTURE_2D, t.handle)
+	gl.TexStorage2D(gl.TEXTURE_2D, gl.Sizei(levels), internalFormat, gl.Sizei(w), gl.Sizei(h))
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+
+	if levels > 1 {
+		t.SetSamplerState(TrilinearRepeatState)
+	} else {
+		t.SetSamplerState(LinearClampState)
+	}
+
+	return
+}
+
+func (t *Texture2D) Delete() {
+	if t.handle == 0 {
+		return
+	}
+
+	gldebug.Untrack(gldebug.Texture, t.handle)
+	gl.DeleteTextures(1, &t.handle)
+	t.handle = 0
+}
+
+func (t *Texture2D) GetHandle() gl.Uint {
+	return t.handle
+}
+
+func (t *Texture2D) GetSize() (w, h int) {
+	return t.w, t.h
+}
+
+func (t *Texture2D) GetLevels() int {
+	return t.levels
+}
+
+func (t *Texture2D) GetInternalFormat() gl.Enum {
+	return t.internalFormat
+}
+
+func (t *Texture2D) GetSamplerState() SamplerState {
+	return t.sampler
+}
+
+func (t *Texture2D) SetSamplerState(state SamplerState) {
+	t.sampler = state
+
+	gl.BindTexture(gl.TEXTURE_2D, t.handle)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.Int(state.MinFilter))
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.Int(state.MagFilter))
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.Int(state.WrapS))
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.Int(state.WrapT))
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+}
+
+// Upload replaces the contents of one mip level. format/type describe data,
+// e.g. gl.RGBA/gl.UNSIGNED_BYTE.
+func (t *Texture2D) Upload(level int, format, dataType gl.Enum, data gl.Pointer) {
+	w, h := t.GetLevelSize(level)
+
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+	gl.BindTexture(gl.TEXTURE_2D, t.handle)
+	gl.TexSubImage2D(gl.TEXTURE_2D, gl.Int(level), 0, 0, gl.Sizei(w), gl.Sizei(h), format, dataType, data)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+}
+
+// GenerateMipmaps fills levels 1..n-1 from level 0. For sRGB textures the
+// driver averages in linear space.
+func (t *Texture2D) GenerateMipmaps() {
+	if t.levels < 2 {
+		return
+	}
+
+	gl.BindTexture(gl.TEXTURE_2D, t.handle)
+	gl.GenerateMipmap(gl.TEXTURE_2D)
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+}
+
+func (t *Texture2D) GetLevelSize(level int) (w, h int) {
+	w, h = t.w >> uint(level), t.h >> uint(level)
+
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	return
+}
+
+// Bind binds the texture to texture unit unit (0 = gl.TEXTURE0).
+func (t *Texture2D) Bind(unit int) {
+	gl.ActiveTexture(gl.TEXTURE0 + gl.Enum(unit))
+	gl.BindTexture(gl.TEXTURE_2D, t.handle)
+}
+
+func (_ *Texture2D) Unbind(unit int) {
+	gl.ActiveTexture(gl.TEXTURE0 + gl.Enum(unit))
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+}